@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Health is the /healthz response, one call with everything fleet monitoring needs
+type Health struct {
+	Healthy     bool              `json:"healthy"`
+	Health      string            `json:"health"`
+	ErrorFiles  int               `json:"error_files"`
+	BufferBytes int               `json:"buffered_bytes"`
+	BufferKeys  int               `json:"buffered_keys"`
+	OldestAge   float64           `json:"oldest_batch_age_sec"`
+	LastFlush   string            `json:"last_flush,omitempty"`
+	Upstreams   map[string]string `json:"upstreams,omitempty"`
+	Version     string            `json:"version"`
+}
+
+// Validation is the /validate response, what proxyhouse would do with the insert
+type Validation struct {
+	Key       string `json:"key"`
+	Table     string `json:"table"`
+	Delimiter string `json:"delimiter"`
+	Rows      int    `json:"rows"`
+	Bytes     int    `json:"bytes"`
+	Upstream  string `json:"upstream"`
+}
+
+// DumpEntry describes a buffered key saved by /dump, the data is in File
+type DumpEntry struct {
+	Key     string    `json:"key"`
+	Table   string    `json:"table"`
+	Rows    int       `json:"rows"`
+	Bytes   int       `json:"bytes"`
+	Created time.Time `json:"created"`
+	File    string    `json:"file"`
+}
+
+// BufferEntry is a buffered key in the /buffers response
+type BufferEntry struct {
+	Key     string    `json:"key"`
+	Table   string    `json:"table"`
+	Rows    int       `json:"rows"`
+	Bytes   int       `json:"bytes"`
+	Created time.Time `json:"created"`
+	AgeSec  float64   `json:"age_sec"`
+}
+
+// adminonly wraps admin handlers and checks the X-Admin-Token header if -admintoken is set,
+// every admin action (not GET) is logged by audit
+func adminonly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg().admintoken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(cfg().admintoken)) != 1 {
+			grlog(LEVEL_WARN, fmt.Sprintf("Admin access denied: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr), Fields{"component": "admin"})
+			http.Error(w, "403 forbidden.", http.StatusForbidden)
+			return
+		}
+		if r.Method == "GET" {
+			h(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		audit(r, rec.status)
+	}
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// audit logs who called an admin action and its result
+func audit(r *http.Request, status int) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	token := "none"
+	if t := r.Header.Get("X-Admin-Token"); t != "" {
+		token = fmt.Sprintf("%x", sha256.Sum256([]byte(t)))[:8]
+	}
+	grlog(LEVEL_INFO, "audit", Fields{"component": "admin", "action": r.URL.Path, "ip": ip, "token": token, "status": status})
+}
+
+func showhealthz(w http.ResponseWriter, r *http.Request) {
+	errcount := errorCount()
+	keys, size, oldest := store.stats()
+	health := Health{
+		Healthy:     errcount < cfg().critlevel,
+		Health:      "ok",
+		ErrorFiles:  errcount,
+		BufferBytes: size,
+		BufferKeys:  keys,
+		Version:     version,
+	}
+	if !oldest.IsZero() {
+		health.OldestAge = time.Since(oldest).Seconds()
+	}
+	if last := atomic.LoadInt64(&lastFlush); last > 0 {
+		health.LastFlush = time.Unix(0, last).UTC().Format(time.RFC3339)
+	}
+	// an ejected upstream leaves the rest of the rotation working, degraded not unhealthy
+	for _, u := range upstreamHealth.States() {
+		if health.Upstreams == nil {
+			health.Upstreams = make(map[string]string)
+		}
+		health.Upstreams[hidePassword(u[0])] = u[1]
+		if u[1] == "ejected" {
+			health.Health = "degraded"
+		}
+	}
+	if !health.Healthy {
+		health.Health = "unhealthy"
+	}
+
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// dovalidate runs the insert through the key, format and table detection of
+// dorequest without buffering or forwarding anything, the upstream shown is
+// the next one without taking its turn
+func dovalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := headerQuery(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stripCredentials(r.URL)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	if cfg().multipartfield != "" && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if body, err = multipartBody(r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// the insert is checked as if posted to / instead of /validate
+	r.URL.Path, r.URL.RawPath = "/", ""
+	ins := parseInsert(r)
+	body, rows := ins.rows(body, time.Now())
+	validation := Validation{
+		Key:       hidePassword(ins.key),
+		Table:     ins.table,
+		Delimiter: string(ins.delimiter),
+		Rows:      rows,
+		Bytes:     len(body),
+		Upstream:  hidePassword(previewURI(ins.uri)),
+	}
+
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(validation)
+}
+
+// doconfig changes settings at runtime, POST /config?syncsec=N
+func doconfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	if v := r.URL.Query().Get("syncsec"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec <= 0 {
+			http.Error(w, "syncsec must be a positive number.", http.StatusBadRequest)
+			return
+		}
+		grlog(LEVEL_INFO, "Sync interval changed from ", store.syncInterval(), " to ", time.Duration(sec)*time.Second)
+		store.setInterval(time.Duration(sec) * time.Second)
+	}
+	w.Header().Set("Server", "proxyhouse "+version)
+	fmt.Fprintf(w, "syncsec:%d\r\n", int(store.syncInterval()/time.Second))
+}
+
+// showrecenterrors returns the last upstream error responses by table
+func showrecenterrors(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recentErrors.Get())
+}
+
+// dodump saves a copy of every buffered key to a new directory under -dumpdir,
+// the buffer is left as is. The directory has index.json and one data file per key
+func dodump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	var entries []DumpEntry
+	var data [][]byte
+	store.RLock()
+	for key, val := range store.Req {
+		entries = append(entries, DumpEntry{
+			Key:     hidePassword(key),
+			Table:   val.table,
+			Rows:    val.rowcount,
+			Bytes:   len(val.buffer),
+			Created: val.created,
+			File:    fmt.Sprintf("%d.data", len(entries)),
+		})
+		data = append(data, append([]byte(nil), val.buffer...))
+	}
+	store.RUnlock()
+
+	dir := filepath.Join(cfg().dumpdir, strconv.FormatInt(time.Now().UnixNano(), 10))
+	err := os.MkdirAll(dir, 0755)
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = ioutil.WriteFile(filepath.Join(dir, entries[i].File), data[i], 0644)
+	}
+	if err == nil {
+		var index []byte
+		index, err = json.MarshalIndent(entries, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644)
+		}
+	}
+	if err != nil {
+		grlog(LEVEL_ERR, "Dump error: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	grlog(LEVEL_INFO, "Dumped ", len(entries), " keys to ", dir)
+	w.Header().Set("Server", "proxyhouse "+version)
+	fmt.Fprintf(w, "dump:%s\r\nkeys:%d\r\n", dir, len(entries))
+}
+
+// showbuffers lists the buffered keys, the oldest first, what waits in memory
+// for the next sync
+func showbuffers(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	entries := []BufferEntry{}
+	store.RLock()
+	for key, val := range store.Req {
+		entries = append(entries, BufferEntry{
+			Key:     hidePassword(key),
+			Table:   val.table,
+			Rows:    val.rowcount,
+			Bytes:   len(val.buffer),
+			Created: val.created,
+			AgeSec:  now.Sub(val.created).Seconds(),
+		})
+	}
+	store.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// dopause stops flushing for clickhouse maintenance, the buffer grows up to
+// -maxstorebytes and -maxkeys, over them inserts get 503
+func dopause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	store.pause()
+	grlog(LEVEL_WARN, "Flushing paused")
+	w.Header().Set("Server", "proxyhouse "+version)
+	fmt.Fprint(w, "paused:1\r\n")
+}
+
+// doresume starts flushing again
+func doresume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	store.resume()
+	grlog(LEVEL_WARN, "Flushing resumed")
+	w.Header().Set("Server", "proxyhouse "+version)
+	fmt.Fprint(w, "paused:0\r\n")
+}
+
+// dashboardPage is the /dashboard html, plain markup and a reload timer so
+// it works without any external files
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>proxyhouse {{.Version}}</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td { border-bottom: 1px solid #ddd; padding: 2px 12px 2px 0; }
+.bad { color: #c00; }
+</style>
+</head>
+<body>
+<h2>proxyhouse {{.Version}}</h2>
+<table>
+<tr><td>status</td><td{{if .Bad}} class="bad"{{end}}>{{.Status}}{{if .Paused}}, paused{{end}}</td></tr>
+<tr><td>error files</td><td>{{.ErrorFiles}}</td></tr>
+<tr><td>buffered keys</td><td>{{.BufferKeys}}</td></tr>
+<tr><td>buffered bytes</td><td>{{.BufferBytes}}</td></tr>
+<tr><td>oldest batch age</td><td>{{printf "%.1f" .OldestAge}}s</td></tr>
+<tr><td>last flush</td><td>{{if .LastFlush}}{{.LastFlush}}{{else}}never{{end}}</td></tr>
+</table>
+<table>
+{{range .Statistic}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+<p>updated {{.Now}}, refresh every {{.Refresh}}s</p>
+<script>setTimeout(function() { location.reload(); }, {{.Refresh}} * 1000);</script>
+</body>
+</html>
+`))
+
+// showdashboard renders /status, /statistic and the buffer state as a page
+// for a quick look without graphite
+func showdashboard(w http.ResponseWriter, r *http.Request) {
+	refresh := 5
+	if v, err := strconv.Atoi(r.URL.Query().Get("refresh")); err == nil && v > 0 {
+		refresh = v
+	}
+	errcount := errorCount()
+	keys, size, oldest := store.stats()
+	data := struct {
+		Version, Status, LastFlush, Now string
+		Bad, Paused                     bool
+		ErrorFiles, BufferKeys          int
+		BufferBytes, Refresh            int
+		OldestAge                       float64
+		Statistic                       [][2]string
+	}{
+		Version:     version,
+		Status:      strings.TrimSpace(lastStatus()),
+		Now:         time.Now().UTC().Format(time.RFC3339),
+		Bad:         errcount >= cfg().warnlevel,
+		Paused:      store.isPaused(),
+		ErrorFiles:  errcount,
+		BufferKeys:  keys,
+		BufferBytes: size,
+		Refresh:     refresh,
+	}
+	if !oldest.IsZero() {
+		data.OldestAge = time.Since(oldest).Seconds()
+	}
+	if last := atomic.LoadInt64(&lastFlush); last > 0 {
+		data.LastFlush = time.Unix(0, last).UTC().Format(time.RFC3339)
+	}
+	var stat bytes.Buffer
+	writeStatistic(&stat)
+	for _, line := range strings.Split(strings.TrimSpace(stat.String()), "\r\n") {
+		if i := strings.LastIndex(line, ":"); i > 0 {
+			data.Statistic = append(data.Statistic, [2]string{line[:i], line[i+1:]})
+		}
+	}
+
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardPage.Execute(w, data); err != nil {
+		grlog(LEVEL_ERR, "Dashboard error: ", err)
+	}
+}
+
+// doflush sends the buffer now, POST /flush or /flush?table=x for the keys of
+// one table, and returns the rows and bytes delivered. Failed batches go to
+// the errors dir as on a sync cycle
+func doflush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	var skip func(val *Buffer) bool
+	if table := strings.ToLower(r.URL.Query().Get("table")); table != "" {
+		skip = func(val *Buffer) bool { return strings.ToLower(val.table) != table }
+	}
+	rows, size := store.flushKeys(r.Context(), skip)
+	grlog(LEVEL_INFO, "Flushed on request ", rows, " rows ", size, " bytes")
+	w.Header().Set("Server", "proxyhouse "+version)
+	fmt.Fprintf(w, "rows:%d\r\nbytes:%d\r\n", rows, size)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.admintoken = "secret" })
+
+	resetStore()
+	defer resetStore()
+	store.add("?query=INSERT%20INTO%20t%20VALUES", "?query=INSERT%20INTO%20t%20VALUES", "t", []byte("(1),(2)"), []byte(","), 2)
+	store.Lock()
+	store.Req["?query=INSERT%20INTO%20t%20VALUES"].created = time.Now().Add(-time.Minute)
+	store.Unlock()
+
+	w := httptest.NewRecorder()
+	adminonly(showhealthz)(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("no token: want 403; got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/healthz", nil)
+	r.Header.Set("X-Admin-Token", "secret")
+	adminonly(showhealthz)(w, r)
+	var health Health
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if health.BufferKeys != 1 || health.BufferBytes != 7 {
+		t.Errorf("buffer: want 1 key, 7 bytes; got %d keys, %d bytes", health.BufferKeys, health.BufferBytes)
+	}
+	if health.OldestAge < 60 {
+		t.Errorf("oldest age: want >= 60; got %f", health.OldestAge)
+	}
+	if health.Version != version {
+		t.Errorf("version: want '%s'; got '%s'", version, health.Version)
+	}
+	if health.Health != "ok" || len(health.Upstreams) != 0 {
+		t.Errorf("no upstream sent to: want ok and no upstreams; got %q %v", health.Health, health.Upstreams)
+	}
+
+	// an ejected upstream degrades the health, the others are still ok
+	defer func(h *UpstreamHealth) { upstreamHealth = h }(upstreamHealth)
+	upstreamHealth = newUpstreamHealth()
+	configure(func(c *Config) { c.ejectafter = 1 })
+	upstreamHealth.Result("http://ch1:8123", true)
+	upstreamHealth.Result("http://ch2:8123", false)
+	w = httptest.NewRecorder()
+	adminonly(showhealthz)(w, r)
+	health = Health{}
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || health.Health != "degraded" {
+		t.Errorf("ejected upstream: want 200 and degraded; got %d %q", w.Code, health.Health)
+	}
+	if u := health.Upstreams; len(u) != 2 || u["http://ch1:8123"] != "ok" || u["http://ch2:8123"] != "ejected" {
+		t.Errorf("upstreams: want ch1 ok and ch2 ejected; got %v", u)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = "http://ch:8123" })
+	resetStore()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/validate?query=INSERT%20INTO%20events%20VALUES&password=secret", strings.NewReader("(1),(2),(3)"))
+	adminonly(dovalidate)(w, r)
+	var v Validation
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	want := Validation{
+		Key:       "/?query=INSERT%20INTO%20events%20VALUES&password=*",
+		Table:     "events",
+		Delimiter: ",",
+		Rows:      3,
+		Bytes:     11,
+		Upstream:  "http://ch:8123?query=INSERT%20INTO%20events%20VALUES&password=*",
+	}
+	if v != want {
+		t.Errorf("want %+v; got %+v", want, v)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/validate?query=INSERT%20INTO%20logs%20FORMAT%20TSV", strings.NewReader("1\ta\n2\tb\n"))
+	adminonly(dovalidate)(w, r)
+	v = Validation{}
+	json.Unmarshal(w.Body.Bytes(), &v)
+	if v.Table != "logs" || v.Rows != 2 || v.Delimiter != "" {
+		t.Errorf("TSV: want logs, 2 rows, empty delimiter; got %+v", v)
+	}
+
+	// the key and table of the real insert: the query header and -keyparams
+	configure(func(c *Config) { c.keyparams = "database" })
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/validate?database=db&query_id=1", strings.NewReader("1\ta\n"))
+	r.Header.Set("X-Proxyhouse-Query", "INSERT INTO headers FORMAT TSV")
+	adminonly(dovalidate)(w, r)
+	v = Validation{}
+	json.Unmarshal(w.Body.Bytes(), &v)
+	if v.Key != "/?database=db" || v.Table != "headers" || v.Rows != 1 {
+		t.Errorf("header query with keyparams: want key /?database=db, headers, 1 row; got %+v", v)
+	}
+
+	// the dry run shows the next upstream without taking its turn
+	configure(func(c *Config) { c.fwd, c.keyparams = "http://ch1:8123,http://ch2:8123", "" })
+	defer func(h *UpstreamHealth) { upstreamHealth = h }(upstreamHealth)
+	upstreamHealth = newUpstreamHealth()
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		adminonly(dovalidate)(w, httptest.NewRequest("POST", "/validate?query=INSERT%20INTO%20t%20VALUES", strings.NewReader("(1)")))
+		v = Validation{}
+		json.Unmarshal(w.Body.Bytes(), &v)
+		if !strings.HasPrefix(v.Upstream, "http://ch1:8123") {
+			t.Errorf("validate %d: want ch1; got %q", i, v.Upstream)
+		}
+	}
+	if got := forwardURI("?q"); !strings.HasPrefix(got, "http://ch1:8123") {
+		t.Errorf("after validate: want the first send on ch1; got %q", got)
+	}
+
+	if keys, _, _ := store.stats(); keys != 0 {
+		t.Errorf("want nothing buffered; got %d keys", keys)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer store.setInterval(store.syncInterval())
+	store.setInterval(2 * time.Second)
+	for _, tc := range []struct {
+		query string
+		code  int
+		want  time.Duration
+	}{
+		{"syncsec=5", http.StatusOK, 5 * time.Second},
+		{"syncsec=0", http.StatusBadRequest, 5 * time.Second},
+		{"syncsec=-1", http.StatusBadRequest, 5 * time.Second},
+		{"syncsec=x", http.StatusBadRequest, 5 * time.Second},
+		{"", http.StatusOK, 5 * time.Second},
+	} {
+		w := httptest.NewRecorder()
+		adminonly(doconfig)(w, httptest.NewRequest("POST", "/config?"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: want %d; got %d", tc.query, tc.code, w.Code)
+		}
+		if got := store.syncInterval(); got != tc.want {
+			t.Errorf("%s: want interval %s; got %s", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	defer func(w io.Writer, c Config) { logout = w; restoreConfig(c) }(logout, *cfg())
+	var buf bytes.Buffer
+	logout = &buf
+	configure(func(c *Config) { c.admintoken = "" })
+	defer store.setInterval(store.syncInterval())
+
+	r := httptest.NewRequest("POST", "/config?syncsec=3", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set("X-Admin-Token", "secret")
+	adminonly(doconfig)(httptest.NewRecorder(), r)
+	r = httptest.NewRequest("POST", "/config?syncsec=0", nil)
+	r.RemoteAddr = "10.0.0.2:5555"
+	adminonly(doconfig)(httptest.NewRecorder(), r)
+	adminonly(showhealthz)(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var audits []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "audit ") {
+			audits = append(audits, line)
+		}
+	}
+	if len(audits) != 2 {
+		t.Fatalf("want 2 audit lines; got %q", audits)
+	}
+	if want := "audit action=/config component=admin ip=10.0.0.1 status=200 token=2bb80d53"; audits[0] != want {
+		t.Errorf("want %q; got %q", want, audits[0])
+	}
+	if want := "audit action=/config component=admin ip=10.0.0.2 status=400 token=none"; audits[1] != want {
+		t.Errorf("want %q; got %q", want, audits[1])
+	}
+
+	// with -logformat=json each part is a field of its own
+	buf.Reset()
+	configure(func(c *Config) { c.logformat = "json" })
+	adminonly(doconfig)(httptest.NewRecorder(), httptest.NewRequest("POST", "/config?syncsec=3", nil))
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, `"msg":"audit"`) {
+			json.Unmarshal([]byte(line), &entry)
+		}
+	}
+	if entry["msg"] != "audit" || entry["component"] != "admin" || entry["action"] != "/config" || entry["status"] != float64(200) || entry["token"] != "none" {
+		t.Errorf("json: want audit fields; got %v", entry)
+	}
+	configure(func(c *Config) { c.logformat = "text" })
+
+	buf.Reset()
+	configure(func(c *Config) { c.admintoken = "secret" })
+	r = httptest.NewRequest("POST", "/pause", nil)
+	r.RemoteAddr = "10.0.0.3:5555"
+	r.Header.Set("X-Admin-Token", "wrong")
+	adminonly(dopause)(httptest.NewRecorder(), r)
+	if want := "Admin access denied: POST /pause from 10.0.0.3:5555"; !strings.Contains(buf.String(), want) {
+		t.Errorf("want %q logged; got %q", want, buf.String())
+	}
+	if strings.Contains(buf.String(), "audit ") {
+		t.Errorf("denied request audited: %q", buf.String())
+	}
+}
+
+func TestDump(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.dumpdir = t.TempDir() })
+	resetStore()
+	defer resetStore()
+	key := "?query=INSERT%20INTO%20t%20VALUES&password=secret"
+	store.add(key, key, "t", []byte("(1)"), []byte(","), 1)
+	store.add(key, key, "t", []byte("(2)"), []byte(","), 1)
+
+	w := httptest.NewRecorder()
+	adminonly(dodump)(w, httptest.NewRequest("POST", "/dump", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200; got %d %s", w.Code, w.Body.String())
+	}
+	dirs, _ := filepath.Glob(filepath.Join(cfg().dumpdir, "*"))
+	if len(dirs) != 1 {
+		t.Fatalf("want 1 dump dir; got %q", dirs)
+	}
+	index, err := ioutil.ReadFile(filepath.Join(dirs[0], "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []DumpEntry
+	json.Unmarshal(index, &entries)
+	if len(entries) != 1 || entries[0].Key != "?query=INSERT%20INTO%20t%20VALUES&password=*" || entries[0].Table != "t" || entries[0].Rows != 2 || entries[0].Bytes != 7 {
+		t.Fatalf("index: got %+v", entries)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dirs[0], entries[0].File)); string(data) != "(1),(2)" {
+		t.Errorf("data: want '(1),(2)'; got %q", data)
+	}
+	if keys, size, _ := store.stats(); keys != 1 || size != 7 {
+		t.Errorf("want the buffer left as is; got %d keys, %d bytes", keys, size)
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	old, key := "?query=INSERT%20INTO%20a%20VALUES&password=secret", "?query=INSERT%20INTO%20b%20VALUES"
+	store.add(key, key, "b", []byte("(1)"), []byte(","), 1)
+	store.add(old, old, "a", []byte("(1),(2)"), []byte(","), 2)
+	store.add(old, old, "a", []byte("(3)"), []byte(","), 1)
+	store.Req[old].created = time.Now().Add(-time.Minute)
+
+	w := httptest.NewRecorder()
+	adminonly(showbuffers)(w, httptest.NewRequest("GET", "/buffers", nil))
+	var entries []BufferEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("want 2 keys; got %+v", entries)
+	}
+	if e := entries[0]; e.Key != "?query=INSERT%20INTO%20a%20VALUES&password=*" || e.Table != "a" || e.Rows != 3 || e.Bytes != 11 || e.AgeSec < 60 {
+		t.Errorf("oldest: got %+v", e)
+	}
+	if e := entries[1]; e.Table != "b" || e.Rows != 1 || e.Bytes != 3 || e.AgeSec >= 60 {
+		t.Errorf("newest: got %+v", e)
+	}
+
+	resetStore()
+	w = httptest.NewRecorder()
+	adminonly(showbuffers)(w, httptest.NewRequest("GET", "/buffers", nil))
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Errorf("empty: want []; got %q", got)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractTable("?"+r.URL.RawQuery) != "paused" {
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.maxbatchbytes = ch.URL, 5 })
+	defer store.setInterval(store.syncInterval())
+	defer store.resume()
+	resetStore()
+
+	w := httptest.NewRecorder()
+	adminonly(dopause)(w, httptest.NewRequest("POST", "/pause", nil))
+	if w.Code != http.StatusOK || !store.isPaused() {
+		t.Fatalf("pause: want 200 and paused; got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	showstatus(w, httptest.NewRequest("GET", "/status", nil))
+	if !strings.Contains(w.Body.String(), "paused:1") {
+		t.Errorf("status: want paused:1; got %q", w.Body.String())
+	}
+
+	key := "?query=INSERT%20INTO%20paused%20VALUES"
+	store.add(key, key, "paused", []byte("(1)"), []byte(","), 1)
+	store.add(key, key, "paused", []byte("(2)"), []byte(","), 1) // over maxbatchbytes
+	store.backgroundSender(1)
+	defer store.cancelSyncer()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if len(sent) != 0 {
+		t.Errorf("paused: want nothing sent; got %q", sent)
+	}
+	mu.Unlock()
+
+	adminonly(doresume)(httptest.NewRecorder(), httptest.NewRequest("POST", "/resume", nil))
+	time.Sleep(1100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0] != "(1),(2)" {
+		t.Errorf("resumed: want the buffer sent; got %q", sent)
+	}
+}
+
+func TestPauseSpill(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.maxkeys = 1 })
+	inTempDir(t)
+	resetStore()
+	defer resetStore()
+	store.pause()
+	defer store.resume()
+
+	insert := func(table string) int {
+		w := httptest.NewRecorder()
+		dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20"+table+"%20VALUES", strings.NewReader("(1)")))
+		return w.Code
+	}
+	if code := insert("a"); code != http.StatusOK {
+		t.Fatalf("first key: want 200; got %d", code)
+	}
+	if code := insert("b"); code != http.StatusServiceUnavailable {
+		t.Errorf("over maxkeys: want 503; got %d", code)
+	}
+	configure(func(c *Config) { c.pausespill = true })
+	if code := insert("b"); code != http.StatusOK {
+		t.Errorf("over maxkeys with pausespill: want 200; got %d", code)
+	}
+	if errorCount() != 1 {
+		t.Errorf("want the spilled insert in the errors dir; got %d files", errorCount())
+	}
+	if keys, _, _ := store.stats(); keys != 1 {
+		t.Errorf("want 1 buffered key; got %d", keys)
+	}
+}
+
+func TestPauseFormatMismatch(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.keyparams = "database" })
+	inTempDir(t)
+	resetStore()
+	defer resetStore()
+	store.pause()
+	defer store.resume()
+
+	// keyparams leaves the query out of the key, both formats go to one key
+	insert := func(format, body string) int {
+		w := httptest.NewRecorder()
+		dorequest(w, httptest.NewRequest("POST", "/?database=db&query=INSERT%20INTO%20mixed%20FORMAT%20"+format, strings.NewReader(body)))
+		return w.Code
+	}
+	if code := insert("TSV", "1\n"); code != http.StatusOK {
+		t.Fatalf("first format: want 200; got %d", code)
+	}
+	if code := insert("JSONEachRow", `{"a":2}`); code != http.StatusServiceUnavailable {
+		t.Errorf("another format: want 503; got %d", code)
+	}
+	configure(func(c *Config) { c.pausespill = true })
+	if code := insert("JSONEachRow", `{"a":2}`); code != http.StatusOK {
+		t.Errorf("another format with pausespill: want 200; got %d", code)
+	}
+	if errorCount() != 1 {
+		t.Errorf("want the spilled insert in the errors dir; got %d files", errorCount())
+	}
+	if keys, _, _ := store.stats(); keys != 1 {
+		t.Errorf("want 1 buffered key; got %d", keys)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if string(b) == "(fail)" {
+			http.Error(w, "bad row", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		sent = append(sent, string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.flushretries = ch.URL, 0 })
+	inTempDir(t)
+	resetStore()
+	defer resetStore()
+	a, b, c := "?query=INSERT%20INTO%20a%20VALUES", "?query=INSERT%20INTO%20b%20VALUES", "?query=INSERT%20INTO%20c%20VALUES"
+	store.add(a, a, "a", []byte("(1),(2)"), []byte(","), 2)
+	store.add(b, b, "b", []byte("(3)"), []byte(","), 1)
+	store.add(c, c, "c", []byte("(fail)"), []byte(","), 1)
+
+	w := httptest.NewRecorder()
+	adminonly(doflush)(w, httptest.NewRequest("POST", "/flush?table=A", nil))
+	if got := w.Body.String(); got != "rows:2\r\nbytes:7\r\n" {
+		t.Errorf("table a: want rows:2 bytes:7; got %q", got)
+	}
+	if keys, _, _ := store.stats(); keys != 2 {
+		t.Errorf("table a: want 2 keys left; got %d", keys)
+	}
+	w = httptest.NewRecorder()
+	adminonly(doflush)(w, httptest.NewRequest("POST", "/flush", nil))
+	if got := w.Body.String(); got != "rows:1\r\nbytes:3\r\n" {
+		t.Errorf("all: want rows:1 bytes:3, the failed key not counted; got %q", got)
+	}
+	if keys, _, _ := store.stats(); keys != 0 {
+		t.Errorf("all: want the buffer empty; got %d keys", keys)
+	}
+	if errorCount() != 1 {
+		t.Errorf("want the failed key in the errors dir; got %d files", errorCount())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(sent, " "); got != "(1),(2) (3)" {
+		t.Errorf("sent: want '(1),(2) (3)'; got %q", got)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.admintoken = "secret" })
+	resetStore()
+	defer resetStore()
+	key := "?query=INSERT%20INTO%20dash%20VALUES"
+	store.add(key, key, "dash", []byte("(1)"), []byte(","), 1)
+
+	w := httptest.NewRecorder()
+	adminonly(showdashboard)(w, httptest.NewRequest("GET", "/dashboard", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("no token: want 403; got %d", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/dashboard?refresh=7", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	w = httptest.NewRecorder()
+	adminonly(showdashboard)(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("want 200 html; got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	page := w.Body.String()
+	for _, want := range []string{
+		"<td>buffered keys</td><td>1</td>",
+		"<td>buffered bytes</td><td>3</td>",
+		"<td>in requests</td>",
+		"<td>flush paused</td><td>0</td>",
+		"location.reload(); },  7  * 1000",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("want %q in page:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "src=") {
+		t.Error("want no external scripts")
+	}
+}
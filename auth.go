@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are the -apikeys, -htpasswd and -jwtkey of the ingest endpoints,
+// they are separate from the ClickHouse user and password of the insert
+type Credentials struct {
+	keys  []string
+	users map[string]string
+	jwt   *JWTVerifier
+}
+
+var (
+	credentials   *Credentials
+	credentialsMu sync.RWMutex
+)
+
+// loadCredentials reads the api keys file, one key per line, and the
+// htpasswd file, user:{SHA}base64 (htpasswd -s) or user:password lines.
+// Both have # comments. The jwt key file is a PEM public key or an HMAC secret,
+// nil if all names are empty
+func loadCredentials(keysFile, htpasswd, jwtKey, jwtIssuer string) (*Credentials, error) {
+	if keysFile == "" && htpasswd == "" && jwtKey == "" {
+		return nil, nil
+	}
+	c := &Credentials{users: make(map[string]string)}
+	if jwtKey != "" {
+		var err error
+		if c.jwt, err = NewJWTVerifier(jwtKey, jwtIssuer); err != nil {
+			return nil, err
+		}
+	}
+	if keysFile != "" {
+		lines, err := readLines(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		c.keys = lines
+		if len(c.keys) == 0 {
+			return nil, fmt.Errorf("%s: no keys", keysFile)
+		}
+	}
+	if htpasswd != "" {
+		lines, err := readLines(htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range lines {
+			pos := strings.Index(line, ":")
+			if pos <= 0 {
+				return nil, fmt.Errorf("%s line %d: want user:password", htpasswd, i+1)
+			}
+			hash := line[pos+1:]
+			if strings.HasPrefix(hash, "$") {
+				return nil, fmt.Errorf("%s line %d: only {SHA} and plain passwords are supported, use htpasswd -s", htpasswd, i+1)
+			}
+			c.users[line[:pos]] = hash
+		}
+		if len(c.users) == 0 {
+			return nil, fmt.Errorf("%s: no users", htpasswd)
+		}
+	}
+	return c, nil
+}
+
+// readLines returns the trimmed lines of the file without blanks and # comments
+func readLines(name string) (lines []string, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// Check returns the api key, the basic auth user or the jwt subject of the
+// request, an error if none matches. Claims are set for a jwt only
+func (c *Credentials) Check(r *http.Request) (string, *JWTClaims, error) {
+	if key := r.Header.Get("X-Proxyhouse-Key"); key != "" {
+		for _, k := range c.keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+				return "key", nil, nil
+			}
+		}
+		return "", nil, errors.New("bad key")
+	}
+	if token := bearerToken(r); token != "" && c.jwt != nil {
+		claims, err := c.jwt.Verify(token, time.Now())
+		if err != nil {
+			return "", nil, err
+		}
+		return claims.Subject, claims, nil
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil, errors.New("no credentials")
+	}
+	hash, found := c.users[user]
+	if !found {
+		// compare anyway, a missing user takes as long as a bad password
+		hash = "{SHA}"
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		password = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(hash)) != 1 || !found {
+		return "", nil, errors.New("bad password of " + user)
+	}
+	return user, nil, nil
+}
+
+// setCredentials loads the -apikeys, -htpasswd and -jwtkey files, on start and
+// on a reload so keys are rotated without a restart
+func setCredentials() error {
+	c, err := loadCredentials(cfg().apikeys, cfg().htpasswd, cfg().jwtkey, cfg().jwtissuer)
+	if err != nil {
+		return err
+	}
+	credentialsMu.Lock()
+	credentials = c
+	credentialsMu.Unlock()
+	return nil
+}
+
+// authonly wraps the ingest handlers and checks the credentials of the insert
+// if -apikeys, -htpasswd or -jwtkey is set. GET is the status of load balancers,
+// no check. The tables of a jwt are checked by the handler, see tableAllowed
+func authonly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credentialsMu.RLock()
+		c := credentials
+		credentialsMu.RUnlock()
+		if c == nil || r.Method == "GET" {
+			h(w, r)
+			return
+		}
+		_, claims, err := c.Check(r)
+		if err != nil {
+			grlog(LEVEL_WARN, "Unauthorized insert from ", r.RemoteAddr, ": ", err, Fields{"component": "auth"})
+			gr.SimpleSend(fmt.Sprintf("%s.auth_failed", cfg().graphiteprefix), "1")
+			if len(c.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="proxyhouse"`)
+			}
+			http.Error(w, "401 unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		if claims != nil {
+			r = r.WithContext(withTables(r.Context(), claims.Tables))
+		}
+		h(w, r)
+	}
+}
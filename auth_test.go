@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthonly(t *testing.T) {
+	defer func(c Config) { restoreConfig(c); setCredentials() }(*cfg())
+	dir := t.TempDir()
+	configure(func(c *Config) { c.apikeys = filepath.Join(dir, "keys") })
+	configure(func(c *Config) { c.htpasswd = filepath.Join(dir, "htpasswd") })
+	ioutil.WriteFile(cfg().apikeys, []byte("# producers\nkey1\n\nkey2\n"), 0600)
+	// htpasswd -nbs app secret
+	ioutil.WriteFile(cfg().htpasswd, []byte("app:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nplain:pass\n"), 0600)
+	if err := setCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	for _, tc := range []struct {
+		name, method, key, user, password string
+		want                              int
+	}{
+		{"no credentials", "POST", "", "", "", http.StatusUnauthorized},
+		{"status ping", "GET", "", "", "", http.StatusOK},
+		{"key", "POST", "key2", "", "", http.StatusOK},
+		{"bad key", "POST", "key3", "", "", http.StatusUnauthorized},
+		{"sha user", "POST", "", "app", "secret", http.StatusOK},
+		{"plain user", "POST", "", "plain", "pass", http.StatusOK},
+		{"bad password", "POST", "", "app", "pass", http.StatusUnauthorized},
+		{"unknown user", "POST", "", "nobody", "{SHA}", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(tc.method, "/", strings.NewReader("(1)"))
+		if tc.key != "" {
+			r.Header.Set("X-Proxyhouse-Key", tc.key)
+		}
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		authonly(ok)(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: want %d; got %d", tc.name, tc.want, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: want WWW-Authenticate", tc.name)
+		}
+	}
+
+	// keys are rotated by a reload
+	ioutil.WriteFile(cfg().apikeys, []byte("key3\n"), 0600)
+	if err := setCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("X-Proxyhouse-Key", "key3")
+	w := httptest.NewRecorder()
+	authonly(ok)(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("rotated key: want 200; got %d", w.Code)
+	}
+
+	ioutil.WriteFile(cfg().htpasswd, []byte("app:$2y$05$abc\n"), 0600)
+	if problems := strings.Join(validateFlags(cfg()), "\n"); !strings.Contains(problems, "htpasswd -s") {
+		t.Errorf("bcrypt: want a problem; got %q", problems)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff is a full jitter exponential backoff, the delay for an attempt is
+// random in [0, min(Max, Base*2^attempt)) so retries across the fleet don't line up
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Cap returns the upper bound of the delay for the attempt
+func (b Backoff) Cap(attempt int) time.Duration {
+	if b.Base <= 0 {
+		return 0
+	}
+	if attempt > 30 {
+		attempt = 30
+	}
+	cap := b.Base << uint(attempt)
+	if cap > b.Max || cap <= 0 {
+		cap = b.Max
+	}
+	return cap
+}
+
+// Delay returns a random delay for the attempt, counted from 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	cap := b.Cap(attempt)
+	if cap <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(cap)))
+}
+
+// sendBackoff is the backoff between inline send retries
+func sendBackoff() Backoff {
+	return Backoff{
+		Base: time.Duration(cfg().backoffbase) * time.Millisecond,
+		Max:  time.Duration(cfg().backoffmax) * time.Millisecond,
+	}
+}
+
+// errorBackoff is the backoff for resending error files, by file level
+func errorBackoff() Backoff {
+	return Backoff{
+		Base: time.Duration(cfg().resendint) * time.Second,
+		Max:  time.Duration(cfg().errbackoffmax) * time.Second,
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Base: 100 * time.Millisecond, Max: time.Second}
+	for attempt, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		if got := b.Cap(attempt); got != want {
+			t.Errorf("cap %d: want %s; got %s", attempt, want, got)
+		}
+		for i := 0; i < 100; i++ {
+			if d := b.Delay(attempt); d < 0 || d >= want {
+				t.Fatalf("delay %d: want [0, %s); got %s", attempt, want, d)
+			}
+		}
+	}
+	if got := b.Cap(100); got != time.Second {
+		t.Errorf("cap overflow: want %s; got %s", time.Second, got)
+	}
+	if got := (Backoff{}).Delay(3); got != 0 {
+		t.Errorf("zero backoff: want 0; got %s", got)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateFlags checks the flags of c that would start fine but misbehave at
+// runtime, it returns all the problems found
+func validateFlags(c *Config) (problems []string) {
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	bases := upstreams(c.fwd)
+	if isSRV(c.fwd) {
+		if u, err := url.Parse(c.fwd); err != nil || u.Host == "" || len(bases) > 1 || strings.Contains(c.fwd, "*") {
+			add("-fwd %q: want a single srv+http://_service._tcp.domain", c.fwd)
+		}
+		bases = nil
+	}
+	if isConsul(c.fwd) {
+		if u, err := url.Parse(c.fwd); err != nil || u.Host == "" || len(bases) > 1 || strings.Contains(c.fwd, "*") {
+			add("-fwd %q: want a single consul+http://service", c.fwd)
+		}
+		if u, err := url.Parse(c.consuladdr); err != nil || u.Host == "" {
+			add("-consuladdr %q: want http://host:port with a consul+http -fwd", c.consuladdr)
+		}
+		bases = nil
+	}
+	for _, base := range strings.Split(c.fwd, ",") {
+		if pos := strings.LastIndex(base, "*"); pos > 0 {
+			if w, err := strconv.Atoi(strings.TrimSpace(base[pos+1:])); err != nil || w <= 0 {
+				add("-fwd %q: want host*weight with a positive weight", strings.TrimSpace(base))
+			}
+		}
+	}
+	if len(bases) == 0 && !isSRV(c.fwd) && !isConsul(c.fwd) {
+		add("-fwd %q: want http://host:port, https://host:port or unix:///path", c.fwd)
+	}
+	for _, base := range bases {
+		if u, err := url.Parse(base); err != nil {
+			add("-fwd %q: %v", base, err)
+		} else if u.Scheme == "unix" {
+			if u.Path == "" {
+				add("-fwd %q: want unix:///path/to/socket", base)
+			} else if len(bases) > 1 {
+				add("-fwd %q: a unix socket can't be in a list", base)
+			}
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("-fwd %q: want http://host:port, https://host:port or unix:///path", base)
+		}
+	}
+	if c.repl != "" && !strings.HasPrefix(c.repl, "?") && !strings.HasPrefix(c.repl, "/") && !strings.Contains(c.repl, "://") {
+		add("-repl %q: forwarded keys start with ? or a /path (or a url in old error files), it never matches", c.repl)
+	}
+	if c.replmode != "first" && c.replmode != "all" {
+		add("-replmode %q: want first or all", c.replmode)
+	}
+	if (c.tlscert == "") != (c.tlskey == "") {
+		add("-tlscert and -tlskey: want both for https")
+	} else if c.tlscert != "" {
+		if _, err := tls.LoadX509KeyPair(c.tlscert, c.tlskey); err != nil {
+			add("-tlscert, -tlskey: %v", err)
+		}
+	}
+	if _, err := loadCredentials(c.apikeys, c.htpasswd, c.jwtkey, c.jwtissuer); err != nil {
+		add("-apikeys, -htpasswd, -jwtkey: %v", err)
+	}
+	if _, err := loadIPRules(c.ipaccess); err != nil {
+		add("-ipaccess: %v", err)
+	}
+	if c.tlsclientca != "" {
+		if c.tlscert == "" {
+			add("-tlsclientca: want -tlscert and -tlskey, client certificates need https")
+		} else if _, err := clientAuth(c.tlsclientca); err != nil {
+			add("-tlsclientca: %v", err)
+		}
+	}
+	if c.adminport != 0 && c.adminport == c.port {
+		add("-adminport %d: want a port other than -p", c.adminport)
+	}
+	if _, ok := logLevels[c.loglevel]; !ok || c.loglevel == "notice" || c.loglevel == "critical" || c.loglevel == "alert" {
+		add("-loglevel %q: want debug, info, warn or error", c.loglevel)
+	}
+	if c.syslog != "" {
+		if _, err := NewSyslog(c.syslog); err != nil {
+			add("-syslog: %v", err)
+		}
+		if c.grayloghost != "" {
+			add("-syslog and -grayloghost: log to one of them")
+		}
+	}
+	if c.statsdhost != "" && c.graphitehost != "" {
+		add("-statsdhost and -graphitehost: send metrics to one of them")
+	}
+	if c.graphiteproto != "udp" && c.graphiteproto != "tcp" {
+		add("-graphiteproto %q: want udp or tcp", c.graphiteproto)
+	}
+	if c.graphiteagg < 0 {
+		add("-graphiteagg %d: want 0 or a positive interval", c.graphiteagg)
+	}
+	if c.statsdtags != "datadog" && c.statsdtags != "influx" && c.statsdtags != "none" {
+		add("-statsdtags %q: want datadog, influx or none", c.statsdtags)
+	}
+	if c.graylogproto != "udp" && c.graylogproto != "tcp" && c.graylogproto != "tls" {
+		add("-graylogproto %q: want udp, tcp or tls", c.graylogproto)
+	}
+	if c.logformat != "text" && c.logformat != "json" {
+		add("-logformat %q: want text or json", c.logformat)
+	}
+	if c.syncsec <= 0 {
+		add("-syncsec %d: want a positive interval", c.syncsec)
+	}
+	for _, entry := range strings.Split(c.tablesyncsec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if sec, err := strconv.Atoi(strings.TrimSpace(entry[i+1:])); i <= 0 || err != nil || sec <= 0 {
+			add("-tablesyncsec %q: want table:seconds;table:seconds", entry)
+		}
+	}
+	if c.resendint < 0 {
+		add("-resendint %d: want 0 or more", c.resendint)
+	}
+	if c.ejectafter > 0 && c.probeint <= 0 {
+		add("-probeint %d: want a positive interval with -ejectafter", c.probeint)
+	}
+	if c.healthcheck && c.ejectafter <= 0 {
+		add("-healthcheck: want -ejectafter, the failed pings that eject an upstream")
+	}
+	if c.critlevel <= c.warnlevel {
+		add("-c %d: want the error level above the warning level -w %d", c.critlevel, c.warnlevel)
+	}
+	if c.keyoverflow != "reject" && c.keyoverflow != "flush" {
+		add("-keyoverflow %q: want reject or flush", c.keyoverflow)
+	}
+	if c.storeoverflow != "reject" && c.storeoverflow != "flush" && c.storeoverflow != "table" {
+		add("-storeoverflow %q: want reject, flush or table", c.storeoverflow)
+	}
+	if c.statusformat != "plain" && c.statusformat != "json" {
+		add("-statusformat %q: want plain or json", c.statusformat)
+	}
+	if ts := strings.ToUpper(c.injecttimestamp); ts != "" && ts != "TSV" && ts != "CSV" {
+		add("-injecttimestamp %q: want TSV or CSV", c.injecttimestamp)
+	}
+	for name, value := range map[string]int{
+		"maxkeys": c.maxkeys, "maxstorebytes": c.maxstorebytes, "maxbatchbytes": c.maxbatchbytes,
+		"maxbatchrows": c.maxbatchrows, "maxbodybytes": c.maxbodybytes, "maxinflightbytes": c.maxinflightbytes, "maxflushpercycle": c.maxflushpercycle,
+		"maxbatchage": c.maxbatchage, "chunkbytes": c.chunkbytes, "retries": c.retries, "ejectafter": c.ejectafter, "sigintimeout": c.sigintimeout, "memstats": c.memstats,
+		"logbodybytes": c.logbodybytes,
+	} {
+		if value < 0 {
+			add("-%s %d: want 0 (off) or more", name, value)
+		}
+	}
+	if c.querynormalize != "" {
+		if _, err := regexp.Compile(c.querynormalize); err != nil {
+			add("-querynormalize: %v", err)
+		}
+	}
+	if _, err := newHistogram(c.bytebuckets); err != nil {
+		add("-bytebuckets: %v", err)
+	}
+	if _, err := newHistogram(c.rowbuckets); err != nil {
+		add("-rowbuckets: %v", err)
+	}
+	if _, err := newHistogram(c.latencybuckets); err != nil {
+		add("-latencybuckets: %v", err)
+	}
+	if c.httpproxy != "" {
+		if u, err := url.Parse(c.httpproxy); err != nil || u.Host == "" {
+			add("-httpproxy %q: want http://host:port", c.httpproxy)
+		}
+	}
+	if c.vaultpath != "" {
+		if u, err := url.Parse(c.vaultaddr); err != nil || u.Host == "" {
+			add("-vaultaddr %q: want https://host:port with -vaultpath", c.vaultaddr)
+		}
+		if c.vaultrenew <= 0 {
+			add("-vaultrenew %d: want a positive number of seconds", c.vaultrenew)
+		}
+	}
+	for _, base := range upstreams(c.failover) {
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("-failover %q: want http://host:port or https://host:port", base)
+		}
+	}
+	if (c.upcert == "") != (c.upkey == "") {
+		add("-upcert and -upkey go together")
+	}
+	if _, err := upstreamTLS(c); err != nil {
+		add("-upca, -upcert: %v", err)
+	}
+	if c.upservername != "" && (len(upstreams(c.fwd)) > 1 || c.failover != "" || isSRV(c.fwd) || isConsul(c.fwd)) {
+		add("-upservername %q: one name fails the verification of the other hosts, want a single -fwd host and no -failover", c.upservername)
+	}
+	return problems
+}
+
+// byteSize is an int flag of bytes that takes 16MB, 512KB or 1GB (1024 based) too
+type byteSize struct {
+	p *int
+}
+
+// bytesVar defines a byteSize flag on fs stored in p
+func bytesVar(fs *flag.FlagSet, p *int, name string, value int, usage string) {
+	*p = value
+	fs.Var(byteSize{p}, name, usage)
+}
+
+func (b byteSize) String() string {
+	if b.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*b.p)
+}
+
+func (b byteSize) Set(s string) error {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	unit := 1
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			s = strings.TrimSpace(s[:n-1])
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.New("want bytes, KB, MB or GB")
+	}
+	*b.p = v * unit
+	return nil
+}
+
+// flagSet returns the flags bound to c, with the values c has
+func flagSet(c *Config) *flag.FlagSet {
+	values := *c
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	defineFlags(fs, c)
+	*c = values
+	return fs
+}
+
+// setFlags returns the flags given on the command line
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// loadEnv sets the flags of fs from PROXYHOUSE_<NAME> environment variables,
+// the flags in set keep their values, the ones set from env are added to set
+func loadEnv(fs *flag.FlagSet, set map[string]bool) (err error) {
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if e := f.Value.Set(value); e != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), e)
+			return
+		}
+		set[f.Name] = true
+	})
+	return err
+}
+
+// envName returns the environment variable of the flag, PROXYHOUSE_SYNCSEC for -syncsec
+func envName(name string) string {
+	return "PROXYHOUSE_" + strings.ToUpper(name)
+}
+
+// restartFlags are read once at start, a reload keeps their values
+var restartFlags = map[string]bool{
+	"config": true, "p": true, "tlscert": true, "tlskey": true, "tlsclientca": true, "logfile": true,
+	"adminport": true, "pprof": true, "readtimeout": true, "keepalive": true, "upidle": true,
+	"upkeepalive": true, "httpproxy": true, "noproxy": true, "grayloghost": true, "graylogport": true,
+	"graylogretries": true, "graylogproto": true, "graylogca": true, "syslog": true,
+	"metricsqueue": true, "graphiteagg": true, "resendint": true, "maxbatchage": true,
+	"memstats": true, "ejectafter": true, "probeint": true, "querynormalize": true,
+	"bytebuckets": true, "rowbuckets": true, "latencybuckets": true, "proxyprotocol": true,
+	"upca": true, "upcert": true, "upkey": true, "upinsecure": true, "upservername": true, "dnsrefresh": true,
+	"consuladdr": true, "consultag": true,
+	"vaultaddr": true, "vaultpath": true, "vaulttokenfile": true, "vaultca": true, "vaultrenew": true,
+}
+
+// loadConfig sets the flags of fs from the -config file, the flags in set
+// (given on the command line) keep their values
+func loadConfig(fs *flag.FlagSet, path string, set map[string]bool) error {
+	_, err := applyConfig(fs, path, set)
+	return err
+}
+
+// applyConfig sets the flags of fs from the config file and returns the
+// previous values of the changed ones
+func applyConfig(fs *flag.FlagSet, path string, set map[string]bool) (changed map[string]string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sep := ":"
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		sep = "="
+	}
+	values, err := parseConfig(data, sep)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	changed = make(map[string]string)
+	for name, value := range values {
+		if set[name] {
+			continue
+		}
+		f := fs.Lookup(name)
+		old := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		if f.Value.String() != old {
+			changed[name] = old
+		}
+	}
+	return changed, nil
+}
+
+// reloadConfig applies the -config file again on SIGHUP, the buffer and the
+// connections are kept. The file is applied to a copy of the running config,
+// published only without problems, so a file with problems is not applied at all
+func reloadConfig(path string, set map[string]bool) error {
+	next := *cfg()
+	fs := flagSet(&next)
+	changed, err := applyConfig(fs, path, set)
+	if err != nil {
+		return err
+	}
+	var restart []string
+	for name, value := range changed {
+		// the discovered upstreams belong to the srv+http or consul+http -fwd of
+		// the start, the client dials the unix socket of the start
+		if restartFlags[name] || (name == "fwd" && (isSRV(value) || isSRV(next.fwd) || isConsul(value) || isConsul(next.fwd) || isUnix(value) || isUnix(next.fwd))) {
+			restart = append(restart, name)
+			fs.Set(name, value)
+			delete(changed, name)
+		}
+	}
+	if problems := validateFlags(&next); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	running.Store(&next)
+	if err := setCredentials(); err != nil {
+		grlog(LEVEL_ERR, "Config reload, credentials error: ", err, Fields{"component": "config"})
+	}
+	if err := setIPRules(); err != nil {
+		grlog(LEVEL_ERR, "Config reload, ip access error: ", err, Fields{"component": "config"})
+	}
+	if _, ok := changed["syncsec"]; ok {
+		store.setInterval(time.Duration(cfg().syncsec) * time.Second)
+	}
+	if _, ok := changed["tablesyncsec"]; ok {
+		setTableIntervals()
+	}
+	reconnect := false
+	for _, name := range []string{"graphitehost", "graphiteport", "graphiteproto", "statsdhost", "statsdprefix", "statsdtags"} {
+		if _, ok := changed[name]; ok {
+			reconnect = true
+		}
+	}
+	if reconnect {
+		sender, err := graphiteSender()
+		if err != nil {
+			grlog(LEVEL_ERR, "Config reload, graphite error: ", err, Fields{"component": "config"})
+		}
+		if sender != nil {
+			gr.SetSender(sender)
+		}
+	}
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.Strings(restart)
+	grlog(LEVEL_INFO, "Config reloaded, changed: ", strings.Join(names, ","), Fields{"component": "config"})
+	if len(restart) > 0 {
+		grlog(LEVEL_WARN, "Config reload, restart to change: ", strings.Join(restart, ","), Fields{"component": "config"})
+	}
+	return nil
+}
+
+// parseConfig reads a flat config, one flag per line as YAML name: value or
+// TOML name = value, with # comments and quoted values. Nesting and lists are
+// not supported, a flag has no use for them
+func parseConfig(data []byte, sep string) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		pos := strings.Index(line, sep)
+		if pos <= 0 {
+			return nil, fmt.Errorf("line %d: want name %s value", i+1, sep)
+		}
+		name, value := strings.TrimSpace(line[:pos]), strings.TrimSpace(line[pos+1:])
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("line %d: unknown flag %q", i+1, name)
+		}
+		switch {
+		case strings.HasPrefix(value, "\""):
+			end := strings.LastIndex(value, "\"")
+			unquoted, err := strconv.Unquote(value[:end+1])
+			if err != nil || end == 0 {
+				return nil, fmt.Errorf("line %d: bad quoted value", i+1)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			end := strings.LastIndex(value, "'")
+			if end == 0 {
+				return nil, fmt.Errorf("line %d: bad quoted value", i+1)
+			}
+			value = value[1:end]
+		default:
+			if pos := strings.Index(value, " #"); pos >= 0 {
+				value = strings.TrimSpace(value[:pos])
+			}
+			if strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{") || value == "" {
+				return nil, fmt.Errorf("line %d: want a single value", i+1)
+			}
+		}
+		values[name] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateFlags(t *testing.T) {
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Fatalf("defaults: want no problems; got %q", problems)
+	}
+	for _, tc := range []struct {
+		flags map[string]string
+		want  []string
+	}{
+		{map[string]string{"fwd": "localhost:8123"}, []string{"-fwd"}},
+		{map[string]string{"fwd": "http://%zz"}, []string{"-fwd"}},
+		{map[string]string{"fwd": "unix://"}, []string{"-fwd"}},
+		{map[string]string{"fwd": "unix:///tmp/ch.sock"}, nil},
+		{map[string]string{"repl": "db"}, []string{"-repl"}},
+		{map[string]string{"replmode": "some"}, []string{"-replmode"}},
+		{map[string]string{"syncsec": "-1"}, []string{"-syncsec"}},
+		{map[string]string{"c": "100", "w": "400"}, []string{"-c 100"}},
+		{map[string]string{"keyoverflow": "drop", "storeoverflow": "drop"}, []string{"-keyoverflow", "-storeoverflow"}},
+		{map[string]string{"statusformat": "xml", "injecttimestamp": "json"}, []string{"-statusformat", "-injecttimestamp"}},
+		{map[string]string{"maxkeys": "-1", "chunkbytes": "-5"}, []string{"-chunkbytes", "-maxkeys"}},
+		{map[string]string{"querynormalize": "(", "bytebuckets": "10,1"}, []string{"-querynormalize", "-bytebuckets"}},
+		{map[string]string{"httpproxy": "proxy"}, []string{"-httpproxy"}},
+		{map[string]string{"upservername": "ch.internal", "fwd": "https://10.0.0.1:8443,https://10.0.0.2:8443"}, []string{"-upservername"}},
+		{map[string]string{"upservername": "ch.internal", "failover": "https://10.0.0.2:8443"}, []string{"-upservername"}},
+		{map[string]string{"upservername": "ch.internal", "fwd": "https://10.0.0.1:8443"}, nil},
+	} {
+		c := *cfg()
+		fs := flagSet(&c)
+		for name, value := range tc.flags {
+			fs.Set(name, value)
+		}
+		problems := validateFlags(&c)
+		if len(problems) != len(tc.want) {
+			t.Errorf("%v: want %d problems; got %q", tc.flags, len(tc.want), problems)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(strings.Join(problems, "\n"), want) {
+				t.Errorf("%v: want a %s problem; got %q", tc.flags, want, problems)
+			}
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxyhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		file, data string
+	}{
+		{"proxyhouse.yaml", "# proxyhouse\n---\nfwd: http://ch:8123 # clickhouse\nsyncsec: 5\ndelim: \";\"\ngrayloghost: 'gl # 1'\nallowemptybody: true\nc: 600\n"},
+		{"proxyhouse.toml", "# proxyhouse\nfwd = \"http://ch:8123\"\nsyncsec = 5\ndelim = \";\"\ngrayloghost = 'gl # 1'\nallowemptybody = true\nc = 600\n"},
+	} {
+		c := *cfg()
+		c.syncsec = 2
+		path := filepath.Join(dir, tc.file)
+		ioutil.WriteFile(path, []byte(tc.data), 0644)
+		// syncsec is given on the command line and keeps its value
+		if err := loadConfig(flagSet(&c), path, map[string]bool{"syncsec": true}); err != nil {
+			t.Fatalf("%s: %v", tc.file, err)
+		}
+		if c.fwd != "http://ch:8123" || c.syncsec != 2 || c.delim != ";" || c.grayloghost != "gl # 1" || !c.allowemptybody || c.critlevel != 600 {
+			t.Errorf("%s: got fwd %q, syncsec %d, delim %q, grayloghost %q, allowemptybody %v, c %d",
+				tc.file, c.fwd, c.syncsec, c.delim, c.grayloghost, c.allowemptybody, c.critlevel)
+		}
+	}
+
+	for _, data := range []string{
+		"unknown: 1\n",
+		"syncsec 5\n",
+		"syncsec: many\n",
+		"retries: [1, 2]\n",
+		"graphite:\n  host: g\n",
+		"delim: \"x\n",
+	} {
+		path := filepath.Join(dir, "bad.yaml")
+		ioutil.WriteFile(path, []byte(data), 0644)
+		c := *cfg()
+		if err := loadConfig(flagSet(&c), path, nil); err == nil {
+			t.Errorf("%q: want an error", data)
+		}
+	}
+	c := *cfg()
+	if err := loadConfig(flagSet(&c), filepath.Join(dir, "missing.yaml"), nil); err == nil {
+		t.Error("missing file: want an error")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxyhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restoreConfig(*cfg())
+	defer store.setInterval(store.syncInterval())
+	resetStore()
+	defer resetStore()
+	key := "?query=INSERT%20INTO%20t%20VALUES"
+	store.add(key, key, "t", []byte("(1)"), []byte(","), 1)
+
+	path := filepath.Join(dir, "proxyhouse.yaml")
+	ioutil.WriteFile(path, []byte("syncsec: 7\ndelim: \";\"\np: 9999\nc: 800\n"), 0644)
+	// c is given on the command line and keeps its value
+	if err := reloadConfig(path, map[string]bool{"c": true}); err != nil {
+		t.Fatal(err)
+	}
+	if store.syncInterval() != 7*time.Second || cfg().delim != ";" {
+		t.Errorf("want syncsec 7s and delim ;; got %v and %q", store.syncInterval(), cfg().delim)
+	}
+	if cfg().port == 9999 || cfg().critlevel == 800 {
+		t.Errorf("want p (restart only) and c (command line) kept; got %d and %d", cfg().port, cfg().critlevel)
+	}
+	if keys, _, _ := store.stats(); keys != 1 {
+		t.Errorf("want the buffer kept; got %d keys", keys)
+	}
+
+	// c under w is a problem, nothing is applied
+	ioutil.WriteFile(path, []byte("syncsec: 3\nc: 100\n"), 0644)
+	if err := reloadConfig(path, nil); err == nil || !strings.Contains(err.Error(), "-c 100") {
+		t.Errorf("want the -c problem; got %v", err)
+	}
+	if cfg().syncsec != 7 || store.syncInterval() != 7*time.Second {
+		t.Errorf("bad file: want syncsec 7 kept; got %d", cfg().syncsec)
+	}
+
+	// the client dials the socket of the start, a move to or from unix:// is restart only
+	for _, tc := range []struct{ from, to string }{
+		{"http://ch:8123", "unix:///tmp/ch.sock"},
+		{"unix:///tmp/ch.sock", "http://ch:8123"},
+		{"unix:///tmp/ch.sock", "unix:///tmp/other.sock"},
+	} {
+		configure(func(c *Config) { c.fwd = tc.from })
+		ioutil.WriteFile(path, []byte("fwd: "+tc.to+"\n"), 0644)
+		if err := reloadConfig(path, nil); err != nil {
+			t.Fatal(err)
+		}
+		if cfg().fwd != tc.from {
+			t.Errorf("%s to %s: want fwd kept; got %s", tc.from, tc.to, cfg().fwd)
+		}
+	}
+	configure(func(c *Config) { c.fwd = "http://ch:8123" })
+	ioutil.WriteFile(path, []byte("fwd: http://ch2:8123\n"), 0644)
+	if err := reloadConfig(path, nil); err != nil || cfg().fwd != "http://ch2:8123" {
+		t.Errorf("http to http: want fwd changed; got %s, %v", cfg().fwd, err)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxyhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, value := range map[string]string{"PROXYHOUSE_SYNCSEC": "9", "PROXYHOUSE_DELIM": "|", "PROXYHOUSE_FWD": "http://env:8123"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	c := *cfg()
+	c.fwd = "http://cmdline:8123"
+	fs := flagSet(&c)
+
+	// fwd is given on the command line, env overrides the file
+	set := map[string]bool{"fwd": true}
+	if err := loadEnv(fs, set); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "proxyhouse.yaml")
+	ioutil.WriteFile(path, []byte("syncsec: 4\ndelim: \";\"\nfwd: http://file:8123\nc: 700\n"), 0644)
+	if err := loadConfig(fs, path, set); err != nil {
+		t.Fatal(err)
+	}
+	if c.syncsec != 9 || c.delim != "|" || c.fwd != "http://cmdline:8123" || c.critlevel != 700 {
+		t.Errorf("want syncsec 9, delim | from env, fwd from the command line, c 700 from the file; got %d, %q, %q, %d",
+			c.syncsec, c.delim, c.fwd, c.critlevel)
+	}
+
+	os.Setenv("PROXYHOUSE_SYNCSEC", "often")
+	if err := loadEnv(fs, map[string]bool{}); err == nil || !strings.Contains(err.Error(), "PROXYHOUSE_SYNCSEC") {
+		t.Errorf("bad value: want an error naming the variable; got %v", err)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	c := *cfg()
+	fs := flagSet(&c)
+	for _, tc := range []struct {
+		value string
+		want  int
+	}{
+		{"1000", 1000},
+		{"16MB", 16 << 20},
+		{"16m", 16 << 20},
+		{"512KB", 512 << 10},
+		{"1GiB", 1 << 30},
+		{"0", 0},
+	} {
+		if err := fs.Set("maxbatchbytes", tc.value); err != nil || c.maxbatchbytes != tc.want {
+			t.Errorf("%s: want %d; got %d, %v", tc.value, tc.want, c.maxbatchbytes, err)
+		}
+	}
+	for _, bad := range []string{"", "MB", "16TB", "x16"} {
+		if err := fs.Set("maxbatchbytes", bad); err == nil {
+			t.Errorf("%q: want an error", bad)
+		}
+	}
+	fs.Set("maxbatchbytes", "2KB")
+	if got := fs.Lookup("maxbatchbytes").Value.String(); got != "2048" {
+		t.Errorf("want 2048; got %s", got)
+	}
+}
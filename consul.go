@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulWait is how long Consul holds a blocking query without changes
+const consulWait = 5 * time.Minute
+
+// Consul watches the passing instances of a service, a -fwd of
+// consul+http://service, and makes them the upstream list
+type Consul struct {
+	Addr    string
+	Service string
+	Tag     string
+	Scheme  string
+	index   uint64
+	client  *http.Client
+}
+
+// isConsul is true for a -fwd of consul+http://service
+func isConsul(list string) bool {
+	return strings.HasPrefix(list, "consul+http://") || strings.HasPrefix(list, "consul+https://")
+}
+
+// NewConsul returns the watch of the -fwd service in the Consul agent at addr
+func NewConsul(addr, fwd, tag string) (*Consul, error) {
+	u, err := url.Parse(fwd)
+	if err != nil {
+		return nil, err
+	}
+	return &Consul{
+		Addr:    strings.TrimSuffix(addr, "/"),
+		Service: u.Host,
+		Tag:     tag,
+		Scheme:  strings.TrimPrefix(u.Scheme, "consul+"),
+		client:  &http.Client{Timeout: consulWait + 30*time.Second},
+	}, nil
+}
+
+// Instances returns the -fwd list of the passing instances, with the
+// Consul weights as host*weight. With wait it is a blocking query that
+// returns on a change of the service or after wait
+func (c *Consul) Instances(ctx context.Context, wait time.Duration) (string, error) {
+	query := url.Values{"passing": {"1"}}
+	if c.Tag != "" {
+		query.Set("tag", c.Tag)
+	}
+	if wait > 0 && c.index > 0 {
+		query.Set("index", strconv.FormatUint(c.index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(wait.Seconds())))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Addr+"/v1/health/service/"+url.PathEscape(c.Service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s: %s %s", c.Service, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+			Weights struct {
+				Passing int
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", fmt.Errorf("%s: %v", c.Service, err)
+	}
+	// the index must grow, start over if it went back (a Consul restore)
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if index < c.index {
+		index = 0
+	}
+	c.index = index
+	if len(entries) == 0 {
+		return "", errors.New(c.Service + ": no passing instances")
+	}
+	var hosts []string
+	var weights []int
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		hosts = append(hosts, net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)))
+		weights = append(weights, entry.Service.Weights.Passing)
+	}
+	return weightedList(c.Scheme, hosts, weights), nil
+}
+
+// refresh sets the upstream list from the instances, an error keeps the last one
+func (c *Consul) refresh(ctx context.Context, wait time.Duration) error {
+	list, err := c.Instances(ctx, wait)
+	if err != nil {
+		gr.SimpleSend(fmt.Sprintf("%s.consul_errors", cfg().graphiteprefix), "1")
+		return err
+	}
+	if setDiscovered(list, "") {
+		grlog(LEVEL_INFO, "Upstreams from consul service ", c.Service, ": ", list, Fields{"component": "consul"})
+		gr.SimpleSend(fmt.Sprintf("%s.consul_changes", cfg().graphiteprefix), "1")
+	}
+	return nil
+}
+
+// background watches the service with blocking queries, at most one a second
+// and one in 10 seconds after an error
+func (c *Consul) background() {
+	go func() {
+		for {
+			start := time.Now()
+			if err := c.refresh(context.Background(), consulWait); err != nil {
+				grlog(LEVEL_ERR, "Consul watch error: ", err, Fields{"component": "consul"})
+				c.index = 0
+				time.Sleep(10 * time.Second)
+			} else if time.Since(start) < time.Second {
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsul(t *testing.T) {
+	instances := `[{"Node":{"Address":"10.0.0.1"},"Service":{"Address":"","Port":8123,"Weights":{"Passing":2}}},
+		{"Node":{"Address":"10.0.0.9"},"Service":{"Address":"10.0.0.2","Port":8123,"Weights":{"Passing":1}}}]`
+	var mu sync.Mutex
+	var queries []string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		if r.URL.Path != "/v1/health/service/clickhouse" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("index") == "5" {
+			w.Header().Set("X-Consul-Index", "6")
+			w.Write([]byte(`[{"Node":{"Address":"10.0.0.1"},"Service":{"Port":8123,"Weights":{"Passing":1}}}]`))
+			return
+		}
+		w.Header().Set("X-Consul-Index", "5")
+		w.Write([]byte(instances))
+	}))
+	defer agent.Close()
+	query := func(i int) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries[i]
+	}
+	t.Setenv("CONSUL_HTTP_TOKEN", "secret")
+	defer func(c Config) { restoreConfig(c); setDiscovered("", "") }(*cfg())
+	configure(func(c *Config) { c.fwd, c.consuladdr = "consul+http://clickhouse", agent.URL })
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+
+	consul, err := NewConsul(cfg().consuladdr, cfg().fwd, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consul.refresh(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://10.0.0.1:8123*2,http://10.0.0.2:8123"; fwdList() != want {
+		t.Errorf("want %q; got %q", want, fwdList())
+	}
+	if want := "passing=1&tag=prod"; query(0) != want {
+		t.Errorf("want query %q; got %q", want, query(0))
+	}
+
+	// a deregistered instance leaves the list on the next blocking query
+	if err := consul.refresh(context.Background(), consulWait); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://10.0.0.1:8123"; fwdList() != want {
+		t.Errorf("want %q; got %q", want, fwdList())
+	}
+	if want := "index=5&passing=1&tag=prod&wait=300s"; query(1) != want {
+		t.Errorf("want query %q; got %q", want, query(1))
+	}
+
+	// an error keeps the last upstreams
+	consul.Service = "other"
+	if err := consul.refresh(context.Background(), time.Second); err == nil {
+		t.Errorf("want the 403 error")
+	}
+	if want := "http://10.0.0.1:8123"; fwdList() != want {
+		t.Errorf("want the last list %q; got %q", want, fwdList())
+	}
+
+	// the watch stays on the consul+http -fwd of the start
+	path := filepath.Join(t.TempDir(), "proxyhouse.yaml")
+	ioutil.WriteFile(path, []byte("fwd: http://ch3:8123\n"), 0644)
+	if err := reloadConfig(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg().fwd != "consul+http://clickhouse" {
+		t.Errorf("reload: want the consul+http -fwd kept; got %q", cfg().fwd)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lookupHost and lookupSRV resolve the upstreams, tests swap them
+var (
+	lookupHost = net.DefaultResolver.LookupHost
+	lookupSRV  = net.DefaultResolver.LookupSRV
+)
+
+// discovered is the upstream list found by SRV records, it replaces -fwd,
+// and the backups, the SRV targets of the other priorities
+var discovered struct {
+	sync.RWMutex
+	list    string
+	backups string
+}
+
+// fwdList returns the upstream list: the discovered one or else -fwd
+func fwdList() string {
+	discovered.RLock()
+	defer discovered.RUnlock()
+	if discovered.list != "" {
+		return discovered.list
+	}
+	return cfg().fwd
+}
+
+// failoverList returns the backups followed by the -failover hosts
+func failoverList() string {
+	discovered.RLock()
+	defer discovered.RUnlock()
+	if discovered.backups == "" || cfg().failover == "" {
+		return discovered.backups + cfg().failover
+	}
+	return discovered.backups + "," + cfg().failover
+}
+
+// setDiscovered replaces the upstream and backup lists, it reports whether they changed
+func setDiscovered(list, backups string) bool {
+	discovered.Lock()
+	defer discovered.Unlock()
+	changed := discovered.list != list || discovered.backups != backups
+	discovered.list, discovered.backups = list, backups
+	return changed
+}
+
+// isSRV is true for a -fwd of srv+http://_service._proto.name
+func isSRV(list string) bool {
+	return strings.HasPrefix(list, "srv+http://") || strings.HasPrefix(list, "srv+https://")
+}
+
+// srvUpstreams resolves a srv+http -fwd to the list of the targets with the
+// lowest priority and the backups, the other targets by priority. The SRV
+// weights become host*weight, divided by their greatest common divisor
+func srvUpstreams(ctx context.Context, srv string) (list, backups string, err error) {
+	u, err := url.Parse(srv)
+	if err != nil {
+		return "", "", err
+	}
+	_, addrs, err := lookupSRV(ctx, "", "", u.Host)
+	if err != nil {
+		return "", "", err
+	}
+	if len(addrs) == 0 {
+		return "", "", errors.New(u.Host + ": no SRV records")
+	}
+	scheme := strings.TrimPrefix(u.Scheme, "srv+")
+	priority := addrs[0].Priority
+	for _, addr := range addrs {
+		if addr.Priority < priority {
+			priority = addr.Priority
+		}
+	}
+	var hosts []string
+	var weights []int
+	var others []*net.SRV
+	for _, addr := range addrs {
+		if addr.Priority == priority {
+			hosts = append(hosts, srvHost(addr))
+			weights = append(weights, int(addr.Weight))
+		} else {
+			others = append(others, addr)
+		}
+	}
+	sort.SliceStable(others, func(i, j int) bool { return others[i].Priority < others[j].Priority })
+	bases := make([]string, 0, len(others))
+	for _, addr := range others {
+		bases = append(bases, scheme+"://"+srvHost(addr))
+	}
+	return weightedList(scheme, hosts, weights), strings.Join(bases, ","), nil
+}
+
+// srvHost returns the host:port of the SRV target
+func srvHost(addr *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), fmt.Sprint(addr.Port))
+}
+
+// weightedList returns the sorted -fwd list of the host:port ones, the weights
+// become host*weight divided by their greatest common divisor, 0 is weight 1
+func weightedList(scheme string, hosts []string, weights []int) string {
+	divisor := 0
+	for _, weight := range weights {
+		divisor = gcd(divisor, weight)
+	}
+	bases := make([]string, 0, len(hosts))
+	for i, host := range hosts {
+		base := scheme + "://" + host
+		if divisor > 0 && weights[i]/divisor > 1 {
+			base += fmt.Sprintf("*%d", weights[i]/divisor)
+		}
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	return strings.Join(bases, ",")
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// DNSWatch resolves the upstream hosts again every -dnsrefresh, so a DNS
+// failover reaches proxyhouse without a restart. Keep-alive connections stay
+// on the address they were dialed to, on a change the idle ones are closed
+// at once and at the next refresh, after the busy ones went idle
+type DNSWatch struct {
+	addrs map[string]string
+	close bool
+}
+
+func newDNSWatch() *DNSWatch {
+	return &DNSWatch{addrs: make(map[string]string)}
+}
+
+// refresh reads the SRV records of a srv+http -fwd and resolves the hosts,
+// it returns the first error
+func (d *DNSWatch) refresh(ctx context.Context) (err error) {
+	if d.close {
+		client.CloseIdleConnections()
+		d.close = false
+	}
+	if isSRV(cfg().fwd) {
+		list, backups, e := srvUpstreams(ctx, cfg().fwd)
+		if e != nil {
+			gr.SimpleSend(fmt.Sprintf("%s.dns_errors", cfg().graphiteprefix), "1")
+			return e
+		}
+		if setDiscovered(list, backups) {
+			grlog(LEVEL_INFO, "Upstreams from ", cfg().fwd, ": ", list, ", backups: ", backups, Fields{"component": "dns"})
+		}
+	}
+	changed := false
+	for _, base := range upstreams(fwdList()) {
+		u, e := url.Parse(base)
+		if e != nil || u.Scheme == "unix" || net.ParseIP(u.Hostname()) != nil {
+			continue
+		}
+		host := u.Hostname()
+		ips, e := lookupHost(ctx, host)
+		if e != nil {
+			gr.SimpleSend(fmt.Sprintf("%s.dns_errors", cfg().graphiteprefix), "1")
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		sort.Strings(ips)
+		joined := strings.Join(ips, ",")
+		if old, ok := d.addrs[host]; ok && old != joined {
+			grlog(LEVEL_WARN, "Upstream ", host, " moved from ", old, " to ", joined, Fields{"component": "dns"})
+			changed = true
+		}
+		d.addrs[host] = joined
+	}
+	if changed {
+		gr.SimpleSend(fmt.Sprintf("%s.dns_changes", cfg().graphiteprefix), "1")
+		client.CloseIdleConnections()
+		d.close = true
+	}
+	return err
+}
+
+// background refreshes every interval
+func (d *DNSWatch) background(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := d.refresh(ctx); err != nil {
+				grlog(LEVEL_ERR, "DNS refresh error: ", err, Fields{"component": "dns"})
+			}
+			cancel()
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSRVUpstreams(t *testing.T) {
+	defer func(l func(context.Context, string, string, string) (string, []*net.SRV, error)) { lookupSRV = l }(lookupSRV)
+	defer func(l func(context.Context, string) ([]string, error)) { lookupHost = l }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.1"}, nil
+	}
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_clickhouse._tcp.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return "", []*net.SRV{
+			{Target: "ch2.example.com.", Port: 8123, Priority: 10, Weight: 20},
+			{Target: "ch1.example.com.", Port: 8123, Priority: 10, Weight: 60},
+			{Target: "dr2.example.com.", Port: 8123, Priority: 30, Weight: 100},
+			{Target: "dr.example.com.", Port: 8123, Priority: 20, Weight: 100},
+		}, nil
+	}
+	list, backups, err := srvUpstreams(context.Background(), "srv+https://_clickhouse._tcp.example.com")
+	if want := "https://ch1.example.com:8123*3,https://ch2.example.com:8123"; err != nil || list != want {
+		t.Errorf("want %q; got %q, %v", want, list, err)
+	}
+	if want := "https://dr.example.com:8123,https://dr2.example.com:8123"; backups != want {
+		t.Errorf("want backups %q; got %q", want, backups)
+	}
+	if _, _, err := srvUpstreams(context.Background(), "srv+http://_clickhouse._tcp.example.org"); err == nil {
+		t.Errorf("want the lookup error")
+	}
+
+	defer func(c Config) { restoreConfig(c); setDiscovered("", "") }(*cfg())
+	configure(func(c *Config) { c.fwd = "srv+http://_clickhouse._tcp.example.com" })
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+	configure(func(c *Config) { c.fwd = "srv+http://_clickhouse._tcp.example.com,http://ch3:8123" })
+	if problems := validateFlags(cfg()); len(problems) == 0 {
+		t.Errorf("want a list with srv+http invalid")
+	}
+	configure(func(c *Config) { c.fwd = "srv+http://_clickhouse._tcp.example.com" })
+	if err := newDNSWatch().refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if base, _ := upstream("t"); base != "http://ch1.example.com:8123" && base != "http://ch2.example.com:8123" {
+		t.Errorf("want a discovered upstream; got %q", base)
+	}
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.failover = "http://ch-dr:8123" })
+	bases := failoverBases("http://ch1.example.com:8123")
+	if want := "http://ch2.example.com:8123,http://dr.example.com:8123,http://dr2.example.com:8123,http://ch-dr:8123"; strings.Join(bases, ",") != want {
+		t.Errorf("want failover to %q; got %q", want, bases)
+	}
+
+	// the discovered upstreams stay until a restart
+	path := filepath.Join(t.TempDir(), "proxyhouse.yaml")
+	ioutil.WriteFile(path, []byte("fwd: http://ch3:8123\n"), 0644)
+	if err := reloadConfig(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg().fwd != "srv+http://_clickhouse._tcp.example.com" {
+		t.Errorf("reload: want the srv+http -fwd kept; got %q", cfg().fwd)
+	}
+}
+
+func TestDNSWatch(t *testing.T) {
+	defer func(l func(context.Context, string) ([]string, error)) { lookupHost = l }(lookupHost)
+	addrs := map[string][]string{"ch1": {"10.0.0.1"}}
+	lookups := 0
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		if ips, ok := addrs[host]; ok {
+			return ips, nil
+		}
+		return nil, errors.New("no such host " + host)
+	}
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = "http://ch1:8123,http://127.0.0.1:8123" })
+	watch := newDNSWatch()
+	if err := watch.refresh(context.Background()); err != nil || watch.close {
+		t.Errorf("first resolve: want no change; got %v %v", err, watch.close)
+	}
+	if lookups != 1 {
+		t.Errorf("want IPs not resolved; got %d lookups", lookups)
+	}
+	addrs["ch1"] = []string{"10.0.0.2"}
+	if err := watch.refresh(context.Background()); err != nil || !watch.close {
+		t.Errorf("moved: want the idle connections closed; got %v %v", err, watch.close)
+	}
+	if watch.refresh(context.Background()); watch.close {
+		t.Errorf("want idle connections closed once more only")
+	}
+	configure(func(c *Config) { c.fwd = "http://ch2:8123" })
+	if err := watch.refresh(context.Background()); err == nil {
+		t.Errorf("want the lookup error")
+	}
+}
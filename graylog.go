@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -31,10 +32,12 @@ const (
 type Graylog struct {
 	Host      string
 	Port      int
+	Transport string // udp, tcp or tls
+	TLSConfig *tls.Config
 	ChunkSize int
 	Hostname  string
 	Filename  string
-	Connect   *net.UDPConn
+	Connect   net.Conn
 	MessageID uint64
 	LogLevel  uint8
 }
@@ -83,6 +86,9 @@ func NewGraylog(opts Graylog) *Graylog {
 	if opts.LogLevel == 0 {
 		opts.LogLevel = LEVEL_INFO
 	}
+	if opts.Transport == "" {
+		opts.Transport = "udp"
+	}
 	return &opts
 }
 
@@ -99,6 +105,43 @@ func Connect(host string, port int) (*net.UDPConn, error) {
 	return conn, nil
 }
 
+// dial connects by the transport, tcp and tls are for graylog behind TCP load balancers
+func (gl *Graylog) dial() (net.Conn, error) {
+	addr := net.JoinHostPort(gl.Host, strconv.Itoa(gl.Port))
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	switch gl.Transport {
+	case "tcp":
+		return dialer.Dial("tcp", addr)
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", addr, gl.TLSConfig)
+	}
+	return Connect(gl.Host, gl.Port)
+}
+
+// stream is true for the tcp and tls transports, GELF messages there are
+// whole JSON ended by a null byte, without compression and chunks
+func (gl *Graylog) stream() bool {
+	return gl.Transport == "tcp" || gl.Transport == "tls"
+}
+
+// Name is the sink name in the log when it is unreachable
+func (gl *Graylog) Name() string {
+	return "Graylog"
+}
+
+// Dial connects to graylog, up to attempts times with the backoff between them
+func (gl *Graylog) Dial(attempts int, backoff Backoff) (err error) {
+	for i := 0; i == 0 || i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff.Delay(i - 1))
+		}
+		if gl.Connect, err = gl.dial(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
 func (gl *Graylog) Compress(b []byte) bytes.Buffer {
 	var buf bytes.Buffer
 	comp := zlib.NewWriter(&buf)
@@ -107,15 +150,28 @@ func (gl *Graylog) Compress(b []byte) bytes.Buffer {
 	return buf
 }
 
+// Send writes the packet, a broken tcp or tls connection is dialed again
+// and the packet written once more
 func (gl *Graylog) Send(b []byte) {
-	if gl.Connect == nil {
-		conn, err := Connect(gl.Host, gl.Port)
-		if err != nil {
+	for attempt := 0; attempt < 2; attempt++ {
+		if gl.Connect == nil {
+			conn, err := gl.dial()
+			if err != nil {
+				return
+			}
+			gl.Connect = conn
+		}
+		if !gl.stream() {
+			gl.Connect.Write(b)
+			return
+		}
+		gl.Connect.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := gl.Connect.Write(b); err == nil {
 			return
 		}
-		gl.Connect = conn
+		gl.Connect.Close()
+		gl.Connect = nil
 	}
-	gl.Connect.Write(b)
 }
 
 func (gl *Graylog) Message(level uint8, msg string) *GLMessage {
@@ -159,6 +215,14 @@ func (gl *Graylog) Append(level uint8, data ...interface{}) {
 	}
 
 	msg := gl.Message(level, strbuf.String())
+	if gl.stream() {
+		jsondata, err := json.Marshal(msg)
+		if err != nil {
+			return
+		}
+		gl.Send(append(jsondata, 0))
+		return
+	}
 	buf, err := gl.PackMessage(msg)
 	if err != nil {
 		return
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
+	"encoding/json"
 	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestGraylog(t *testing.T) {
@@ -69,3 +73,60 @@ func TestGraylog(t *testing.T) {
 
 	gl.Info(long_message)
 }
+
+func TestGraylogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	gl := NewGraylog(Graylog{Host: "127.0.0.1", Port: addr.Port, Transport: "tcp", Hostname: "h"})
+	if err := gl.Dial(1, Backoff{}); err != nil {
+		t.Fatal(err)
+	}
+	read := func(conn net.Conn) GLMessage {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadBytes(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg GLMessage
+		if err := json.Unmarshal(line[:len(line)-1], &msg); err != nil {
+			t.Fatal(err, string(line))
+		}
+		return msg
+	}
+
+	gl.Info("first")
+	conn := <-conns
+	if msg := read(conn); msg.Short != "first " || msg.Host != "h" {
+		t.Errorf("first: got %+v", msg)
+	}
+	// the server drops the connection, the writes after it dial again
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		gl.Info("second")
+		select {
+		case conn = <-conns:
+			if msg := read(conn); msg.Short != "second " {
+				t.Errorf("second: got %+v", msg)
+			}
+			conn.Close()
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("no reconnect")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"hash/crc32"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ringReplicas are the points of a host on the ring, enough for an even
+// spread over a few hosts
+const ringReplicas = 160
+
+// HashRing maps keys to hosts by consistent hashing, a host added or
+// removed moves only the keys of its points
+type HashRing struct {
+	points []uint32
+	hosts  map[uint32]string
+}
+
+// NewHashRing puts ringReplicas points of every host on the ring, times
+// its weight, nil weights are all 1
+func NewHashRing(hosts []string, weights []int) *HashRing {
+	r := &HashRing{hosts: make(map[uint32]string)}
+	for n, host := range hosts {
+		replicas := ringReplicas
+		if weights != nil {
+			replicas *= weights[n]
+		}
+		for i := 0; i < replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(host + "#" + strconv.Itoa(i)))
+			if _, ok := r.hosts[point]; !ok {
+				r.hosts[point] = host
+				r.points = append(r.points, point)
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Get returns the host of the key, the next one on the ring when skip says
+// so, and the key's own host when every host is skipped
+func (r *HashRing) Get(key string, skip func(host string) bool) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	for i := 0; i < len(r.points); i++ {
+		host := r.hosts[r.points[(start+i)%len(r.points)]]
+		if skip == nil || !skip(host) {
+			return host
+		}
+	}
+	return r.hosts[r.points[start%len(r.points)]]
+}
+
+var upstreamRing struct {
+	sync.Mutex
+	fwd  string
+	ring *HashRing
+}
+
+// shardRing returns the ring of the -fwd hosts, built again when a reload
+// or discovery changed them
+func shardRing() *HashRing {
+	upstreamRing.Lock()
+	defer upstreamRing.Unlock()
+	if list := fwdList(); upstreamRing.ring == nil || upstreamRing.fwd != list {
+		upstreamRing.fwd, upstreamRing.ring = list, NewHashRing(upstreamWeights(list))
+	}
+	return upstreamRing.ring
+}
+
+// shardKey returns what the key is sharded by: the table with -shardby=table
+// or else the value of the -shardby query param, the table without one
+func shardKey(key string) string {
+	if cfg().shardby != "table" {
+		if u, err := url.Parse(key); err == nil {
+			if v := u.Query().Get(cfg().shardby); v != "" {
+				return v
+			}
+		}
+	}
+	return extractTable(key)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	hosts := []string{"http://ch1:8123", "http://ch2:8123", "http://ch3:8123"}
+	r := NewHashRing(hosts, nil)
+	counts := make(map[string]int)
+	owner := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("table_%d", i)
+		owner[key] = r.Get(key, nil)
+		counts[owner[key]]++
+	}
+	for _, host := range hosts {
+		if counts[host] < 700 || counts[host] > 1300 {
+			t.Errorf("want about 1000 keys on %s; got %v", host, counts)
+		}
+	}
+
+	// a fourth host takes about a quarter of the keys, only from the others
+	r4 := NewHashRing(append(hosts, "http://ch4:8123"), nil)
+	moved := 0
+	for key, host := range owner {
+		if got := r4.Get(key, nil); got != host {
+			moved++
+			if got != "http://ch4:8123" {
+				t.Fatalf("%s moved from %s to %s, not to the new host", key, host, got)
+			}
+		}
+	}
+	if moved < 450 || moved > 1050 {
+		t.Errorf("want about 750 keys moved; got %d", moved)
+	}
+
+	skip := func(host string) bool { return host == owner["table_1"] }
+	if got := r.Get("table_1", skip); got == owner["table_1"] || got == "" {
+		t.Errorf("skipped host: want another one; got %s", got)
+	}
+	if got := r.Get("table_1", func(string) bool { return true }); got != owner["table_1"] {
+		t.Errorf("all skipped: want the own host %s; got %s", owner["table_1"], got)
+	}
+}
+
+func TestShardBy(t *testing.T) {
+	defer func(h *UpstreamHealth, c Config) { upstreamHealth = h; restoreConfig(c) }(upstreamHealth, *cfg())
+	configure(func(c *Config) { c.fwd = "http://ch1:8123,http://ch2:8123,http://ch3:8123" })
+	upstreamHealth = newUpstreamHealth()
+
+	configure(func(c *Config) { c.shardby = "table" })
+	events, _ := upstream("?query=INSERT%20INTO%20events%20VALUES")
+	for i := 0; i < 5; i++ {
+		if got, _ := upstream("?query=INSERT%20INTO%20events%20FORMAT%20TSV"); got != events {
+			t.Fatalf("want every insert into events on %s; got %s", events, got)
+		}
+	}
+
+	configure(func(c *Config) { c.shardby = "shard" })
+	a, _ := upstream("?query=INSERT%20INTO%20events%20VALUES&shard=a")
+	b, _ := upstream("?query=INSERT%20INTO%20logs%20VALUES&shard=a")
+	if a != b || a != NewHashRing(upstreams(cfg().fwd), nil).Get("a", nil) {
+		t.Errorf("want shard a on one host; got %s %s", a, b)
+	}
+	if got, _ := upstream("?query=INSERT%20INTO%20events%20VALUES"); got != events {
+		t.Errorf("no shard param: want the table host %s; got %s", events, got)
+	}
+
+	// a reloaded -fwd builds the ring again
+	configure(func(c *Config) { c.fwd = "http://ch9:8123,http://ch8:8123" })
+	if got, _ := upstream("?query=INSERT%20INTO%20events%20VALUES"); got != "http://ch9:8123" && got != "http://ch8:8123" {
+		t.Errorf("want a host of the new -fwd; got %s", got)
+	}
+}
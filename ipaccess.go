@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// IPRule allows or denies clients of the network
+type IPRule struct {
+	Allow bool
+	Net   *net.IPNet
+}
+
+var (
+	ipRules   []IPRule
+	ipRulesMu sync.RWMutex
+)
+
+// loadIPRules reads the -ipaccess file, "allow CIDR" or "deny CIDR" lines
+// with # comments, an address is a /32 (/128) and "all" is any address
+func loadIPRules(name string) (rules []IPRule, err error) {
+	if name == "" {
+		return nil, nil
+	}
+	lines, err := readLines(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("%s line %d: want allow or deny CIDR", name, i+1)
+		}
+		rule := IPRule{Allow: fields[0] == "allow"}
+		switch addr := fields[1]; {
+		case addr == "all":
+			rules = append(rules, IPRule{rule.Allow, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}})
+			rule.Net = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+		case strings.Contains(addr, "/"):
+			if _, rule.Net, err = net.ParseCIDR(addr); err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", name, i+1, err)
+			}
+		default:
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("%s line %d: bad address %q", name, i+1, addr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			rule.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ipAllowed returns the first rule matching the ip, nginx style,
+// an address no rule matches is allowed
+func ipAllowed(rules []IPRule, ip net.IP) bool {
+	for _, rule := range rules {
+		if rule.Net.Contains(ip) {
+			return rule.Allow
+		}
+	}
+	return true
+}
+
+// setIPRules loads the -ipaccess file, on start and on a reload
+func setIPRules() error {
+	rules, err := loadIPRules(cfg().ipaccess)
+	if err != nil {
+		return err
+	}
+	ipRulesMu.Lock()
+	ipRules = rules
+	ipRulesMu.Unlock()
+	return nil
+}
+
+// ipfilter rejects clients denied by -ipaccess with 403 before any handler
+func ipfilter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ipRulesMu.RLock()
+		rules := ipRules
+		ipRulesMu.RUnlock()
+		if len(rules) > 0 {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if ip := net.ParseIP(host); ip == nil || !ipAllowed(rules, ip) {
+				grlog(LEVEL_WARN, "Denied client ", host, " by -ipaccess", Fields{"component": "auth"})
+				gr.SimpleSend(fmt.Sprintf("%s.ip_denied", cfg().graphiteprefix), "1")
+				http.Error(w, "403 forbidden.", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
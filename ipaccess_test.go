@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIPAccess(t *testing.T) {
+	defer func(c Config) { restoreConfig(c); setIPRules() }(*cfg())
+	configure(func(c *Config) { c.ipaccess = filepath.Join(t.TempDir(), "ipaccess") })
+	ioutil.WriteFile(cfg().ipaccess, []byte("# producers\ndeny 10.1.2.3\nallow 10.0.0.0/8\nallow ::1\ndeny all\n"), 0600)
+	if err := setIPRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := ipfilter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for addr, want := range map[string]int{
+		"10.0.0.1:5000":    http.StatusOK,
+		"10.1.2.3:5000":    http.StatusForbidden,
+		"192.168.1.1:5000": http.StatusForbidden,
+		"[::1]:5000":       http.StatusOK,
+		"[2001:db8::1]:80": http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: want %d; got %d", addr, want, w.Code)
+		}
+	}
+
+	// no match is allowed, the file is read again by a reload
+	ioutil.WriteFile(cfg().ipaccess, []byte("deny 10.0.0.0/8\n"), 0600)
+	if err := setIPRules(); err != nil {
+		t.Fatal(err)
+	}
+	if !ipAllowed(ipRules, net.ParseIP("192.168.1.1")) || ipAllowed(ipRules, net.ParseIP("10.0.0.1")) {
+		t.Errorf("want 10.0.0.0/8 denied only; got %v", ipRules)
+	}
+
+	ioutil.WriteFile(cfg().ipaccess, []byte("permit 10.0.0.0/8\n"), 0600)
+	if problems := strings.Join(validateFlags(cfg()), "\n"); !strings.Contains(problems, "-ipaccess") {
+		t.Errorf("want a problem; got %q", problems)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// JWTVerifier checks the signature and claims of bearer tokens, HS256 with a
+// secret or RS256, ES256 with a public key
+type JWTVerifier struct {
+	secret []byte
+	key    crypto.PublicKey
+	issuer string
+}
+
+// JWTClaims are the claims proxyhouse checks, Tables are path.Match patterns
+// of the tables the token may insert into
+type JWTClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Tables    []string `json:"tables"`
+}
+
+// NewJWTVerifier reads the key file, a PEM public key or else the HMAC secret
+func NewJWTVerifier(keyFile, issuer string) (*JWTVerifier, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	v := &JWTVerifier{issuer: issuer}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		v.secret = []byte(strings.TrimSpace(string(data)))
+		if len(v.secret) < 32 {
+			return nil, fmt.Errorf("%s: HMAC secret shorter than 32 bytes", keyFile)
+		}
+		return v, nil
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		v.key = cert.PublicKey
+	} else if v.key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	switch v.key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%s: want an RSA or ECDSA public key", keyFile)
+}
+
+// Verify returns the claims of a valid token
+func (v *JWTVerifier) Verify(token string, now time.Time) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := v.verifySignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	claims := &JWTClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return nil, errors.New("token not valid yet")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("bad issuer %q", claims.Issuer)
+	}
+	return claims, nil
+}
+
+// verifySignature checks the alg matches the key, so an RS256 public key
+// is never taken as an HS256 secret
+func (v *JWTVerifier) verifySignature(alg, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch key := v.key.(type) {
+	case nil:
+		if alg != "HS256" {
+			break
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(sig) != 64 || !ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected alg %q", alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// bearerToken returns the token of the Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+type tablesKey struct{}
+
+// withTables keeps the table patterns of the token for tableAllowed
+func withTables(ctx context.Context, tables []string) context.Context {
+	return context.WithValue(ctx, tablesKey{}, tables)
+}
+
+// tableAllowed reports whether the token of the request may insert into the
+// table, requests without a token are not restricted. An empty table, the
+// query is not an INSERT, is never allowed for a token
+func tableAllowed(r *http.Request, table string) bool {
+	tables, ok := r.Context().Value(tablesKey{}).([]string)
+	if !ok {
+		return true
+	}
+	if table == "" {
+		return false
+	}
+	table = strings.ToLower(table)
+	for _, pattern := range tables {
+		if matched, _ := path.Match(strings.ToLower(pattern), table); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// denyTable rejects an insert into a table the token has no access to
+func denyTable(w http.ResponseWriter, r *http.Request, table string) {
+	grlog(LEVEL_WARN, "Denied insert into ", table, " from ", r.RemoteAddr, Fields{"component": "auth", "table": table})
+	gr.SimpleSend(fmt.Sprintf("%s.auth_denied", cfg().graphiteprefix), "1")
+	http.Error(w, "403 forbidden, no access to table "+table+".", http.StatusForbidden)
+}
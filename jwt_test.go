@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT signs the claims with the HMAC secret or else the ECDSA key
+func signJWT(t *testing.T, claims map[string]interface{}, secret []byte, key *ecdsa.PrivateKey) string {
+	alg := "HS256"
+	if key != nil {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	if key == nil {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	} else {
+		sum := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	dir := t.TempDir()
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	ioutil.WriteFile(filepath.Join(dir, "secret"), append(secret, '\n'), 0600)
+	v, err := NewJWTVerifier(filepath.Join(dir, "secret"), "auth.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "team-a", "iss": "auth.example", "exp": now.Add(time.Hour).Unix(), "tables": []string{"events"}}
+		for k, val := range extra {
+			c[k] = val
+		}
+		return c
+	}
+
+	got, err := v.Verify(signJWT(t, claims(nil), secret, nil), now)
+	if err != nil || got.Subject != "team-a" || len(got.Tables) != 1 {
+		t.Errorf("valid token: got %+v %v", got, err)
+	}
+	for name, tc := range map[string]struct {
+		claims map[string]interface{}
+		secret []byte
+	}{
+		"expired":    {claims(map[string]interface{}{"exp": now.Add(-time.Second).Unix()}), secret},
+		"no exp":     {claims(map[string]interface{}{"exp": 0}), secret},
+		"nbf":        {claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}), secret},
+		"issuer":     {claims(map[string]interface{}{"iss": "other"}), secret},
+		"bad secret": {claims(nil), []byte("another secret of 32 bytes......")},
+	} {
+		if _, err := v.Verify(signJWT(t, tc.claims, tc.secret, nil), now); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+	if _, err := v.Verify("a.b", now); err == nil {
+		t.Error("malformed: want an error")
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	ioutil.WriteFile(filepath.Join(dir, "pub.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	ev, err := NewJWTVerifier(filepath.Join(dir, "pub.pem"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ev.Verify(signJWT(t, claims(nil), nil, key), now); err != nil {
+		t.Errorf("ES256: %v", err)
+	}
+	// an HS256 token signed with the public key bytes must not pass
+	pub, _ := ioutil.ReadFile(filepath.Join(dir, "pub.pem"))
+	if _, err := ev.Verify(signJWT(t, claims(nil), pub, nil), now); err == nil {
+		t.Error("HS256 with the public key: want an error")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "short"), []byte("short"), 0600)
+	if _, err := NewJWTVerifier(filepath.Join(dir, "short"), ""); err == nil {
+		t.Error("short secret: want an error")
+	}
+}
+
+func TestJWTTables(t *testing.T) {
+	defer func(c Config) { restoreConfig(c); setCredentials() }(*cfg())
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	configure(func(c *Config) { c.jwtkey = filepath.Join(t.TempDir(), "secret") })
+	configure(func(c *Config) { c.jwtissuer = "" })
+	ioutil.WriteFile(cfg().jwtkey, secret, 0600)
+	if err := setCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	token := signJWT(t, map[string]interface{}{"sub": "team-a", "exp": exp, "tables": []string{"events", "team_a_*"}}, secret, nil)
+	none := signJWT(t, map[string]interface{}{"sub": "team-b", "exp": exp}, secret, nil)
+
+	for _, tc := range []struct {
+		token, url string
+		want       int
+	}{
+		{"", "/ingest?table=events", http.StatusUnauthorized},
+		{token, "/ingest?table=logs", http.StatusForbidden},
+		{none, "/ingest?table=events", http.StatusForbidden},
+		{token, "/?query=INSERT%20INTO%20logs%20VALUES", http.StatusForbidden},
+		{token, "/?query=INSERT%20INTO%20team_b_logs%20VALUES", http.StatusForbidden},
+		// the table of a decoy param is not the one clickhouse inserts into
+		{token, "/?param_x=INSERT%20INTO%20events%20&query=INSERT%20INTO%20secret%20VALUES", http.StatusForbidden},
+		{token, "/?query=SELECT%201%20INSERT%20INTO%20events%20VALUES", http.StatusForbidden},
+		{token, "/?query=INSERT%20INTO%20events%20VALUES&query=INSERT%20INTO%20secret%20VALUES", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("POST", tc.url, strings.NewReader("(1)"))
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handler := dorequest
+		if strings.HasPrefix(tc.url, "/ingest") {
+			handler = doingest
+		}
+		authonly(handler)(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: want %d; got %d %s", tc.url, tc.want, w.Code, w.Body)
+		}
+	}
+
+	var allowed []bool
+	check := func(w http.ResponseWriter, r *http.Request) {
+		allowed = append(allowed, tableAllowed(r, "events"), tableAllowed(r, "Team_A_Logs"), tableAllowed(r, "team_b"))
+	}
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	authonly(check)(httptest.NewRecorder(), r)
+	if len(allowed) != 3 || !allowed[0] || !allowed[1] || allowed[2] {
+		t.Errorf("want events and team_a_* only; got %v", allowed)
+	}
+
+	for query, want := range map[string]string{
+		"INSERT INTO events VALUES":                   "events",
+		" insert into TABLE `db`.`Events` FORMAT TSV": "db.events",
+		"INSERT INTO \"events\"(a, b) VALUES":         "events",
+		"SELECT 1 FROM events":                        "",
+		"/* INSERT INTO events */ SELECT 1":           "",
+	} {
+		if got := insertTable(url.Values{"query": {query}}); got != want {
+			t.Errorf("%q: want table %q; got %q", query, want, got)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fields are the structured part of a log line: component, table, key, error.
+// grlog takes them as the last argument, in text they are key=value pairs
+type Fields map[string]interface{}
+
+// String formats the fields as sorted key=value pairs
+func (f Fields) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, f[k]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// levelNames are the logLevels by level
+var levelNames = func() map[uint8]string {
+	names := make(map[uint8]string, len(logLevels))
+	for name, level := range logLevels {
+		names[level] = name
+	}
+	return names
+}()
+
+// logLevel is the -loglevel level, debug with -isdebug
+func logLevel() uint8 {
+	if cfg().isdebug {
+		return LEVEL_DBG
+	}
+	if level, ok := logLevels[cfg().loglevel]; ok {
+		return level
+	}
+	return LEVEL_INFO
+}
+
+// openLog opens the -logfile destination, stdout for "" and stderr for
+// "stderr", a file is appended to
+func openLog(path string) (io.Writer, error) {
+	switch path {
+	case "":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// writeLog writes a grlog line to w, with -logformat=json as one JSON object
+// with time, level, msg and the fields, an error in data is the error field
+func writeLog(w io.Writer, level uint8, data ...interface{}) {
+	if cfg().logformat != "json" {
+		fmt.Fprintln(w, data...)
+		return
+	}
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": levelNames[level],
+	}
+	var msg []interface{}
+	for _, d := range data {
+		switch v := d.(type) {
+		case Fields:
+			for k, value := range v {
+				if err, ok := value.(error); ok {
+					value = err.Error()
+				}
+				entry[k] = value
+			}
+		case error:
+			entry["error"] = v.Error()
+			msg = append(msg, d)
+		default:
+			msg = append(msg, d)
+		}
+	}
+	entry["msg"] = strings.TrimSpace(fmt.Sprintln(msg...))
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Fprintln(w, data...)
+		return
+	}
+	w.Write(append(line, '\n'))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteLog(t *testing.T) {
+	defer restoreConfig(*cfg())
+	var buf bytes.Buffer
+	fields := Fields{"component": "flush", "table": "t", "key": "?query=x"}
+
+	configure(func(c *Config) { c.logformat = "text" })
+	writeLog(&buf, LEVEL_ERR, "Request error:", errors.New("boom"), fields)
+	if want := "Request error: boom component=flush key=?query=x table=t\n"; buf.String() != want {
+		t.Errorf("text: want %q; got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	configure(func(c *Config) { c.logformat = "json" })
+	writeLog(&buf, LEVEL_ERR, "Request error:", errors.New("boom"), fields)
+	writeLog(&buf, LEVEL_INFO, "Shutdown done")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines; got %q", buf.String())
+	}
+	var entry map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err, lines[0])
+	}
+	for k, want := range map[string]string{"level": "error", "msg": "Request error: boom", "error": "boom", "component": "flush", "table": "t", "key": "?query=x"} {
+		if entry[k] != want {
+			t.Errorf("%s: want %q; got %q", k, want, entry[k])
+		}
+	}
+	if entry["time"] == "" {
+		t.Error("want time")
+	}
+	entry = nil
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry["level"] != "info" || entry["msg"] != "Shutdown done" {
+		t.Errorf("info: got %v %v", entry, err)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	defer func(w io.Writer, c Config) { logout = w; restoreConfig(c) }(logout, *cfg())
+	var buf bytes.Buffer
+	logout = &buf
+	log := func() []string {
+		buf.Reset()
+		grlog(LEVEL_DBG, "debug")
+		grlog(LEVEL_INFO, "info")
+		grlog(LEVEL_WARN, "warn")
+		grlog(LEVEL_ERR, "error")
+		return strings.Fields(buf.String())
+	}
+	for _, tc := range []struct {
+		level   string
+		isdebug bool
+		want    string
+	}{
+		{"info", false, "info warn error"},
+		{"warn", false, "warn error"},
+		{"error", false, "error"},
+		{"debug", false, "debug info warn error"},
+		{"error", true, "debug info warn error"},
+	} {
+		configure(func(c *Config) { c.loglevel, c.isdebug = tc.level, tc.isdebug })
+		if got := strings.Join(log(), " "); got != tc.want {
+			t.Errorf("%s isdebug %v: want %q; got %q", tc.level, tc.isdebug, tc.want, got)
+		}
+	}
+}
+
+func TestLogBody(t *testing.T) {
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ch.Close()
+	defer func(w io.Writer, c Config) { logout = w; restoreConfig(c) }(logout, *cfg())
+	var buf bytes.Buffer
+	logout = &buf
+	configure(func(c *Config) { c.fwd, c.isdebug = ch.URL, true })
+	key := "?query=INSERT%20INTO%20t%20VALUES"
+
+	for _, tc := range []struct {
+		bytes int
+		want  string
+	}{
+		{0, ""},
+		{4, "val:  (1), ...(truncated at 4 bytes)"},
+		{100, "val:  (1),(2),(3) "},
+	} {
+		buf.Reset()
+		configure(func(c *Config) { c.logbodybytes = tc.bytes })
+		if _, _, err := deliver(context.Background(), key, []byte("(1),(2),(3)"), 3); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); tc.want == "" && strings.Contains(got, "(1)") || tc.want != "" && !strings.Contains(got, tc.want) {
+			t.Errorf("logbodybytes %d: want %q logged; got %q", tc.bytes, tc.want, got)
+		}
+	}
+}
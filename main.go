@@ -3,24 +3,32 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
-	_ "expvar"
-
 	"github.com/marpaia/graphite-golang"
 	"github.com/recoilme/graceful"
 	"github.com/recoilme/pudge"
@@ -28,29 +36,261 @@ import (
 )
 
 var (
-	errClose       = errors.New("Error closed")
-	version        = "0.2.0"
-	port           = flag.Int("p", 8124, "TCP port number to listen on (default: 8124)")
-	keepalive      = flag.Int("keepalive", 10, "keepalive connection, in seconds")
-	readtimeout    = flag.Int("readtimeout", 5, "request header read timeout, in seconds")
-	fwd            = flag.String("fwd", "http://localhost:8123", "forward to this server (clickhouse)")
-	repl           = flag.String("repl", "", "replace this string on forward")
-	delim          = flag.String("delim", ",", "body delimiter")
-	syncsec        = flag.Int("syncsec", 2, "sync interval, in seconds")
-	graphitehost   = flag.String("graphitehost", "", "graphite host")
-	graphiteport   = flag.Int("graphiteport", 2023, "graphite port")
-	graphiteprefix = flag.String("graphiteprefix", "relap.count.proxyhouse", "graphite prefix")
-	grayloghost    = flag.String("grayloghost", "", "graylog host")
-	graylogport    = flag.Int("graylogport", 12201, "graylog port")
-	isdebug        = flag.Bool("isdebug", false, "debug requests")
-	resendint      = flag.Int("resendint", 60, "resend error interval, in seconds")
-	warnlevel      = flag.Int("w", 400, "error counts for warning level")
-	critlevel      = flag.Int("c", 500, "error counts for error level")
-
-	status           = "OK\r\n"
+	errClose = errors.New("Error closed")
+	version  = "0.2.0"
+
 	graylog *Graylog = nil
 )
 
+// Config is the flag values. The running one is never changed in place, a
+// -config reload publishes a changed copy, so a reader sees the old values
+// or the new ones, never a mix
+type Config struct {
+	configfile         string
+	port               int
+	tlscert            string
+	tlskey             string
+	tlsclientca        string
+	adminport          int
+	pprof              bool
+	keepalive          int
+	shutdowntimeout    int
+	sigintimeout       int
+	readtimeout        int
+	fwd                string
+	failover           string
+	shardby            string
+	dnsrefresh         int
+	consuladdr         string
+	consultag          string
+	repl               string
+	replmode           string
+	delim              string
+	logformat          string
+	syncsec            int
+	tablesyncsec       string
+	graphitehost       string
+	graphiteport       int
+	graphiteprefix     string
+	graphiteproto      string
+	graphiteagg        int
+	statsdhost         string
+	statsdprefix       string
+	statsdtags         string
+	grayloghost        string
+	graylogport        int
+	graylogretries     int
+	graylogproto       string
+	graylogca          string
+	syslog             string
+	webhook            string
+	memstats           int
+	metricsqueue       int
+	isdebug            bool
+	loglevel           string
+	logbodybytes       int
+	logfile            string
+	resendint          int
+	errbackoffmax      int
+	retries            int
+	backoffbase        int
+	backoffmax         int
+	flushretries       int
+	flushretrydelay    int
+	tracing            bool
+	ejectafter         int
+	probeint           int
+	healthcheck        bool
+	flushretrystatus   bool
+	warnlevel          int
+	critlevel          int
+	multipartfield     string
+	allowemptybody     bool
+	okstatus           string
+	synctables         string
+	querynormalize     string
+	keyparams          string
+	maxkeys            int
+	keyoverflow        string
+	pausespill         bool
+	maxstorebytes      int
+	storeoverflow      string
+	httpproxy          string
+	noproxy            string
+	upca               string
+	upcert             string
+	upkey              string
+	upinsecure         bool
+	upservername       string
+	chuser             string
+	chpassword         string
+	vaultaddr          string
+	vaultpath          string
+	vaulttokenfile     string
+	vaultca            string
+	vaultrenew         int
+	upidle             int
+	upkeepalive        int
+	maxbatchbytes      int
+	maxbatchrows       int
+	maxbatchage        int
+	chunkbytes         int
+	bytebuckets        string
+	rowbuckets         string
+	latencybuckets     string
+	maxbodybytes       int
+	maxrespbytes       int
+	maxinflightbytes   int
+	maxflushpercycle   int
+	injecttimestamp    string
+	tableheader        string
+	tablefooter        string
+	readyafterrecovery bool
+	statusformat       string
+	handoff            string
+	dumpdir            string
+	skipvalidation     bool
+	admintoken         string
+	apikeys            string
+	htpasswd           string
+	jwtkey             string
+	jwtissuer          string
+	ipaccess           string
+	proxyprotocol      bool
+}
+
+// defineFlags defines the flags on fs, with their values in c
+func defineFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.configfile, "config", "", "YAML (name: value) or TOML (name = value) file of flag values, the command line overrides it")
+	fs.IntVar(&c.port, "p", 8124, "TCP port number to listen on (default: 8124)")
+	fs.StringVar(&c.tlscert, "tlscert", "", "PEM certificate file, with -tlskey the ports serve https")
+	fs.StringVar(&c.tlskey, "tlskey", "", "PEM private key file of -tlscert")
+	fs.StringVar(&c.tlsclientca, "tlsclientca", "", "PEM CA bundle, the ingest port requires client certificates signed by it")
+	fs.IntVar(&c.adminport, "adminport", 0, "serve /status, /statistic, /metrics, /debug/vars and the admin endpoints on this port only, 0 - on the main port")
+	fs.BoolVar(&c.pprof, "pprof", false, "serve /debug/pprof/ profiles with the admin endpoints")
+	fs.IntVar(&c.keepalive, "keepalive", 10, "keepalive connection, in seconds")
+	fs.IntVar(&c.shutdowntimeout, "shutdowntimeout", 10, "on SIGTERM or SIGQUIT time to finish requests in progress and flush the buffer, in seconds")
+	fs.IntVar(&c.sigintimeout, "sigintimeout", 2, "on SIGINT drop requests in progress and flush the buffer within this time, in seconds, 0 - as on SIGTERM")
+	fs.IntVar(&c.readtimeout, "readtimeout", 5, "request header read timeout, in seconds")
+	fs.StringVar(&c.fwd, "fwd", "http://localhost:8123", "forward to this server (clickhouse), comma separated for round-robin with optional *weight, unix:///path for unix socket, srv+http://name for SRV records, consul+http://service for Consul")
+	fs.StringVar(&c.failover, "failover", "", "comma separated secondary clickhouse hosts a failed flush is tried on before the errors dir")
+	fs.StringVar(&c.shardby, "shardby", "", "send each table (table) or query param value to one -fwd host by consistent hashing, empty - round-robin")
+	fs.IntVar(&c.dnsrefresh, "dnsrefresh", 0, "seconds between resolves of the -fwd hosts and srv+http records, 0 - at start only")
+	fs.StringVar(&c.consuladdr, "consuladdr", "http://127.0.0.1:8500", "Consul agent of a consul+http://service -fwd")
+	fs.StringVar(&c.consultag, "consultag", "", "only the instances of the consul+http -fwd service with this tag")
+	fs.StringVar(&c.repl, "repl", "", "the start of forwarded keys replaced by the -fwd host, empty - the host is put in front")
+	fs.StringVar(&c.replmode, "replmode", "first", "repl rewrite: first or all occurrences")
+	fs.StringVar(&c.delim, "delim", ",", "body delimiter")
+	fs.StringVar(&c.logformat, "logformat", "text", "stdout log lines: text or json with time, level, msg, component, table, key and error fields")
+	fs.IntVar(&c.syncsec, "syncsec", 2, "sync interval, in seconds")
+	fs.StringVar(&c.tablesyncsec, "tablesyncsec", "", "per table sync intervals instead of syncsec: events:1;logs:30, in seconds")
+	fs.StringVar(&c.graphitehost, "graphitehost", "", "graphite host")
+	fs.IntVar(&c.graphiteport, "graphiteport", 2023, "graphite port")
+	fs.StringVar(&c.graphiteprefix, "graphiteprefix", "relap.count.proxyhouse", "graphite prefix")
+	fs.StringVar(&c.graphiteproto, "graphiteproto", "udp", "graphite transport: udp or tcp")
+	fs.IntVar(&c.graphiteagg, "graphiteagg", 0, "aggregate the metrics in process and send them every N seconds, counters summed, 0 - send as they come")
+	fs.StringVar(&c.statsdhost, "statsdhost", "", "send the metrics to statsd host:port over udp instead of graphite")
+	fs.StringVar(&c.statsdprefix, "statsdprefix", "proxyhouse", "statsd metric prefix")
+	fs.StringVar(&c.statsdtags, "statsdtags", "datadog", "statsd host and table tags: datadog (|#table:t), influx (,table=t) or none (table in the name)")
+	fs.StringVar(&c.grayloghost, "grayloghost", "", "graylog host")
+	fs.IntVar(&c.graylogport, "graylogport", 12201, "graylog port")
+	fs.IntVar(&c.graylogretries, "graylogretries", 5, "attempts to connect to graylog at start, then logs go to stdout; over udp only an unresolved host fails")
+	fs.StringVar(&c.graylogproto, "graylogproto", "udp", "graylog GELF transport: udp, tcp or tls")
+	fs.StringVar(&c.graylogca, "graylogca", "", "PEM file of the CA for graylog tls, the system roots if empty")
+	fs.StringVar(&c.syslog, "syslog", "", "log to syslog instead of graylog, RFC5424: local, udp://host:514 or tcp://host:514")
+	fs.StringVar(&c.webhook, "webhook", "", "url posted a JSON event when batches start going to the errors dir and when it is drained")
+	fs.IntVar(&c.memstats, "memstats", 0, "runtime memory stats sample interval for /statistic and graphite, in seconds, 0 - off")
+	fs.IntVar(&c.metricsqueue, "metricsqueue", 10000, "graphite and graylog or syslog queue size, over it messages are dropped")
+	fs.BoolVar(&c.isdebug, "isdebug", false, "debug requests, same as -loglevel=debug")
+	fs.StringVar(&c.loglevel, "loglevel", "info", "log messages of this level and above: debug, info, warn or error")
+	bytesVar(fs, &c.logbodybytes, "logbodybytes", 0, "log up to this many bytes of every sent batch at debug level, 0 - none")
+	fs.StringVar(&c.logfile, "logfile", "", "log to this file or stderr instead of stdout, without graylog")
+	fs.IntVar(&c.resendint, "resendint", 60, "resend error interval, in seconds")
+	fs.IntVar(&c.errbackoffmax, "errbackoffmax", 3600, "max backoff before resending an error file, in seconds")
+	fs.IntVar(&c.retries, "retries", 0, "inline send retries before saving to errors")
+	fs.IntVar(&c.backoffbase, "backoffbase", 100, "inline send retry backoff base, in ms")
+	fs.IntVar(&c.backoffmax, "backoffmax", 5000, "inline send retry backoff max, in ms")
+	fs.IntVar(&c.flushretries, "flushretries", 0, "tries more of a failed flushed batch within the sync cycle before saving to errors")
+	fs.IntVar(&c.flushretrydelay, "flushretrydelay", 500, "delay between flush retries, in ms")
+	fs.BoolVar(&c.tracing, "tracing", false, "pass the W3C traceparent of client requests on to clickhouse, no spans are exported")
+	fs.IntVar(&c.ejectafter, "ejectafter", 0, "consecutive connection errors or 5xx before an upstream is out of the rotation until its /ping answers, 0 - never")
+	fs.IntVar(&c.probeint, "probeint", 5, "ejected upstream /ping probe interval, in seconds")
+	fs.BoolVar(&c.healthcheck, "healthcheck", false, "probe /ping of every upstream each -probeint, -ejectafter failed pings eject it")
+	fs.BoolVar(&c.flushretrystatus, "flushretrystatus", false, "flush retries on error status codes too, not only on connection errors")
+	fs.IntVar(&c.warnlevel, "w", 400, "error counts for warning level")
+	fs.IntVar(&c.critlevel, "c", 500, "error counts for error level")
+	fs.StringVar(&c.multipartfield, "multipartfield", "data", "multipart/form-data field read as the insert body, the query may be in the query field, empty - bodies are buffered as sent")
+	fs.BoolVar(&c.allowemptybody, "allowemptybody", false, "answer 200 on empty POST instead of 400")
+	fs.StringVar(&c.okstatus, "okstatus", "", "comma separated upstream status codes treated as success, empty - any 2xx")
+	fs.StringVar(&c.synctables, "synctables", "", "comma separated tables forwarded synchronously, without buffering")
+	fs.StringVar(&c.querynormalize, "querynormalize", "", "regexp removed from the query for the buffer key, table and format detection, the query is forwarded as sent")
+	fs.StringVar(&c.keyparams, "keyparams", "", "comma separated query params the buffer key is built from, empty - whole query string")
+	fs.IntVar(&c.maxkeys, "maxkeys", 0, "max distinct buffer keys, 0 - unlimited")
+	fs.StringVar(&c.keyoverflow, "keyoverflow", "reject", "on maxkeys overflow: reject (503) or flush (send the largest key)")
+	fs.BoolVar(&c.pausespill, "pausespill", false, "while paused, inserts over maxstorebytes or maxkeys or in another format than their key go to the errors dir instead of 503, resent after resume")
+	bytesVar(fs, &c.maxstorebytes, "maxstorebytes", 0, "max buffered bytes, 0 - unlimited")
+	fs.StringVar(&c.storeoverflow, "storeoverflow", "reject", "on maxstorebytes overflow: reject (503), flush (send the largest key) or table (send all keys of the largest table)")
+	fs.StringVar(&c.httpproxy, "httpproxy", "", "http proxy url for upstream requests, overrides HTTP_PROXY env, empty - proxy from env")
+	fs.StringVar(&c.noproxy, "noproxy", "", "comma separated hosts, domains and CIDRs sent to directly with -httpproxy, like NO_PROXY")
+	fs.StringVar(&c.upca, "upca", "", "PEM CA bundle to verify https -fwd, empty - system roots")
+	fs.StringVar(&c.upcert, "upcert", "", "PEM client certificate for https -fwd")
+	fs.StringVar(&c.upkey, "upkey", "", "PEM private key of -upcert")
+	fs.BoolVar(&c.upinsecure, "upinsecure", false, "don't verify the certificate of https -fwd, testing only")
+	fs.StringVar(&c.upservername, "upservername", "", "TLS server name (SNI) of a single https -fwd host, empty - the -fwd host")
+	fs.StringVar(&c.chuser, "chuser", "", "clickhouse user of upstream requests, the user and password of clients are dropped, empty - clients' own")
+	fs.StringVar(&c.chpassword, "chpassword", "", "clickhouse password of -chuser, better set by PROXYHOUSE_CHPASSWORD")
+	fs.StringVar(&c.vaultaddr, "vaultaddr", "", "Vault url, https://vault:8200")
+	fs.StringVar(&c.vaultpath, "vaultpath", "", "Vault secret of the clickhouse password (and username), kv or database/creds/<role>")
+	fs.StringVar(&c.vaulttokenfile, "vaulttokenfile", "", "file of the Vault token, read on every refresh, empty - VAULT_TOKEN env")
+	fs.StringVar(&c.vaultca, "vaultca", "", "PEM CA bundle to verify the Vault https, empty - system roots")
+	fs.IntVar(&c.vaultrenew, "vaultrenew", 300, "seconds between reads of a kv secret, a leased one is read at half the lease")
+	fs.IntVar(&c.upidle, "upidle", 5, "idle upstream connection timeout, in seconds, keep it below clickhouse keep_alive_timeout")
+	fs.IntVar(&c.upkeepalive, "upkeepalive", 30, "upstream TCP keep-alive probe interval, in seconds")
+	bytesVar(fs, &c.maxbatchbytes, "maxbatchbytes", 0, "send a key before the sync interval when it reaches this size, 0 - unlimited")
+	fs.IntVar(&c.maxbatchrows, "maxbatchrows", 0, "send a key before the sync interval when it reaches this many rows, 0 - unlimited")
+	fs.IntVar(&c.maxbatchage, "maxbatchage", 0, "send a key buffered longer than this, in seconds, without waiting for the sync interval, 0 - off")
+	bytesVar(fs, &c.chunkbytes, "chunkbytes", 0, "send flushed batches over this size as several inserts of at most this size, cut at row ends, 0 - off")
+	fs.StringVar(&c.bytebuckets, "bytebuckets", "1024,16384,131072,1048576,8388608", "comma separated batch size buckets, in bytes, for the batch_bytes histogram")
+	fs.StringVar(&c.rowbuckets, "rowbuckets", "10,100,1000,10000,100000", "comma separated batch size buckets, in rows, for the batch_rows histogram")
+	fs.StringVar(&c.latencybuckets, "latencybuckets", "1,5,10,25,50,100,250,500,1000,2500,5000,10000", "comma separated latency buckets, in ms, for the ingest and forward histograms")
+	bytesVar(fs, &c.maxbodybytes, "maxbodybytes", 0, "reject request bodies over this size with 413, 0 - unlimited")
+	fs.IntVar(&c.maxrespbytes, "maxrespbytes", 65536, "max bytes read from a clickhouse error response, the rest is not read, 0 - unlimited")
+	bytesVar(fs, &c.maxinflightbytes, "maxinflightbytes", 0, "max bytes concurrently sent upstream, 0 - unlimited")
+	fs.IntVar(&c.maxflushpercycle, "maxflushpercycle", 0, "max keys flushed per sync interval, oldest first, 0 - unlimited")
+	fs.StringVar(&c.injecttimestamp, "injecttimestamp", "", "prepend receive time as first column to rows of this format: TSV or CSV, empty - off")
+	fs.StringVar(&c.tableheader, "tableheader", "", "semicolon separated table:line sent once before each flushed batch of the table, \\t and \\n are unescaped")
+	fs.StringVar(&c.tablefooter, "tablefooter", "", "semicolon separated table:line sent once after each flushed batch of the table, \\t and \\n are unescaped")
+	fs.BoolVar(&c.readyafterrecovery, "readyafterrecovery", false, "/ready answers 503 until the first error recovery pass is done")
+	fs.StringVar(&c.statusformat, "statusformat", "plain", "status response format: plain or json")
+	fs.StringVar(&c.handoff, "handoff", "", "proxyhouse instance buffered keys are posted to on shutdown instead of clickhouse, empty - off")
+	fs.StringVar(&c.dumpdir, "dumpdir", "dumps", "directory for POST /dump snapshots of the buffer")
+	fs.BoolVar(&c.skipvalidation, "skipvalidation", false, "start even if params are inconsistent, like -c below -w or a bad -fwd url")
+	fs.StringVar(&c.admintoken, "admintoken", "", "token for admin endpoints (X-Admin-Token header), empty - no check")
+	fs.StringVar(&c.apikeys, "apikeys", "", "file of api keys for inserts (X-Proxyhouse-Key header), one per line")
+	fs.StringVar(&c.htpasswd, "htpasswd", "", "htpasswd file for inserts (basic auth), {SHA} (htpasswd -s) or plain passwords")
+	fs.StringVar(&c.jwtkey, "jwtkey", "", "PEM public key (RS256, ES256) or HMAC secret file (HS256) of JWTs for inserts")
+	fs.StringVar(&c.jwtissuer, "jwtissuer", "", "required iss claim of JWTs, empty - any")
+	fs.StringVar(&c.ipaccess, "ipaccess", "", "file of allow CIDR and deny CIDR lines for clients of -p, first match wins")
+	fs.BoolVar(&c.proxyprotocol, "proxyprotocol", false, "connections to -p start with the PROXY protocol v1 or v2 header of the load balancer")
+}
+
+// running holds the *Config in use, the command line flags at start
+var running = commandLine()
+
+// commandLine defines the command line flags and returns them as the running config
+func commandLine() *atomic.Value {
+	c := new(Config)
+	defineFlags(flag.CommandLine, c)
+	v := new(atomic.Value)
+	v.Store(c)
+	return v
+}
+
+// cfg returns the running config, a reload replaces it but never changes it
+func cfg() *Config {
+	return running.Load().(*Config)
+}
+
 const (
 	ERROR_DIR = "errors"
 )
@@ -60,36 +300,49 @@ type conn struct {
 	addr string
 }
 
-type Buffer struct {
-	rowcount int
-	buffer   []byte
-}
-
-type Store struct {
-	sync.RWMutex
-	Req          map[string]*Buffer
-	cancelSyncer context.CancelFunc
-}
-
-var store = &Store{Req: make(map[string]*Buffer, 0)}
 var totalConnections uint32 // Total number of connections opened since the server started running
 var currConnections int32   // Number of open connections
 var idleConnections int32   // Number of idle connections
 var in uint32               //in requests
 var out uint32              //out requests
 var errorsCheck uint32      // Number of errors Check
-var gr *graphite.Graphite
+var replWarned uint32       // Set after the first key without repl is logged
+var recovered int32         // Set after the first error recovery pass
+var lastFlush int64         // Unix nano time of the last successful send
+var status = struct {
+	sync.Mutex
+	s string
+}{s: "OK\r\n"} // Result of the last send, sends run concurrently
+var connStates = struct {
+	sync.Mutex
+	m map[net.Conn]http.ConnState
+}{m: make(map[net.Conn]http.ConnState)} // Last known state of open connections
 var buffersize = 1024 * 8
 var hostname string
+var logout io.Writer = os.Stdout // grlog output without graylog
 
 func main() {
 	flag.Parse()
-	//fix http client
-	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1000
-
-	store.backgroundSender(*syncsec)
-	store.backgroundRecovery(*resendint)
-
+	// flags override env, env overrides the config file
+	cmdline := setFlags()
+	if err := loadEnv(flag.CommandLine, cmdline); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad env:", err)
+		os.Exit(2)
+	}
+	if cfg().configfile != "" {
+		if err := loadConfig(flag.CommandLine, cfg().configfile, cmdline); err != nil {
+			fmt.Fprintln(os.Stderr, "Bad config:", err)
+			os.Exit(2)
+		}
+	}
+	if problems := validateFlags(cfg()); len(problems) > 0 && !cfg().skipvalidation {
+		fmt.Fprintln(os.Stderr, "Bad params, use -skipvalidation to start anyway:")
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "  "+problem)
+		}
+		os.Exit(2)
+	}
+	// metrics, logs and histograms first, the background loops below use them
 	atomic.StoreUint32(&totalConnections, 0)
 	atomic.StoreInt32(&currConnections, 0)
 	atomic.StoreInt32(&idleConnections, 0)
@@ -97,62 +350,281 @@ func main() {
 	atomic.StoreUint32(&out, 0)
 	atomic.StoreUint32(&errorsCheck, 0)
 
-	if *graphitehost != "" {
-		g, err := graphite.NewGraphiteUDP(*graphitehost, *graphiteport)
-		if err != nil {
-			panic(err)
-		}
-		gr = g
-	} else {
-		gr = graphite.NewGraphiteNop(*graphitehost, *graphiteport)
-	}
 	host, err := os.Hostname()
 	if err != nil {
 		host = "unknown"
 	}
 	hostname = strings.ReplaceAll(host, ".", "_")
+	sender, err := graphiteSender()
+	if err != nil {
+		grlog(LEVEL_ERR, "Graphite error: ", err, Fields{"component": "metrics"})
+	}
+	if sender == nil {
+		sender = graphite.NewGraphiteNop(cfg().graphitehost, cfg().graphiteport)
+	}
+	gr = NewMetricsEvery(sender, cfg().metricsqueue, time.Duration(cfg().graphiteagg)*time.Second)
+
+	if logout, err = openLog(cfg().logfile); err != nil {
+		fmt.Fprintln(os.Stderr, "Log file:", err)
+		os.Exit(2)
+	}
+	if cfg().grayloghost != "" {
+		// grlog filters by -loglevel, graylog sends what it gets
+		graylog = NewGraylog(Graylog{Host: cfg().grayloghost, Port: cfg().graylogport, Transport: cfg().graylogproto, LogLevel: LEVEL_DBG})
+		if graylog.TLSConfig, err = tlsConfig(cfg().graylogca); err != nil {
+			fmt.Fprintln(os.Stderr, "Graylog CA:", err)
+			os.Exit(2)
+		}
+		logQueue = NewLogQueue(graylog, cfg().metricsqueue, cfg().graylogretries, Backoff{Base: 500 * time.Millisecond, Max: 5 * time.Second})
+		grlog(LEVEL_INFO, "Start proxyhouse")
+	} else if cfg().syslog != "" {
+		sl, err := NewSyslog(cfg().syslog)
+		if err != nil {
+			log.Fatal("Syslog: ", err)
+		}
+		logQueue = NewLogQueue(sl, cfg().metricsqueue, cfg().graylogretries, Backoff{Base: 500 * time.Millisecond, Max: 5 * time.Second})
+		grlog(LEVEL_INFO, "Start proxyhouse")
+	}
 
-	if *grayloghost != "" {
-		graylog = NewGraylog(Graylog{Host: *grayloghost, Port: *graylogport})
-		graylog.Info("Start proxyhouse")
+	// -skipvalidation starts with bad params, but not with ones that can't work
+	if cfg().querynormalize != "" {
+		if normalizer, err = regexp.Compile(cfg().querynormalize); err != nil {
+			log.Fatal("-querynormalize: ", err)
+		}
+	}
+	if batchBytes, err = newHistogram(cfg().bytebuckets); err != nil {
+		log.Fatal("-bytebuckets: ", err)
 	}
+	if batchRows, err = newHistogram(cfg().rowbuckets); err != nil {
+		log.Fatal("-rowbuckets: ", err)
+	}
+	if _, err = newHistogram(cfg().latencybuckets); err != nil {
+		log.Fatal("-latencybuckets: ", err)
+	}
+	ingestLatency, forwardLatency = newTableHistograms(cfg().latencybuckets), newTableHistograms(cfg().latencybuckets)
+
+	//fix http client
+	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 1000
+	if client, err = newClient(); err != nil {
+		log.Fatal("Upstream client: ", err)
+	}
+	if isConsul(cfg().fwd) {
+		consul, err := NewConsul(cfg().consuladdr, cfg().fwd, cfg().consultag)
+		if err != nil {
+			log.Fatal("Consul: ", err)
+		}
+		if err := consul.refresh(context.Background(), 0); err != nil {
+			log.Fatal("Consul: ", err)
+		}
+		consul.background()
+	}
+	if cfg().dnsrefresh > 0 || isSRV(cfg().fwd) {
+		watch := newDNSWatch()
+		if err := watch.refresh(context.Background()); err != nil {
+			if isSRV(cfg().fwd) && fwdList() == cfg().fwd {
+				log.Fatal("DNS: ", err)
+			}
+			grlog(LEVEL_ERR, "DNS refresh error: ", err, Fields{"component": "dns"})
+		}
+		if cfg().dnsrefresh > 0 {
+			watch.background(time.Duration(cfg().dnsrefresh) * time.Second)
+		}
+	}
+	if cfg().vaultpath != "" {
+		vault, err := NewVault(cfg().vaultaddr, cfg().vaultpath, cfg().vaulttokenfile, cfg().vaultca)
+		if err != nil {
+			log.Fatal("Vault: ", err)
+		}
+		interval := time.Duration(cfg().vaultrenew) * time.Second
+		next, err := vault.refresh(context.Background(), interval)
+		if err != nil {
+			log.Fatal("Vault: ", err)
+		}
+		vault.background(next, interval)
+	}
+
+	setTableIntervals()
+	store.backgroundSender(cfg().syncsec)
+	store.backgroundAger(cfg().maxbatchage)
+	store.backgroundTableSync()
+	backgroundCoalescing()
+	backgroundLatency(coalesceWindow)
+	store.backgroundRecovery(cfg().resendint)
+	if cfg().memstats > 0 {
+		backgroundMemStats(time.Duration(cfg().memstats) * time.Second)
+	}
+	if cfg().ejectafter > 0 {
+		upstreamHealth.backgroundProbe(time.Duration(cfg().probeint) * time.Second)
+	}
+
+	grlog(LEVEL_INFO, "Keep-alive: client idle ", cfg().keepalive, "s, upstream idle ", cfg().upidle, "s, upstream probes ", cfg().upkeepalive, "s")
+	grlog(LEVEL_INFO, "Forward sample: ", hidePassword(previewURI(cfg().repl+"?query=INSERT%20INTO%20t%20VALUES")))
 
 	_, err = os.Stat(ERROR_DIR)
 	if err != nil {
 		panic(err)
 	}
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// setup signal catching
-	quit := make(chan os.Signal, 1)
-	fallback := func() error {
-		fmt.Println("Some signal - ignored")
-		grlog(LEVEL_INFO, "Some signal - ignored")
-		return nil
-	}
-	graceful.Unignore(quit, fallback, graceful.Terminate...)
-
 	server := &http.Server{
-		Addr:              ":" + fmt.Sprint(*port),
-		ReadHeaderTimeout: time.Duration(*readtimeout) * time.Second,
-		IdleTimeout:       time.Duration(*keepalive) * time.Second,
+		Addr:              ":" + fmt.Sprint(cfg().port),
+		ReadHeaderTimeout: time.Duration(cfg().readtimeout) * time.Second,
+		IdleTimeout:       time.Duration(cfg().keepalive) * time.Second,
 		ConnState:         statelistener,
 	}
-	http.HandleFunc("/", dorequest)
-	http.HandleFunc("/status", showstatus)
-	http.HandleFunc("/statistic", showstatistic)
-	err = server.ListenAndServe()
+
+	// Wait for terminate signals to shutdown the server, each signal with its
+	// own shutdown, the first one received wins
+	var once sync.Once
+	var admin *http.Server
+	stopped := make(chan struct{})
+	for _, sig := range graceful.Terminate {
+		shutdown := shutdownFor(server, sig)
+		graceful.Unignore(make(chan os.Signal, 1), func() error {
+			once.Do(func() {
+				shutdown()
+				if admin != nil {
+					admin.Close()
+				}
+				close(stopped)
+			})
+			return nil
+		}, sig)
+	}
+
+	if cfg().configfile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reloadConfig(cfg().configfile, cmdline); err != nil {
+					grlog(LEVEL_ERR, "Config reload error, nothing changed: ", err, Fields{"component": "config"})
+				}
+			}
+		}()
+	}
+
+	if err := setCredentials(); err != nil {
+		log.Fatal("Credentials: ", err)
+	}
+	if err := setIPRules(); err != nil {
+		log.Fatal("IP access: ", err)
+	}
+
+	if cfg().tlsclientca != "" {
+		if server.TLSConfig, err = clientAuth(cfg().tlsclientca); err != nil {
+			log.Fatal("Client CA: ", err)
+		}
+	}
+
+	// explicit muxes, net/http/pprof registers itself on the default one
+	ingest := http.NewServeMux()
+	server.Handler = ipfilter(ingest)
+	if cfg().adminport > 0 {
+		adminMux := http.NewServeMux()
+		routes(ingest, adminMux)
+		admin = &http.Server{
+			Addr:              ":" + fmt.Sprint(cfg().adminport),
+			Handler:           adminMux,
+			ReadHeaderTimeout: time.Duration(cfg().readtimeout) * time.Second,
+			IdleTimeout:       time.Duration(cfg().keepalive) * time.Second,
+		}
+		go func() {
+			if err := listenAndServe(admin, false); err != nil && err != http.ErrServerClosed {
+				log.Fatal("Admin ListenAndServe: ", err)
+			}
+		}()
+	} else {
+		routes(ingest, ingest)
+	}
+	err = listenAndServe(server, cfg().proxyprotocol)
+	if err == http.ErrServerClosed {
+		<-stopped
+		return
+	}
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 		os.Exit(1)
 	}
 }
 
+// routes registers the handlers, inserts on ingest and everything else on
+// admin. With -adminport they are two muxes, the ingest port has nothing to
+// control the proxy, /ready is on both for load balancer checks
+func routes(ingest, admin *http.ServeMux) {
+	ingest.HandleFunc("/", authonly(dorequest))
+	ingest.HandleFunc("/ingest", authonly(doingest))
+	ingest.HandleFunc("/ready", showready)
+	if admin != ingest {
+		admin.HandleFunc("/ready", showready)
+	}
+	admin.HandleFunc("/status", showstatus)
+	admin.HandleFunc("/statistic", showstatistic)
+	admin.HandleFunc("/metrics", showmetrics)
+	admin.HandleFunc("/healthz", adminonly(showhealthz))
+	admin.HandleFunc("/validate", adminonly(dovalidate))
+	admin.HandleFunc("/config", adminonly(doconfig))
+	admin.HandleFunc("/errors/recent", adminonly(showrecenterrors))
+	admin.HandleFunc("/dump", adminonly(dodump))
+	admin.HandleFunc("/buffers", adminonly(showbuffers))
+	admin.HandleFunc("/pause", adminonly(dopause))
+	admin.HandleFunc("/resume", adminonly(doresume))
+	admin.HandleFunc("/flush", adminonly(doflush))
+	admin.HandleFunc("/dashboard", adminonly(showdashboard))
+	admin.Handle("/debug/vars", expvar.Handler())
+	if cfg().pprof {
+		admin.HandleFunc("/debug/pprof/", adminonly(pprof.Index))
+		admin.HandleFunc("/debug/pprof/cmdline", adminonly(pprof.Cmdline))
+		admin.HandleFunc("/debug/pprof/profile", adminonly(pprof.Profile))
+		admin.HandleFunc("/debug/pprof/symbol", adminonly(pprof.Symbol))
+		admin.HandleFunc("/debug/pprof/trace", adminonly(pprof.Trace))
+	}
+}
+
+// gracefulShutdown stops accepting connections, waits for the requests in
+// progress to be buffered and flushes the buffer, all within the timeout.
+// Batches not sent in time are saved to the errors dir
+func gracefulShutdown(server *http.Server, timeout time.Duration) {
+	grlog(LEVEL_INFO, "Shutdown, timeout ", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		grlog(LEVEL_ERR, "Shutdown error: ", err)
+	}
+	deadline, _ := ctx.Deadline()
+	store.shutdown(time.Until(deadline))
+	gr.Flush(time.Second)
+	grlog(LEVEL_INFO, "Shutdown done")
+}
+
+// shutdownFor returns the shutdown for the signal: SIGINT (Ctrl-C) is fast
+// with -sigintimeout set, SIGTERM and SIGQUIT are graceful
+func shutdownFor(server *http.Server, sig os.Signal) func() {
+	if sig == os.Interrupt && cfg().sigintimeout > 0 {
+		return func() { fastShutdown(server, time.Duration(cfg().sigintimeout)*time.Second) }
+	}
+	return func() { gracefulShutdown(server, time.Duration(cfg().shutdowntimeout)*time.Second) }
+}
+
+// fastShutdown closes the connections, dropping the requests in progress, and
+// flushes the buffer best effort within the timeout
+func fastShutdown(server *http.Server, timeout time.Duration) {
+	grlog(LEVEL_INFO, "Fast shutdown, timeout ", timeout)
+	if err := server.Close(); err != nil {
+		grlog(LEVEL_ERR, "Shutdown error: ", err)
+	}
+	store.shutdown(timeout)
+	gr.Flush(time.Second)
+	grlog(LEVEL_INFO, "Shutdown done")
+}
+
 func grlog(level uint8, data ...interface{}) {
-	if graylog != nil {
-		graylog.Log(level, data...)
+	if level > logLevel() {
+		return
+	}
+	if logQueue != nil {
+		logQueue.Log(level, data...)
 	} else {
-		fmt.Println(data...)
+		writeLog(logout, level, data...)
 	}
 }
 
@@ -168,51 +640,85 @@ func dorequest(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Date", date)
 		w.Header().Set("Server", "proxyhouse "+version)
 		w.Header().Set("Connection", "Closed")
+		if cfg().statusformat == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			writeJSONStatus(w, "OK")
+			return
+		}
 		fmt.Fprint(w, "status = \"OK\"\r\n")
 		return
 
 	case "POST":
-		body, err := ioutil.ReadAll(r.Body)
+		start := time.Now()
+		if err := headerQuery(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stripCredentials(r.URL)
+		// reject by Content-Length before reading, chunked bodies are read up to the limit
+		var reader io.Reader = r.Body
+		if cfg().maxbodybytes > 0 {
+			if r.ContentLength > int64(cfg().maxbodybytes) {
+				gr.SimpleSend(fmt.Sprintf("%s.body_too_large", cfg().graphiteprefix), "1")
+				http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+				return
+			}
+			reader = io.LimitReader(r.Body, int64(cfg().maxbodybytes)+1)
+		}
+		body, err := ioutil.ReadAll(reader)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer r.Body.Close()
-		uri := r.URL.RawPath + "?" + r.URL.RawQuery
+		if cfg().multipartfield != "" && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			if body, err = multipartBody(r, body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if cfg().maxbodybytes > 0 && len(body) > cfg().maxbodybytes {
+			gr.SimpleSend(fmt.Sprintf("%s.body_too_large", cfg().graphiteprefix), "1")
+			http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		ins := parseInsert(r)
+		body, rows := ins.rows(body, time.Now())
 		if len(body) > 0 {
-			delimiter := []byte(*delim)
-			separator := []byte("),")
-			addrows := 1
-			q := r.URL.Query().Get("query")
-			if strings.HasSuffix(q, "FORMAT TSV") || strings.HasSuffix(q, "FORMAT CSV") {
-				delimiter = []byte("")
-				separator = []byte("\n")
-				addrows = 0
+			uri, table := ins.uri, ins.table
+			// the forwarded query, not the normalized one, is what clickhouse runs
+			if !tableAllowed(r, insertTable(r.URL.Query())) {
+				denyTable(w, r, table)
+				return
 			}
-			store.Lock()
-			buf, ok := store.Req[uri]
-			if !ok {
-				buf = &Buffer{rowcount: 0, buffer: make([]byte, 0, buffersize)}
-			} else {
-				buf.buffer = append(buf.buffer, delimiter...)
+			if isSyncTable(table) {
+				atomic.AddUint32(&in, 1)
+				receivedMetrics(table, len(body))
+				forwardSync(w, r, uri, table, body, rows)
+				ingestLatency.Observe(table, time.Since(start))
+				return
+			}
+			if err = store.add(ins.key, uri, table, body, ins.delimiter, rows); err != nil && !store.spill(uri, table, body) {
+				code := http.StatusServiceUnavailable
+				if err == errBodyTooLarge {
+					code = http.StatusRequestEntityTooLarge
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			if tp := r.Header.Get("traceparent"); cfg().tracing && traceID(tp) != "" {
+				store.trace(ins.key, tp)
+				grlog(LEVEL_DBG, "Trace ", traceID(tp), " received ", len(body), " bytes in ", time.Since(start), ": ", hidePassword(uri))
 			}
-			buf.buffer = append(buf.buffer, body...)
-			buf.rowcount += addrows + bytes.Count(body, separator)
-			store.Req[uri] = buf
-
-			store.Unlock()
 			atomic.AddUint32(&in, 1)
-			gr.SimpleSend(fmt.Sprintf("%s.requests_received", *graphiteprefix), "1")
-			gr.SimpleSend(fmt.Sprintf("%s.byhost.%s.requests_received", *graphiteprefix, hostname), "1")
-			table := extractTable(uri)
-			gr.SimpleSend(fmt.Sprintf("%s.bytable.%s.requests_received", *graphiteprefix, table), "1")
-			gr.SimpleSend(fmt.Sprintf("%s.bytes_received", *graphiteprefix), fmt.Sprintf("%d", len(body)))
-			gr.SimpleSend(fmt.Sprintf("%s.byhost.%s.bytes_received", *graphiteprefix, hostname), fmt.Sprintf("%d", len(body)))
-			gr.SimpleSend(fmt.Sprintf("%s.bytable.%s.bytes_received", *graphiteprefix, table), fmt.Sprintf("%d", len(body)))
+			receivedMetrics(table, len(body))
+			ingestLatency.Observe(table, time.Since(start))
 			w.Header().Set("Server", "proxyhouse "+version)
 			w.Header().Set("Content-type", "text/tab-separated-values; charset=UTF-8")
+		} else if cfg().allowemptybody {
+			w.Header().Set("Server", "proxyhouse "+version)
 		} else {
-			http.Error(w, "No data given.", http.StatusMethodNotAllowed)
+			http.Error(w, "No data given.", http.StatusBadRequest)
 		}
 
 	default:
@@ -220,47 +726,466 @@ func dorequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func showstatus(w http.ResponseWriter, r *http.Request) {
-	errcount := 0
+// ingestFormats are the formats of newline delimited rows /ingest accepts
+var ingestFormats = map[string]string{"jsoneachrow": "JSONEachRow", "tsv": "TSV", "csv": "CSV"}
+
+// doingest takes newline delimited rows for ?table=t&format=JSONEachRow (TSV, CSV),
+// for clients that can't build an insert query, and buffers them as
+// INSERT INTO t FORMAT JSONEachRow
+func doingest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	table := values.Get("table")
+	if !tableName.MatchString(table) {
+		http.Error(w, "Bad table param.", http.StatusBadRequest)
+		return
+	}
+	if !tableAllowed(r, table) {
+		denyTable(w, r, table)
+		return
+	}
+	format, ok := ingestFormats[strings.ToLower(values.Get("format"))]
+	if values.Get("format") == "" {
+		format, ok = "JSONEachRow", true
+	}
+	if !ok {
+		http.Error(w, "Bad format param, want JSONEachRow, TSV or CSV.", http.StatusBadRequest)
+		return
+	}
+	values.Del("table")
+	values.Del("format")
+	if user, password := clickhouseCredentials(); user != "" || password != "" {
+		values.Del("user")
+		values.Del("password")
+	}
+	values.Set("query", "INSERT INTO "+table+" FORMAT "+format)
+	r.URL.Path, r.URL.RawPath, r.URL.RawQuery = "/", "", values.Encode()
+	r.Header.Del("X-Proxyhouse-Query")
+	r.Header.Del("X-Proxyhouse-Table")
+	dorequest(w, r)
+}
+
+// errorCount returns the number of error files waiting for resend
+func errorCount() int {
 	list, err := filePathWalkDir(ERROR_DIR)
-	if err == nil {
-		errcount = len(list)
+	if err != nil {
+		return 0
+	}
+	return len(list)
+}
+
+var normalizer *regexp.Regexp // compiled -querynormalize, nil when off
+
+// batch size histograms of sent batches, set up from -bytebuckets and -rowbuckets
+var batchBytes, batchRows = mustHistogram(cfg().bytebuckets), mustHistogram(cfg().rowbuckets)
+
+// ingestLatency is the client request handling time, forwardLatency the
+// clickhouse round trip with the inline retries, by table
+var ingestLatency, forwardLatency = newTableHistograms(cfg().latencybuckets), newTableHistograms(cfg().latencybuckets)
+
+var tableName = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)?$`)
+
+// headerQuery sets the query param from the X-Proxyhouse-Query header, or builds
+// INSERT INTO table VALUES from X-Proxyhouse-Table, for clients that can't set the url
+func headerQuery(r *http.Request) error {
+	q := r.Header.Get("X-Proxyhouse-Query")
+	if table := r.Header.Get("X-Proxyhouse-Table"); q == "" && table != "" {
+		if !tableName.MatchString(table) {
+			return errors.New("Bad X-Proxyhouse-Table header.")
+		}
+		q = "INSERT INTO " + table + " VALUES"
+	}
+	if q == "" {
+		return nil
+	}
+	if !setQuery(r, q) {
+		return errors.New("Bad X-Proxyhouse-Query header.")
+	}
+	return nil
+}
+
+// setQuery sets the query param to an insert query from a header or a form
+// field, false if it's not a single INSERT
+func setQuery(r *http.Request, q string) bool {
+	if !strings.HasPrefix(strings.ToUpper(q), "INSERT INTO ") || strings.ContainsAny(q, ";\r\n") {
+		return false
+	}
+	values := r.URL.Query()
+	values.Set("query", q)
+	r.URL.RawQuery = values.Encode()
+	return true
+}
+
+// multipartBody returns the -multipartfield file of a multipart/form-data body,
+// the query form field is used when the url has none
+func multipartBody(r *http.Request, body []byte) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	found := false
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch part.FormName() {
+		case cfg().multipartfield:
+			data, err = ioutil.ReadAll(part)
+			found = true
+		case "query":
+			var q []byte
+			q, err = ioutil.ReadAll(part)
+			if err == nil && r.URL.Query().Get("query") == "" && !setQuery(r, string(q)) {
+				err = errors.New("Bad query form field.")
+			}
+		}
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("No %s form field given.", cfg().multipartfield)
+	}
+	return data, nil
+}
+
+// normalizeQuery returns the url with -querynormalize matches removed from the
+// query param and spaces collapsed, so comments and request ids don't split batches
+func normalizeQuery(u *url.URL) *url.URL {
+	if normalizer == nil {
+		return u
+	}
+	values := u.Query()
+	q := values.Get("query")
+	if q == "" {
+		return u
+	}
+	values.Set("query", strings.Join(strings.Fields(normalizer.ReplaceAllString(q, " ")), " "))
+	normalized := *u
+	normalized.RawQuery = values.Encode()
+	return &normalized
+}
+
+// insertRequest is what an insert request comes to: the forwarded uri, the
+// buffer key, the table and the format of its rows
+type insertRequest struct {
+	uri, key, table, query string
+	delimiter, separator   []byte
+	addrows                int
+}
+
+// parseInsert finds the key, table and format of an insert whose query
+// headers and credentials are applied to r.URL already. dorequest and
+// /validate share it, so the dry run reports what the insert gets
+func parseInsert(r *http.Request) insertRequest {
+	keyURL := normalizeQuery(r.URL)
+	ins := insertRequest{
+		uri:   r.URL.RawPath + "?" + r.URL.RawQuery,
+		key:   bufferKey(keyURL),
+		table: extractTable(keyURL.RawPath + "?" + keyURL.RawQuery),
+		query: keyURL.Query().Get("query"),
+	}
+	ins.delimiter, ins.separator, ins.addrows = detectFormat(ins.query)
+	return ins
+}
+
+// rows normalizes the rows of the body, with -injecttimestamp adds the
+// receive time to them, and returns the body and its row count
+func (ins insertRequest) rows(body []byte, now time.Time) ([]byte, int) {
+	body = normalizeRows(body, ins.separator)
+	if len(body) == 0 {
+		return body, 0
+	}
+	if format := insertFormat(ins.uri); cfg().injecttimestamp != "" && format == strings.ToUpper(cfg().injecttimestamp) {
+		body = injectTimestamp(body, format, now)
+	}
+	return body, ins.addrows + bytes.Count(body, ins.separator)
+}
+
+// bufferKey returns the key requests are batched by, with -keyparams set only
+// the listed query params count, so params like query_id don't split batches.
+// The path is always escaped and never has a '?', so the first '?' of the key
+// splits it into the path and the query the same way for every request
+func bufferKey(u *url.URL) string {
+	if cfg().keyparams == "" {
+		return u.EscapedPath() + "?" + u.RawQuery
+	}
+	query := u.Query()
+	values := url.Values{}
+	for _, param := range strings.Split(cfg().keyparams, ",") {
+		param = strings.TrimSpace(param)
+		if v, ok := query[param]; ok {
+			values[param] = v
+		}
+	}
+	return u.EscapedPath() + "?" + values.Encode()
+}
+
+// newlineFormats are the insert formats with one row per line
+var newlineFormats = map[string]bool{"TSV": true, "TABSEPARATED": true, "CSV": true, "JSONEACHROW": true, "JSONLINES": true, "NDJSON": true,
+	"TSVWITHNAMES": true, "TABSEPARATEDWITHNAMES": true, "CSVWITHNAMES": true,
+	"TSVWITHNAMESANDTYPES": true, "TABSEPARATEDWITHNAMESANDTYPES": true, "CSVWITHNAMESANDTYPES": true,
+	"TSVRAW": true, "TABSEPARATEDRAW": true, "TSVRAWWITHNAMES": true, "TABSEPARATEDRAWWITHNAMES": true,
+	"TSVRAWWITHNAMESANDTYPES": true, "TABSEPARATEDRAWWITHNAMESANDTYPES": true,
+	"JSONSTRINGSEACHROW": true, "JSONCOMPACTEACHROW": true, "JSONCOMPACTSTRINGSEACHROW": true,
+	"JSONCOMPACTEACHROWWITHNAMES": true, "JSONCOMPACTEACHROWWITHNAMESANDTYPES": true,
+	"JSONCOMPACTSTRINGSEACHROWWITHNAMES": true, "JSONCOMPACTSTRINGSEACHROWWITHNAMESANDTYPES": true,
+	"LINEASSTRING": true}
+
+// headerRows returns the lines a body of the insert format starts with, the
+// column names of *WithNames and the names and types of *WithNamesAndTypes
+func headerRows(format string) int {
+	switch {
+	case strings.HasSuffix(format, "WITHNAMESANDTYPES"):
+		return 2
+	case strings.HasSuffix(format, "WITHNAMES"):
+		return 1
+	}
+	return 0
+}
+
+// dropRows returns the body without its first n lines
+func dropRows(body []byte, n int) []byte {
+	for ; n > 0 && len(body) > 0; n-- {
+		pos := bytes.IndexByte(body, '\n')
+		if pos < 0 {
+			return body[:0]
+		}
+		body = body[pos+1:]
+	}
+	return body
+}
+
+// detectFormat returns the delimiter between merged bodies, the row separator
+// and rows to add to the separator count for the insert query
+func detectFormat(q string) (delimiter, separator []byte, addrows int) {
+	fields := strings.Fields(strings.ToUpper(q))
+	if n := len(fields); n >= 2 && fields[n-2] == "FORMAT" && newlineFormats[fields[n-1]] {
+		return []byte(""), []byte("\n"), 0
+	}
+	return []byte(cfg().delim), []byte("),"), 1
+}
+
+// normalizeRows makes a body of a newline format end with exactly one newline
+// and drops blank lines around it, so merged bodies never make an empty row
+func normalizeRows(body, separator []byte) []byte {
+	if string(separator) != "\n" || len(body) == 0 {
+		return body
 	}
+	body = bytes.Trim(body, "\r\n")
+	if len(body) == 0 {
+		return body
+	}
+	return append(body, '\n')
+}
+
+// injectTimestamp prepends the receive time as a leading column to every row
+// of a TSV or CSV body, the target table must have a matching first column
+func injectTimestamp(body []byte, format string, now time.Time) []byte {
+	column := now.Format("2006-01-02 15:04:05")
+	if format == "CSV" {
+		column = "\"" + column + "\","
+	} else {
+		column += "\t"
+	}
+	rows := bytes.SplitAfter(body, []byte("\n"))
+	res := make([]byte, 0, len(body)+len(rows)*len(column))
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		res = append(res, column...)
+		res = append(res, row...)
+	}
+	return res
+}
+
+// setStatus records the result of a send for /status
+func setStatus(s string) {
+	status.Lock()
+	status.s = s
+	status.Unlock()
+}
+
+// lastStatus returns the result of the last send, "OK\r\n" or the error
+func lastStatus() string {
+	status.Lock()
+	defer status.Unlock()
+	return status.s
+}
+
+func showstatus(w http.ResponseWriter, r *http.Request) {
+	errcount := errorCount()
 
 	date := time.Now().UTC().Format(http.TimeFormat)
 	w.Header().Set("Date", date)
 	w.Header().Set("Server", "proxyhouse "+version)
 	w.Header().Set("Connection", "Closed")
-	if errcount >= *critlevel {
+	if cfg().statusformat == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if errcount >= cfg().critlevel {
 		w.WriteHeader(http.StatusInternalServerError)
-	} else if errcount >= *warnlevel {
+	} else if errcount >= cfg().warnlevel {
 		w.WriteHeader(http.StatusBadRequest)
 	}
-	fmt.Fprintf(w, "status:%s", status)
+	paused := store.isPaused()
+	var upstreams [][2]string
+	if cfg().ejectafter > 0 {
+		upstreams = upstreamHealth.States()
+	}
+	if cfg().statusformat == "json" {
+		states := make(map[string]string)
+		for _, u := range upstreams {
+			states[hidePassword(u[0])] = u[1]
+		}
+		json.NewEncoder(w).Encode(struct {
+			Status    string            `json:"status"`
+			Paused    bool              `json:"paused,omitempty"`
+			Upstreams map[string]string `json:"upstreams,omitempty"`
+		}{strings.TrimSuffix(lastStatus(), "\r\n"), paused, states})
+		return
+	}
+	fmt.Fprintf(w, "status:%s", lastStatus())
+	if paused {
+		fmt.Fprint(w, "paused:1\r\n")
+	}
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "upstream:%s %s\r\n", hidePassword(u[0]), u[1])
+	}
+}
+
+// writeJSONStatus writes {"status":"..."} for -statusformat=json
+func writeJSONStatus(w http.ResponseWriter, st string) {
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{st})
+}
+
+// showready answers 503 until the first error recovery pass is done with
+// -readyafterrecovery, so a load balancer waits while the backlog is replayed
+func showready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Connection", "Closed")
+	if cfg().readyafterrecovery && atomic.LoadInt32(&recovered) == 0 {
+		http.Error(w, "recovering", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "ready\r\n")
 }
 
 func showstatistic(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "proxyhouse "+version)
 	w.Header().Set("Connection", "Closed")
+	writeStatistic(w)
+}
+
+// writeStatistic writes the /statistic counters, one name:value per line
+func writeStatistic(w io.Writer) {
 	fmt.Fprintf(w, "total connections:%d\r\n", atomic.LoadUint32(&totalConnections))
 	fmt.Fprintf(w, "current connections:%d\r\n", atomic.LoadInt32(&currConnections))
 	fmt.Fprintf(w, "idle connections:%d\r\n", atomic.LoadInt32(&idleConnections))
 	fmt.Fprintf(w, "in requests:%d\r\n", atomic.LoadUint32(&in))
 	fmt.Fprintf(w, "out requests:%d\r\n", atomic.LoadUint32(&out))
+	ratio, outRate := coalescing.Get()
+	fmt.Fprintf(w, "coalescing ratio:%.2f\r\n", ratio)
+	fmt.Fprintf(w, "out rate:%.2f\r\n", outRate)
+	store.RLock()
+	fmt.Fprintf(w, "buffer keys:%d\r\n", len(store.Req))
+	store.RUnlock()
+	fmt.Fprintf(w, "flush in progress:%d\r\n", atomic.LoadInt32(&store.flushing))
+	fmt.Fprintf(w, "flush paused:%d\r\n", atomic.LoadInt32(&store.paused))
+	fmt.Fprintf(w, "inflight bytes:%d\r\n", inflight.Bytes())
+	fmt.Fprintf(w, "metrics dropped:%d\r\n", gr.Dropped())
+	if logQueue != nil {
+		fmt.Fprintf(w, "logs dropped:%d\r\n", logQueue.Dropped())
+	}
+	if heapAlloc, nextGC, numGC, bufferBytes, ok := memStats.Get(); ok {
+		fmt.Fprintf(w, "heap alloc:%d\r\n", heapAlloc)
+		fmt.Fprintf(w, "next gc:%d\r\n", nextGC)
+		fmt.Fprintf(w, "num gc:%d\r\n", numGC)
+		fmt.Fprintf(w, "buffered bytes:%d\r\n", bufferBytes)
+	}
+	for _, tc := range tableErrors.Top(5) {
+		fmt.Fprintf(w, "table errors:%s:%d\r\n", tc.Table, tc.Count)
+	}
+	writeTableStatistic(w)
 }
 
+// writeTableStatistic writes a line per table: requests in and out, rows,
+// bytes, errors, buffered bytes and the last send as unix time, 0 - never
+func writeTableStatistic(w io.Writer) {
+	counts := make(map[string]map[string]uint64)
+	for _, c := range promCounters {
+		counts[c[0]] = tableCounters.Get(c[0])
+	}
+	sent := tableCounters.LastSent()
+	store.RLock()
+	buffered := make(map[string]int, len(store.tables))
+	for table, size := range store.tables {
+		buffered[table] = size
+	}
+	store.RUnlock()
+	seen := make(map[string]bool)
+	for table := range counts["requests_received"] {
+		seen[table] = true
+	}
+	for table := range buffered {
+		seen[table] = true
+	}
+	tables := make([]string, 0, len(seen))
+	for table := range seen {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		var last int64
+		if at, ok := sent[table]; ok {
+			last = at.Unix()
+		}
+		fmt.Fprintf(w, "table:%s in=%d out=%d rows=%d bytes_in=%d bytes_out=%d errors=%d buffered=%d last_flush=%d\r\n",
+			table, counts["requests_received"][table], counts["requests_sent"][table], counts["rows_sent"][table],
+			counts["bytes_received"][table], counts["bytes_sent"][table], counts["ch_errors"][table], buffered[table], last)
+	}
+}
+
+// statelistener keeps the last state of every connection, so the gauges are
+// computed from real transitions and can't drift on repeated or missed states
 func statelistener(c net.Conn, cs http.ConnState) {
+	connStates.Lock()
+	prev, known := connStates.m[c]
 	switch cs {
-	case http.StateNew:
+	case http.StateClosed, http.StateHijacked:
+		delete(connStates.m, c)
+	default:
+		connStates.m[c] = cs
+	}
+	connStates.Unlock()
+
+	live := cs != http.StateClosed && cs != http.StateHijacked
+	if cs == http.StateNew && !known {
 		atomic.AddUint32(&totalConnections, 1)
+	}
+	if live && !known {
 		atomic.AddInt32(&currConnections, 1)
-		atomic.AddInt32(&idleConnections, 1)
-	case http.StateActive:
-		atomic.AddInt32(&idleConnections, -1)
-	case http.StateIdle:
-		atomic.AddInt32(&idleConnections, 1)
-	case http.StateClosed:
+	} else if !live && known {
 		atomic.AddInt32(&currConnections, -1)
+	}
+	wasIdle := known && (prev == http.StateNew || prev == http.StateIdle)
+	isIdle := cs == http.StateNew || cs == http.StateIdle
+	if isIdle && !wasIdle {
+		atomic.AddInt32(&idleConnections, 1)
+	} else if !isIdle && wasIdle {
 		atomic.AddInt32(&idleConnections, -1)
 	}
 }
@@ -270,26 +1195,123 @@ func statelistener(c net.Conn, cs http.ConnState) {
 func (store *Store) backgroundSender(interval int) {
 	ctx, cancel := context.WithCancel(context.Background())
 	store.cancelSyncer = cancel
+	store.setInterval(time.Duration(interval) * time.Second)
 	go func() {
+		// flush right away, then on a ticker so the flush time doesn't add to the interval
+		current := store.syncInterval()
+		ticker := time.NewTicker(current)
+		defer ticker.Stop()
 		for {
+			atomic.AddUint32(&errorsCheck, 1)
+			if store.isPaused() {
+				gr.SimpleSend(fmt.Sprintf("%s.paused_cycles", cfg().graphiteprefix), "1")
+			} else {
+				store.flushCycle()
+			}
+			if d := store.syncInterval(); d != current {
+				current = d
+				ticker.Reset(d)
+			}
 			select {
 			case <-ctx.Done():
-				fmt.Println("backgroundManager - canceled")
+				grlog(LEVEL_INFO, "backgroundManager - canceled", Fields{"component": "flush"})
 				return
-			default:
-				atomic.AddUint32(&errorsCheck, 1)
-				store.Lock()
-				requests := store.Req
-				store.Req = make(map[string]*Buffer)
-				store.Unlock()
-				//keys itterator
-				for key, val := range requests {
-					send(key, val.buffer, val.rowcount, 0)
-					atomic.AddUint32(&out, 1)
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// backgroundAger checks the keys age 4 times per maxbatchage, so no key waits
+// much longer than maxbatchage even with a longer sync interval
+func (store *Store) backgroundAger(maxage int) {
+	if maxage <= 0 {
+		return
+	}
+	age := time.Duration(maxage) * time.Second
+	go func() {
+		for range time.Tick(age / 4) {
+			if !store.isPaused() {
+				store.flushAged(age)
+			}
+		}
+	}()
+}
+
+// backgroundTableSync sends the keys of tables with their own -tablesyncsec
+// interval, checking 4 times per second so a 1s table is at most 250ms late
+func (store *Store) backgroundTableSync() {
+	ctx, cancel := context.WithCancel(context.Background())
+	store.cancelTables = cancel
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !store.isPaused() {
+				store.flushTables()
+			}
+		}
+	}()
+}
 
+// backgroundCoalescing samples the in/out requests ratio every coalesceWindow
+func backgroundCoalescing() {
+	coalescing.Sample(atomic.LoadUint32(&in), atomic.LoadUint32(&out), time.Now())
+	go func() {
+		for now := range time.Tick(coalesceWindow) {
+			coalescing.Sample(atomic.LoadUint32(&in), atomic.LoadUint32(&out), now)
+			ratio, outRate := coalescing.Get()
+			gr.SimpleSend(fmt.Sprintf("%s.coalescing_ratio", cfg().graphiteprefix), fmt.Sprintf("%.2f", ratio))
+			gr.SimpleSend(fmt.Sprintf("%s.out_rate", cfg().graphiteprefix), fmt.Sprintf("%.2f", outRate))
+		}
+	}()
+}
+
+// backgroundLatency sends the p50, p95 and p99 latencies of every table
+// with requests in the last interval
+func backgroundLatency(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			batch := NewMetricBatch()
+			for _, l := range []struct {
+				name       string
+				histograms *TableHistograms
+			}{{"ingest_ms", ingestLatency}, {"forward_ms", forwardLatency}} {
+				for table, h := range l.histograms.Get() {
+					last := h.Interval()
+					if _, counts, _ := last.Cumulative(); counts[len(counts)-1] == 0 {
+						continue
+					}
+					for _, q := range []float64{0.5, 0.95, 0.99} {
+						batch.Add(fmt.Sprintf("%s.bytable.%s.%s_p%d", cfg().graphiteprefix, table, l.name, int(q*100)),
+							strconv.FormatFloat(last.Quantile(q), 'f', 1, 64))
+					}
 				}
-				time.Sleep(time.Duration(interval) * time.Second)
 			}
+			gr.SendBatch(batch.metrics)
+		}
+	}()
+}
+
+// backgroundMemStats samples the runtime memory stats every interval and
+// sends them with the buffered bytes
+func backgroundMemStats(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			_, size, _ := store.stats()
+			memStats.Sample(size)
+			heapAlloc, nextGC, numGC, _, _ := memStats.Get()
+			batch := NewMetricBatch()
+			batch.Add(fmt.Sprintf("%s.heap_alloc", cfg().graphiteprefix), strconv.FormatUint(heapAlloc, 10))
+			batch.Add(fmt.Sprintf("%s.next_gc", cfg().graphiteprefix), strconv.FormatUint(nextGC, 10))
+			batch.Add(fmt.Sprintf("%s.num_gc", cfg().graphiteprefix), strconv.FormatUint(uint64(numGC), 10))
+			batch.Add(fmt.Sprintf("%s.buffered_bytes", cfg().graphiteprefix), strconv.Itoa(size))
+			gr.SendBatch(batch.metrics)
 		}
 	}()
 }
@@ -297,50 +1319,57 @@ func (store *Store) backgroundSender(interval int) {
 // backgroundRecovery run continuously in background and try recovery errors
 func (store *Store) backgroundRecovery(interval int) {
 	ctx, cancel := context.WithCancel(context.Background())
-	store.cancelSyncer = cancel
+	store.cancelResend = cancel
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
-				fmt.Println("backgroundManager - canceled")
+				grlog(LEVEL_INFO, "backgroundManager - canceled", Fields{"component": "recovery"})
 				return
 			default:
+				// nothing goes to clickhouse while paused, the errors wait for /resume
+				if store.isPaused() {
+					break
+				}
+				// recovery errors are never fatal, the next pass retries
 				nopanic := checkErr()
 				if nopanic != nil {
-					fmt.Println("nopanic:", nopanic.Error())
+					grlog(LEVEL_ERR, "nopanic:", nopanic, Fields{"component": "recovery"})
+				} else if cfg().webhook != "" {
+					notifier.recovered(errorCount())
 				}
+				atomic.StoreInt32(&recovered, 1)
 			}
 			time.Sleep(time.Duration(interval) * time.Second)
 		}
 	}()
 }
 
+// extractTable returns the table of the insert query of the key, "unknown"
+// if it has none
 func extractTable(key string) string {
-	table := "unknown"
-	lowkey := strings.ToLower(key)
-	if strings.Contains(lowkey, "insert%20into%20") {
-		from := strings.Index(lowkey, "insert%20into%20")
-		if from >= 0 {
-			from += len("insert%20into%20")
-			to := strings.Index(lowkey[from:], "%20")
-			if to > 0 {
-				table = lowkey[from:(to + from)]
-			}
-		}
+	values, _ := url.ParseQuery(key[strings.Index(key, "?")+1:])
+	if table := insertTable(values); table != "" {
+		return table
 	}
-	if table == "unknown" {
-		if strings.Contains(lowkey, "insert+into+") {
-			from := strings.Index(lowkey, "insert+into+")
-			if from >= 0 {
-				from += len("insert+into+")
-				to := strings.Index(lowkey[from:], "+")
-				if to > 0 {
-					table = lowkey[from:(to + from)]
-				}
-			}
-		}
+	return "unknown"
+}
+
+var insertQuery = regexp.MustCompile("(?i)^\\s*INSERT\\s+INTO\\s+(TABLE\\s+)?([\\w.`\"]+)")
+
+// insertTable returns the lowercased table of the query param, without the
+// quotes, only if it is a single INSERT query. Other params are never looked
+// at, a param_x=INSERT INTO t is not the query clickhouse runs
+func insertTable(values url.Values) string {
+	queries := values["query"]
+	if len(queries) != 1 {
+		return ""
 	}
-	return table
+	m := insertQuery.FindStringSubmatch(queries[0])
+	if m == nil {
+		return ""
+	}
+	return strings.ToLower(strings.NewReplacer("`", "", `"`, "").Replace(m[2]))
 }
 
 // вырезаем из строки password=xxxxx для логов
@@ -358,72 +1387,237 @@ func hidePassword(str string) string {
 }
 
 func saveToErrors(key string, val []byte, level int) {
+	saveToErrorsAt(key, val, level, time.Now())
+}
+
+// saveToErrorsAt saves the batch to be resent after at and the backoff of the
+// level, picked once here. The file time is the resend time, checkErr holds
+// the file until then
+func saveToErrorsAt(key string, val []byte, level int, at time.Time) {
 	prefix := strconv.Itoa(level)
 	if level >= 10 {
 		prefix = "O"
 	}
-	db := fmt.Sprintf("%s/%s%d", ERROR_DIR, prefix, time.Now().UnixNano())
+	at = at.Add(errorBackoff().Delay(level - 1))
+	db := fmt.Sprintf("%s/%s%d", ERROR_DIR, prefix, at.UnixNano())
 	pudge.Set(db, key, val)
 	pudge.Close(db)
+	notifier.saved()
+}
+
+// retryAfter returns the Retry-After delay of a 503 response, capped by
+// errbackoffmax, 0 for other responses
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	var wait time.Duration
+	if sec, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(sec) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		wait = time.Until(at)
+	}
+	if max := time.Duration(cfg().errbackoffmax) * time.Second; wait > max {
+		wait = max
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// isOKStatus checks the upstream status code against -okstatus
+func isOKStatus(code int) bool {
+	if cfg().okstatus == "" {
+		return code >= 200 && code < 300
+	}
+	for _, s := range strings.Split(cfg().okstatus, ",") {
+		if strings.TrimSpace(s) == strconv.Itoa(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// receivedMetrics sends the counters of a request received from a client
+func receivedMetrics(table string, bytes int) {
+	batch := NewMetricBatch()
+	batch.Add(fmt.Sprintf("%s.requests_received", cfg().graphiteprefix), "1")
+	batch.Add(fmt.Sprintf("%s.byhost.%s.requests_received", cfg().graphiteprefix, hostname), "1")
+	batch.Add(fmt.Sprintf("%s.bytable.%s.requests_received", cfg().graphiteprefix, table), "1")
+	batch.Add(fmt.Sprintf("%s.bytes_received", cfg().graphiteprefix), fmt.Sprintf("%d", bytes))
+	batch.Add(fmt.Sprintf("%s.byhost.%s.bytes_received", cfg().graphiteprefix, hostname), fmt.Sprintf("%d", bytes))
+	batch.Add(fmt.Sprintf("%s.bytable.%s.bytes_received", cfg().graphiteprefix, table), fmt.Sprintf("%d", bytes))
+	gr.SendBatch(batch.metrics)
+	tableCounters.Add("requests_received", table, 1)
+	tableCounters.Add("bytes_received", table, uint64(bytes))
+}
+
+// sentMetrics sends the counters of a request forwarded upstream
+func sentMetrics(table string, rowcount int, bytes int) {
+	batch := NewMetricBatch()
+	batch.Add(fmt.Sprintf("%s.rows_sent", cfg().graphiteprefix), fmt.Sprintf("%d", rowcount))
+	batch.Add(fmt.Sprintf("%s.requests_sent", cfg().graphiteprefix), "1")
+	batch.Add(fmt.Sprintf("%s.byhost.%s.rows_sent", cfg().graphiteprefix, hostname), fmt.Sprintf("%d", rowcount))
+	batch.Add(fmt.Sprintf("%s.byhost.%s.requests_sent", cfg().graphiteprefix, hostname), "1")
+	batch.Add(fmt.Sprintf("%s.bytable.%s.rows_sent", cfg().graphiteprefix, table), fmt.Sprintf("%d", rowcount))
+	batch.Add(fmt.Sprintf("%s.bytable.%s.requests_sent", cfg().graphiteprefix, table), "1")
+	batch.Add(fmt.Sprintf("%s.bytes_sent", cfg().graphiteprefix), fmt.Sprintf("%d", bytes))
+	batch.Add(fmt.Sprintf("%s.byhost.%s.bytes_sent", cfg().graphiteprefix, hostname), fmt.Sprintf("%d", bytes))
+	batch.Add(fmt.Sprintf("%s.bytable.%s.bytes_sent", cfg().graphiteprefix, table), fmt.Sprintf("%d", bytes))
+	gr.SendBatch(batch.metrics)
+	tableCounters.Add("requests_sent", table, 1)
+	tableCounters.Add("rows_sent", table, uint64(rowcount))
+	tableCounters.Add("bytes_sent", table, uint64(bytes))
+	tableCounters.Sent(table, time.Now())
+}
+
+// errorMetrics counts an upstream error for the table
+func errorMetrics(table string) {
+	batch := NewMetricBatch()
+	batch.Add(fmt.Sprintf("%s.ch_errors", cfg().graphiteprefix), "1")
+	batch.Add(fmt.Sprintf("%s.byhost.%s.ch_errors", cfg().graphiteprefix, hostname), "1")
+	batch.Add(fmt.Sprintf("%s.bytable.%s.ch_errors", cfg().graphiteprefix, table), "1")
+	gr.SendBatch(batch.metrics)
+	tableErrors.Add(table)
+	tableCounters.Add("ch_errors", table, 1)
 }
 
 //sender
 func send(key string, val []byte, rowcount int, level int) (err error) {
-	if *isdebug {
-		fmt.Printf("time:%s\tkey:%s\tval:%s\n", time.Now(), key, val)
+	return sendContext(context.Background(), key, val, rowcount, level)
+}
+
+// sendContext is send with the upstream requests bound to ctx
+func sendContext(ctx context.Context, key string, val []byte, rowcount int, level int) (err error) {
+	if level == 0 {
+		observeBatch(val, rowcount)
+	}
+	_, wait, err := deliver(ctx, key, val, rowcount)
+	if err != nil && len(val) > 0 {
+		saveToErrorsAt(key, val, level+1, time.Now().Add(wait))
+	}
+	return err
+}
+
+// observeBatch counts a batch in the size histograms
+func observeBatch(val []byte, rowcount int) {
+	if len(val) == 0 {
+		return
+	}
+	gr.SimpleSend(fmt.Sprintf("%s.batch_bytes.%s", cfg().graphiteprefix, batchBytes.Observe(len(val))), "1")
+	gr.SimpleSend(fmt.Sprintf("%s.batch_rows.%s", cfg().graphiteprefix, batchRows.Observe(rowcount)), "1")
+}
+
+// deliver sends the batch upstream with the inline retries, it returns the
+// last status code (0 without a response) and the Retry-After delay of a
+// 503. The caller saves a failed batch
+func deliver(ctx context.Context, key string, val []byte, rowcount int) (code int, wait time.Duration, err error) {
+	return deliverFrom(ctx, key, val, rowcount, 0)
+}
+
+// deliverFrom is deliver with the inline retries counted from attempt, a
+// flush holding flushMu sends with attempt -retries, so it never sleeps
+func deliverFrom(ctx context.Context, key string, val []byte, rowcount int, from int) (code int, wait time.Duration, err error) {
+	if len(val) == 0 {
+		gr.SimpleSend(fmt.Sprintf("%s.empty_flush_skipped", cfg().graphiteprefix), "1")
+		grlog(LEVEL_WARN, "Empty batch skipped: ", hidePassword(key), Fields{"component": "flush", "table": extractTable(key)})
+		return 0, 0, nil
+	}
+	// batches carry user data, they are logged only when asked for and cut
+	if cfg().logbodybytes > 0 && logLevel() == LEVEL_DBG {
+		text := string(val)
+		if len(val) > cfg().logbodybytes {
+			text = string(val[:cfg().logbodybytes]) + fmt.Sprintf(" ...(truncated at %d bytes)", cfg().logbodybytes)
+		}
+		grlog(LEVEL_DBG, "Send ", hidePassword(key), " val: ", text, Fields{"component": "flush"})
 	}
 	//send
 	table := extractTable(key)
-	uri := key
-	if strings.HasPrefix(uri, "/") {
-		uri = *fwd + uri
-	} else {
-		uri = strings.Replace(uri, *repl, *fwd, 1)
+	fields := Fields{"component": "flush", "table": table, "key": hidePassword(key)}
+	base, _ := upstream(key)
+	uri := forwardTo(key, base)
+	req, err := http.NewRequestWithContext(ctx, "POST", uri /*fmt.Sprintf("%s%s", *fwd, key)*/, bytes.NewBuffer(val))
+	var traceparent string
+	if cfg().tracing && err == nil {
+		traceparent = childTraceparent(traceFrom(ctx))
+		req.Header.Set("traceparent", traceparent)
+		defer func(start time.Time) {
+			grlog(LEVEL_DBG, "Trace ", traceID(traceparent), " sent ", len(val), " bytes in ", time.Since(start), " status ", code, ": ", hidePassword(uri))
+		}(time.Now())
 	}
-	req, err := http.NewRequest("POST", uri /*fmt.Sprintf("%s%s", *fwd, key)*/, bytes.NewBuffer(val))
 
-	bytes := len(val)
-	gr.SimpleSend(fmt.Sprintf("%s.rows_sent", *graphiteprefix), fmt.Sprintf("%d", rowcount))
-	gr.SimpleSend(fmt.Sprintf("%s.requests_sent", *graphiteprefix), "1")
-	gr.SimpleSend(fmt.Sprintf("%s.byhost.%s.rows_sent", *graphiteprefix, hostname), fmt.Sprintf("%d", rowcount))
-	gr.SimpleSend(fmt.Sprintf("%s.byhost.%s.requests_sent", *graphiteprefix, hostname), "1")
-	gr.SimpleSend(fmt.Sprintf("%s.bytable.%s.rows_sent", *graphiteprefix, table), fmt.Sprintf("%d", rowcount))
-	gr.SimpleSend(fmt.Sprintf("%s.bytable.%s.requests_sent", *graphiteprefix, table), "1")
-	gr.SimpleSend(fmt.Sprintf("%s.bytes_sent", *graphiteprefix), fmt.Sprintf("%d", bytes))
-	gr.SimpleSend(fmt.Sprintf("%s.byhost.%s.bytes_sent", *graphiteprefix, hostname), fmt.Sprintf("%d", bytes))
-	gr.SimpleSend(fmt.Sprintf("%s.bytable.%s.bytes_sent", *graphiteprefix, table), fmt.Sprintf("%d", bytes))
+	sentMetrics(table, rowcount, len(val))
 
 	if err != nil {
-		gr.SimpleSend(fmt.Sprintf("%s.ch_errors", *graphiteprefix), "1")
-		gr.SimpleSend(fmt.Sprintf("%s.byhost.%s.ch_errors", *graphiteprefix, hostname), "1")
-		gr.SimpleSend(fmt.Sprintf("%s.bytable.%s.ch_errors", *graphiteprefix, table), "1")
-		grlog(LEVEL_ERR, "Create request error: ", hidePassword(uri), " error: ", err)
-		if len(val) > 0 {
-			saveToErrors(key, val, level+1)
-		}
+		errorMetrics(table)
+		grlog(LEVEL_ERR, "Create request error: ", hidePassword(uri), " error: ", err, fields)
 		return
 	}
-	resp, err := http.DefaultClient.Do(req)
-	defer resp.Body.Close()
-	if err == nil && resp.StatusCode != 200 {
-		err = errors.New("Error: response code not 200")
+	inflight.acquire(int64(len(val)), int64(cfg().maxinflightbytes))
+	defer inflight.release(int64(len(val)))
+	sent := time.Now()
+	resp, err := do(req)
+	// a bad insert (4xx) fails again, only connection errors and 5xx are retried
+	for attempt := from; attempt < cfg().retries && (err != nil || (!isOKStatus(resp.StatusCode) && resp.StatusCode >= 500)) && retryAfter(resp) == 0; attempt++ {
+		if err == nil {
+			resp.Body.Close()
+		}
+		gr.SimpleSend(fmt.Sprintf("%s.send_retries", cfg().graphiteprefix), "1")
+		time.Sleep(sendBackoff().Delay(attempt))
+		req.Body, _ = req.GetBody()
+		resp, err = do(req)
 	}
-	if err != nil {
-		grlog(LEVEL_ERR, "Request error: ", hidePassword(uri), " error: ", err)
-		status = err.Error() + "\r\n"
-		gr.SimpleSend(fmt.Sprintf("%s.ch_errors", *graphiteprefix), "1")
-		gr.SimpleSend(fmt.Sprintf("%s.byhost.%s.ch_errors", *graphiteprefix, hostname), "1")
-		gr.SimpleSend(fmt.Sprintf("%s.bytable.%s.ch_errors", *graphiteprefix, table), "1")
+	forwardLatency.Observe(table, time.Since(sent))
+	if err == nil {
+		defer resp.Body.Close()
+		code = resp.StatusCode
+		if !isOKStatus(resp.StatusCode) {
+			err = fmt.Errorf("Error: response code %d", resp.StatusCode)
+		}
+	}
+	upstreamHealth.Result(base, code > 0 && code < 500)
+	// a down or failing host, not a bad insert, is tried on the next one
+	for _, next := range failoverBases(base) {
+		if err == nil || (code > 0 && code < 500) {
+			break
+		}
+		grlog(LEVEL_WARN, "Send to ", hidePassword(base), " failed: ", err, ", failover to ", hidePassword(next), fields)
+		gr.SimpleSend(fmt.Sprintf("%s.failover_sends", cfg().graphiteprefix), "1")
+		if resp != nil {
+			resp.Body.Close()
+		}
+		base, uri = next, forwardTo(key, next)
+		resp, code, err = sendTo(ctx, uri, val, traceparent)
 		if resp != nil {
-			bodyResp, _ := ioutil.ReadAll(resp.Body)
-			grlog(LEVEL_ERR, "Response: status: ", resp.StatusCode, " body: ", string(bodyResp))
+			defer resp.Body.Close()
+		}
+		upstreamHealth.Result(base, code > 0 && code < 500)
+	}
+	if err != nil {
+		grlog(LEVEL_ERR, "Request error: ", hidePassword(uri), " error: ", err, fields)
+		setStatus(err.Error() + "\r\n")
+		// upstream asked to come back later, the batch waits for it in the errors dir
+		wait = retryAfter(resp)
+		if wait > 0 {
+			gr.SimpleSend(fmt.Sprintf("%s.ch_unavailable", cfg().graphiteprefix), "1")
+		} else {
+			errorMetrics(table)
 		}
-		if len(val) > 0 {
-			saveToErrors(key, val, level+1)
+		if resp != nil {
+			bodyResp, truncated := readErrorBody(resp)
+			text := responseText(resp.Header, bodyResp)
+			if truncated {
+				text += fmt.Sprintf(" ...(truncated at %d bytes)", cfg().maxrespbytes)
+			}
+			grlog(LEVEL_ERR, "Response: status: ", resp.StatusCode, " body: ", text, fields)
+			recentErrors.Add(table, key, resp.StatusCode, text)
 		}
 		return
 	} else {
-		status = "OK\r\n"
+		setStatus("OK\r\n")
+		atomic.StoreInt64(&lastFlush, time.Now().UnixNano())
 	}
 	return
 }
@@ -439,8 +1633,12 @@ func checkErr() (err error) {
 	}
 	sort.Sort(sort.StringSlice(list))
 	for _, file := range list {
+		// resend a file only after its resend time
+		if at, err := strconv.ParseInt(file[1:], 10, 64); err == nil && time.Now().Before(time.Unix(0, at)) {
+			continue
+		}
 		db, err := pudge.Open(ERROR_DIR+"/"+file, nil)
-		grlog(LEVEL_ERR, "Proccessing error:", file)
+		grlog(LEVEL_ERR, "Proccessing error:", file, Fields{"component": "recovery"})
 		if err != nil {
 			return err
 		}
@@ -472,7 +1670,7 @@ func filePathWalkDir(root string) ([]string, error) {
 	var files []string
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			grlog(LEVEL_ERR, "dirwalk error ", err)
+			grlog(LEVEL_ERR, "dirwalk error ", err, Fields{"component": "recovery"})
 			return err
 		}
 		filename := filepath.Base(path)
@@ -3,13 +3,24 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -53,7 +64,7 @@ func Test_Base(t *testing.T) {
 	println("done")
 	store.RLock()
 	for req := range store.Req {
-		slices := bytes.Split(store.Req[req], []byte(","))
+		slices := bytes.Split(store.Req[req].buffer, []byte(","))
 		fmt.Printf("store:\n\nuri:%s\nbody:%d\n", req, len(slices))
 	}
 	store.RUnlock()
@@ -77,3 +88,1023 @@ func post(b string) {
 		panic(err)
 	}
 }
+
+func Test_MaxKeys(t *testing.T) {
+	var sent int32
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sent, 1)
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.maxkeys = ch.URL, 1 })
+
+	insert := func(table string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20"+table+"%20VALUES", strings.NewReader("(1)"))
+		dorequest(w, r)
+		return w.Code
+	}
+
+	resetStore()
+	configure(func(c *Config) { c.keyoverflow = "reject" })
+	if code := insert("t1"); code != http.StatusOK {
+		t.Fatalf("first key: want 200; got %d", code)
+	}
+	if code := insert("t1"); code != http.StatusOK {
+		t.Fatalf("existing key: want 200; got %d", code)
+	}
+	if code := insert("t2"); code != http.StatusServiceUnavailable {
+		t.Fatalf("new key over limit: want 503; got %d", code)
+	}
+
+	configure(func(c *Config) { c.keyoverflow = "flush" })
+	if code := insert("t2"); code != http.StatusOK {
+		t.Fatalf("flush mode: want 200; got %d", code)
+	}
+	store.RLock()
+	_, ok := store.Req["/?query=INSERT%20INTO%20t2%20VALUES"]
+	n := len(store.Req)
+	store.RUnlock()
+	if n != 1 || !ok {
+		t.Errorf("flush mode: want only t2 buffered; got %d keys", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&sent) != 1 {
+		t.Errorf("flush mode: want largest key sent; got %d sends", sent)
+	}
+}
+
+func Test_AsyncInsertParams(t *testing.T) {
+	var got url.Values
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+
+	resetStore()
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES&async_insert=1&wait_for_async_insert=1", strings.NewReader("(1)"))
+		dorequest(w, r)
+	}
+	store.RLock()
+	n := len(store.Req)
+	store.RUnlock()
+	if n != 1 {
+		t.Fatalf("want one buffer key; got %d", n)
+	}
+	store.flush()
+	if got.Get("async_insert") != "1" {
+		t.Errorf("async_insert: want '1'; got '%s'", got.Get("async_insert"))
+	}
+	if got.Get("wait_for_async_insert") != "1" {
+		t.Errorf("wait_for_async_insert: want '1'; got '%s'", got.Get("wait_for_async_insert"))
+	}
+	if got.Get("query") != "INSERT INTO t VALUES" {
+		t.Errorf("query: want 'INSERT INTO t VALUES'; got '%s'", got.Get("query"))
+	}
+}
+
+func Test_MaxFlushPerCycle(t *testing.T) {
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.URL.Query().Get("query"))
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.maxflushpercycle = ch.URL, 2 })
+
+	resetStore()
+	now := time.Now()
+	for i, table := range []string{"c", "a", "b"} {
+		key := "?query=INSERT%20INTO%20" + table + "%20VALUES"
+		store.add(key, key, table, []byte("(1)"), []byte(","), 1)
+		store.Lock()
+		store.Req[key].created = now.Add(time.Duration(i) * time.Second)
+		store.Unlock()
+	}
+
+	store.flush()
+	if len(sent) != 2 {
+		t.Fatalf("first cycle: want 2 sends; got %d", len(sent))
+	}
+	store.RLock()
+	_, ok := store.Req["?query=INSERT%20INTO%20b%20VALUES"]
+	store.RUnlock()
+	if !ok {
+		t.Errorf("first cycle: want newest key 'b' left in buffer")
+	}
+	store.flush()
+	if len(sent) != 3 || sent[2] != "INSERT INTO b VALUES" {
+		t.Errorf("second cycle: want 'b' sent; got %v", sent)
+	}
+}
+
+func Test_StateListener(t *testing.T) {
+	total := atomic.LoadUint32(&totalConnections)
+	curr := atomic.LoadInt32(&currConnections)
+	idle := atomic.LoadInt32(&idleConnections)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+
+	statelistener(c1, http.StateNew)
+	statelistener(c1, http.StateActive)
+	statelistener(c2, http.StateNew)
+	statelistener(c3, http.StateNew)
+	if got := atomic.LoadInt32(&currConnections) - curr; got != 3 {
+		t.Errorf("current: want 3; got %d", got)
+	}
+	if got := atomic.LoadInt32(&idleConnections) - idle; got != 2 {
+		t.Errorf("idle: want 2; got %d", got)
+	}
+
+	statelistener(c1, http.StateIdle)
+	statelistener(c1, http.StateActive)
+	statelistener(c1, http.StateClosed) // closed while active
+	statelistener(c1, http.StateClosed) // duplicate close
+	statelistener(c2, http.StateClosed) // closed while new
+	statelistener(c3, http.StateActive)
+	statelistener(c3, http.StateHijacked)
+	statelistener(c4, http.StateClosed) // never seen
+
+	if got := atomic.LoadUint32(&totalConnections) - total; got != 3 {
+		t.Errorf("total: want 3; got %d", got)
+	}
+	if got := atomic.LoadInt32(&currConnections) - curr; got != 0 {
+		t.Errorf("current: want 0; got %d", got)
+	}
+	if got := atomic.LoadInt32(&idleConnections) - idle; got != 0 {
+		t.Errorf("idle: want 0; got %d", got)
+	}
+}
+
+func Test_StatusFormat(t *testing.T) {
+	defer restoreConfig(*cfg())
+	for _, tc := range []struct {
+		format  string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{"plain", dorequest, "status = \"OK\"\r\n"},
+		{"plain", showstatus, "status:OK\r\n"},
+		{"json", dorequest, "{\"status\":\"OK\"}\n"},
+		{"json", showstatus, "{\"status\":\"OK\"}\n"},
+	} {
+		configure(func(c *Config) { c.statusformat = tc.format })
+		setStatus("OK\r\n")
+		w := httptest.NewRecorder()
+		tc.handler(w, httptest.NewRequest("GET", "/", nil))
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("%s: want %q; got %q", tc.format, tc.want, got)
+		}
+	}
+}
+
+func Test_InjectTimestamp(t *testing.T) {
+	now := time.Date(2020, 7, 16, 19, 17, 55, 0, time.UTC)
+	got := string(injectTimestamp([]byte("1\ta\n2\tb\n"), "TSV", now))
+	want := "2020-07-16 19:17:55\t1\ta\n2020-07-16 19:17:55\t2\tb\n"
+	if got != want {
+		t.Errorf("TSV: want %q; got %q", want, got)
+	}
+	got = string(injectTimestamp([]byte("1\ta"), "TSV", now))
+	want = "2020-07-16 19:17:55\t1\ta"
+	if got != want {
+		t.Errorf("TSV without trailing newline: want %q; got %q", want, got)
+	}
+	got = string(injectTimestamp([]byte("1,a\n"), "CSV", now))
+	want = "\"2020-07-16 19:17:55\",1,a\n"
+	if got != want {
+		t.Errorf("CSV: want %q; got %q", want, got)
+	}
+
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.injecttimestamp = "tsv" })
+	resetStore()
+	w := httptest.NewRecorder()
+	dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20FORMAT%20TSV", strings.NewReader("1\ta\n")))
+	store.RLock()
+	buf := store.Req["/?query=INSERT%20INTO%20t%20FORMAT%20TSV"]
+	store.RUnlock()
+	if buf == nil || bytes.Count(buf.buffer, []byte("\t")) != 2 {
+		t.Errorf("dorequest: want timestamp column prepended; got %v", buf)
+	}
+
+	// the format is matched as clickhouse does, in any case and spacing
+	for _, uri := range []string{"/?query=insert%20into%20t2%20format%20tsv", "/?query=INSERT%20INTO%20t3%20FORMAT%20%20Tsv%0A"} {
+		dorequest(httptest.NewRecorder(), httptest.NewRequest("POST", uri, strings.NewReader("1\ta\n")))
+		store.RLock()
+		buf := store.Req[uri]
+		store.RUnlock()
+		if buf == nil || bytes.Count(buf.buffer, []byte("\t")) != 2 {
+			t.Errorf("%s: want timestamp column prepended; got %v", uri, buf)
+		}
+	}
+}
+
+// configure publishes a copy of the running config changed by set
+func configure(set func(c *Config)) {
+	next := *cfg()
+	set(&next)
+	running.Store(&next)
+}
+
+// restoreConfig publishes c again, tests defer it with the config they start with
+func restoreConfig(c Config) {
+	running.Store(&c)
+}
+
+// resetStore drops all buffered keys without sending them, it waits for the
+// sends and retries in flight first, so they don't see the flags of the next test
+func resetStore() {
+	store.evicting.Wait()
+	store.flushMu.Lock()
+	store.flushMu.Unlock()
+	store.retrying.Wait()
+	store.Lock()
+	store.Req = make(map[string]*Buffer)
+	store.tables = make(map[string]int)
+	store.size = 0
+	store.Unlock()
+}
+
+// inTempDir runs the test in a temporary directory with an empty errors dir
+func inTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxyhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, ERROR_DIR), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+}
+
+func Test_OKStatus(t *testing.T) {
+	inTempDir(t)
+	code := 200
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+
+	for _, tc := range []struct {
+		okstatus string
+		code     int
+		ok       bool
+	}{
+		{"", 200, true},
+		{"", 204, true},
+		{"", 500, false},
+		{"200", 204, false},
+		{"200, 204", 204, true},
+	} {
+		code = tc.code
+		configure(func(c *Config) { c.okstatus = tc.okstatus })
+		err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0)
+		if (err == nil) != tc.ok {
+			t.Errorf("okstatus %q code %d: want ok %v; got %v", tc.okstatus, tc.code, tc.ok, err)
+		}
+		files, _ := filePathWalkDir(ERROR_DIR)
+		if tc.ok && len(files) > 0 {
+			t.Errorf("okstatus %q code %d: want no error files; got %v", tc.okstatus, tc.code, files)
+		}
+		if !tc.ok && len(files) == 0 {
+			t.Errorf("okstatus %q code %d: want error file", tc.okstatus, tc.code)
+		}
+		for _, f := range files {
+			os.Remove(filepath.Join(ERROR_DIR, f))
+		}
+	}
+}
+
+func Test_EmptyBody(t *testing.T) {
+	defer restoreConfig(*cfg())
+	resetStore()
+	for _, tc := range []struct {
+		allow bool
+		code  int
+	}{
+		{false, http.StatusBadRequest},
+		{true, http.StatusOK},
+	} {
+		configure(func(c *Config) { c.allowemptybody = tc.allow })
+		w := httptest.NewRecorder()
+		dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", strings.NewReader("")))
+		if w.Code != tc.code {
+			t.Errorf("allowemptybody %v: want %d; got %d", tc.allow, tc.code, w.Code)
+		}
+	}
+	if keys, _, _ := store.stats(); keys != 0 {
+		t.Errorf("want nothing buffered; got %d keys", keys)
+	}
+}
+
+func Test_SendRetries(t *testing.T) {
+	inTempDir(t)
+	var calls int32
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b, _ := ioutil.ReadAll(r.Body); string(b) != "(1)" {
+			t.Errorf("retry body: want '(1)'; got '%s'", b)
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.retries, c.backoffbase = ch.URL, 2, 1 })
+
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err != nil {
+		t.Errorf("want success after retry; got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("want 2 calls; got %d", calls)
+	}
+
+	// a bad insert is not retried
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer bad.Close()
+	calls = 0
+	configure(func(c *Config) { c.fwd = bad.URL })
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err == nil {
+		t.Errorf("want an error on 400")
+	}
+	if calls != 1 {
+		t.Errorf("400: want no retries; got %d calls", calls)
+	}
+}
+
+func Test_MaxBodyBytes(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.maxbodybytes = 5 })
+	resetStore()
+	w := httptest.NewRecorder()
+	dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", strings.NewReader("(1),(2)")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("want 413; got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", strings.NewReader("(1)")))
+	if w.Code != http.StatusOK {
+		t.Errorf("want 200; got %d", w.Code)
+	}
+}
+
+// countReader counts the bytes read from it
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func Test_MaxBodyBytesEarly(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.maxbodybytes = 100 })
+	resetStore()
+	big := strings.Repeat("(1),", 1000)
+
+	// declared Content-Length: rejected without reading
+	body := &countReader{r: strings.NewReader(big)}
+	r := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", body)
+	r.ContentLength = int64(len(big))
+	w := httptest.NewRecorder()
+	dorequest(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || body.n != 0 {
+		t.Errorf("Content-Length: want 413 and nothing read; got %d, read %d", w.Code, body.n)
+	}
+
+	// chunked: read up to the limit only
+	body = &countReader{r: strings.NewReader(big)}
+	r = httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", body)
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	dorequest(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || body.n > 101 {
+		t.Errorf("chunked: want 413 and at most 101 bytes read; got %d, read %d", w.Code, body.n)
+	}
+}
+
+func Test_RecoveryUpstreamDown(t *testing.T) {
+	inTempDir(t)
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.resendint = ch.URL, 0 })
+
+	saveToErrors("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1)
+	configure(func(c *Config) { c.resendint = 60 })
+	start := time.Now()
+	if err := checkErr(); err != nil {
+		t.Fatalf("want no error with upstream down; got %v", err)
+	}
+	files, _ := filePathWalkDir(ERROR_DIR)
+	if len(files) != 1 || files[0][0] != '2' {
+		t.Fatalf("want the batch kept with level 2; got %v", files)
+	}
+	// the resend time is picked once, up to the level 2 cap of 120s
+	at, _ := strconv.ParseInt(files[0][1:], 10, 64)
+	if wait := time.Unix(0, at).Sub(start); wait < 0 || wait > 121*time.Second {
+		t.Errorf("want the file held up to 120s; got %s", wait)
+	}
+}
+
+func Test_HeaderQuery(t *testing.T) {
+	var got []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.Query().Get("query"))
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+	resetStore()
+
+	for _, tc := range []struct {
+		header, value string
+		code          int
+	}{
+		{"X-Proxyhouse-Query", "INSERT INTO events FORMAT TSV", http.StatusOK},
+		{"X-Proxyhouse-Query", "INSERT INTO events FORMAT TSV", http.StatusOK},
+		{"X-Proxyhouse-Table", "db.logs", http.StatusOK},
+		{"X-Proxyhouse-Table", "logs; DROP TABLE x", http.StatusBadRequest},
+		{"X-Proxyhouse-Query", "SELECT 1", http.StatusBadRequest},
+		{"X-Proxyhouse-Query", "INSERT INTO t VALUES;\nDROP TABLE t", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("POST", "/?query_id=1", strings.NewReader("1\n"))
+		r.Header.Set(tc.header, tc.value)
+		w := httptest.NewRecorder()
+		dorequest(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s %q: want %d; got %d", tc.header, tc.value, tc.code, w.Code)
+		}
+	}
+
+	store.RLock()
+	tables := map[string]bool{}
+	for _, val := range store.Req {
+		tables[val.table] = true
+	}
+	n := len(store.Req)
+	store.RUnlock()
+	if n != 2 || !tables["events"] || !tables["db.logs"] {
+		t.Errorf("want keys for events and db.logs; got %d keys %v", n, tables)
+	}
+	store.flush()
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "INSERT INTO db.logs VALUES" || got[1] != "INSERT INTO events FORMAT TSV" {
+		t.Errorf("forwarded: want header queries; got %q", got)
+	}
+}
+
+func Test_KeyParams(t *testing.T) {
+	var got []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = append(got, r.URL.Query().Get("query_id")+" "+string(b))
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.keyparams = ch.URL, "query,database" })
+	resetStore()
+
+	for _, target := range []string{
+		"/?query=INSERT%20INTO%20t%20VALUES&query_id=1",
+		"/?query=INSERT%20INTO%20t%20VALUES&query_id=2",
+		"/?query=INSERT%20INTO%20t%20VALUES&query_id=3&database=db2",
+	} {
+		dorequest(httptest.NewRecorder(), httptest.NewRequest("POST", target, strings.NewReader("(1)")))
+	}
+	store.RLock()
+	n := len(store.Req)
+	store.RUnlock()
+	if n != 2 {
+		t.Fatalf("want 2 keys; got %d", n)
+	}
+	store.flush()
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "1 (1),(1)" || got[1] != "3 (1)" {
+		t.Errorf("want the first query string forwarded with the merged batch; got %q", got)
+	}
+}
+
+func Test_Ready(t *testing.T) {
+	defer func(v int32, c Config) { restoreConfig(c); atomic.StoreInt32(&recovered, v) }(atomic.LoadInt32(&recovered), *cfg())
+	for _, tc := range []struct {
+		wait      bool
+		recovered int32
+		code      int
+	}{
+		{false, 0, http.StatusOK},
+		{true, 0, http.StatusServiceUnavailable},
+		{true, 1, http.StatusOK},
+	} {
+		configure(func(c *Config) { c.readyafterrecovery = tc.wait })
+		atomic.StoreInt32(&recovered, tc.recovered)
+		w := httptest.NewRecorder()
+		showready(w, httptest.NewRequest("GET", "/ready", nil))
+		if w.Code != tc.code {
+			t.Errorf("readyafterrecovery %v recovered %d: want %d; got %d", tc.wait, tc.recovered, tc.code, w.Code)
+		}
+	}
+}
+
+func Test_SendEmpty(t *testing.T) {
+	var calls int32
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", nil, 0, 0); err != nil {
+		t.Errorf("want nil; got %v", err)
+	}
+	resetStore()
+	store.Lock()
+	store.Req["?query=INSERT%20INTO%20t%20VALUES"] = &Buffer{uri: "?query=INSERT%20INTO%20t%20VALUES", created: time.Now()}
+	store.Unlock()
+	store.flush()
+	if calls != 0 {
+		t.Errorf("want empty buffer never forwarded; got %d calls", calls)
+	}
+}
+
+func Test_RetryAfter(t *testing.T) {
+	inTempDir(t)
+	var calls int32
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.retries, c.backoffbase, c.resendint = ch.URL, 2, 1, 0 })
+
+	start := time.Now()
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err == nil {
+		t.Errorf("want an error on 503")
+	}
+	if calls != 1 {
+		t.Errorf("want no inline retries; got %d calls", calls)
+	}
+	files, _ := filePathWalkDir(ERROR_DIR)
+	if len(files) != 1 {
+		t.Fatalf("want 1 error file; got %q", files)
+	}
+	at, _ := strconv.ParseInt(files[0][1:], 10, 64)
+	if wait := time.Unix(0, at).Sub(start); wait < 119*time.Second || wait > 121*time.Second {
+		t.Errorf("want the file held for 120s; got %s", wait)
+	}
+	checkErr()
+	if calls != 1 {
+		t.Errorf("want no resend before Retry-After; got %d calls", calls)
+	}
+
+	for _, tc := range []struct {
+		code  int
+		value string
+		want  time.Duration
+	}{
+		{http.StatusServiceUnavailable, "", 0},
+		{http.StatusServiceUnavailable, "30", 30 * time.Second},
+		{http.StatusServiceUnavailable, "999999", time.Duration(cfg().errbackoffmax) * time.Second},
+		{http.StatusServiceUnavailable, time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0},
+		{http.StatusInternalServerError, "30", 0},
+	} {
+		resp := &http.Response{StatusCode: tc.code, Header: http.Header{"Retry-After": {tc.value}}}
+		if got := retryAfter(resp); got != tc.want {
+			t.Errorf("%d %q: want %s; got %s", tc.code, tc.value, tc.want, got)
+		}
+	}
+}
+
+func Test_BufferKeyPaths(t *testing.T) {
+	defer restoreConfig(*cfg())
+	for _, params := range []string{"", "x"} {
+		configure(func(c *Config) { c.keyparams = params })
+		keys := make(map[string]string)
+		for _, target := range []string{
+			"/?x=1",
+			"/a%3Fx=1?",
+			"/a%3Fb?x=1",
+			"/a?b%3Fx=1",
+			"/a%2Fb?x=1",
+			"/a/b?x=1",
+		} {
+			u, err := url.ParseRequestURI(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := bufferKey(u)
+			if prev, ok := keys[key]; ok {
+				t.Errorf("keyparams %q: %s and %s share key %s", params, prev, target, key)
+			}
+			keys[key] = target
+		}
+	}
+}
+
+func Test_QueryNormalize(t *testing.T) {
+	defer func(n *regexp.Regexp) { normalizer = n }(normalizer)
+	normalizer = regexp.MustCompile(`/\*.*?\*/|--.*$`)
+	resetStore()
+	defer resetStore()
+
+	for _, q := range []string{
+		"INSERT INTO t VALUES",
+		"INSERT INTO t /* req 1 */ VALUES",
+		"INSERT  INTO t VALUES -- req 2",
+		"/* client */ INSERT INTO t VALUES",
+	} {
+		w := httptest.NewRecorder()
+		dorequest(w, httptest.NewRequest("POST", "/?query="+url.QueryEscape(q)+"&query_id=x", strings.NewReader("(1)")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: want 200; got %d", q, w.Code)
+		}
+	}
+	store.RLock()
+	defer store.RUnlock()
+	if len(store.Req) != 1 {
+		t.Fatalf("want 1 key; got %d", len(store.Req))
+	}
+	for key, buf := range store.Req {
+		if buf.table != "t" || buf.rowcount != 4 {
+			t.Errorf("want table t, 4 rows; got %s, %d", buf.table, buf.rowcount)
+		}
+		if want := "/?query=INSERT+INTO+t+VALUES&query_id=x"; key != want {
+			t.Errorf("key: want %q; got %q", want, key)
+		}
+		if want := "?query=INSERT+INTO+t+VALUES&query_id=x"; buf.uri != want {
+			t.Errorf("uri: want the first query forwarded %q; got %q", want, buf.uri)
+		}
+	}
+}
+
+func Test_Ingest(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	for _, tc := range []struct {
+		target string
+		code   int
+	}{
+		{"/ingest?table=events", http.StatusOK},
+		{"/ingest?table=events&format=jsoneachrow", http.StatusOK},
+		{"/ingest?table=events&format=TSV", http.StatusOK},
+		{"/ingest?table=events%20VALUES", http.StatusBadRequest},
+		{"/ingest?format=TSV", http.StatusBadRequest},
+		{"/ingest?table=events&format=Native", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		doingest(w, httptest.NewRequest("POST", tc.target, strings.NewReader("{\"a\":1}\n")))
+		if w.Code != tc.code {
+			t.Errorf("%s: want %d; got %d", tc.target, tc.code, w.Code)
+		}
+	}
+	store.RLock()
+	defer store.RUnlock()
+	if len(store.Req) != 2 {
+		t.Fatalf("want 2 keys; got %d", len(store.Req))
+	}
+	buf := store.Req["/?query=INSERT+INTO+events+FORMAT+JSONEachRow"]
+	if buf == nil || buf.table != "events" || buf.uri != "?query=INSERT+INTO+events+FORMAT+JSONEachRow" {
+		t.Fatalf("want the JSONEachRow rows buffered under the synthesized query; got %v", buf)
+	}
+	if want := "{\"a\":1}\n{\"a\":1}\n"; string(buf.buffer) != want {
+		t.Errorf("want %q; got %q", want, buf.buffer)
+	}
+	if tsv := store.Req["/?query=INSERT+INTO+events+FORMAT+TSV"]; tsv == nil || tsv.rowcount != 1 {
+		t.Errorf("want the TSV rows buffered under their own key; got %v", tsv)
+	}
+}
+
+func Test_NewlineFormats(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	query := "/?query=INSERT%20INTO%20t%20FORMAT%20JSONEachRow"
+	for _, body := range []string{"{\"a\":1}", "{\"a\":2}\n", "\n\n{\"a\":3}\n{\"a\":4}\r\n\n", "\n"} {
+		w := httptest.NewRecorder()
+		dorequest(w, httptest.NewRequest("POST", query, strings.NewReader(body)))
+	}
+	store.RLock()
+	buf := store.Req["/?query=INSERT%20INTO%20t%20FORMAT%20JSONEachRow"]
+	store.RUnlock()
+	if buf == nil {
+		t.Fatal("want the rows buffered")
+	}
+	if want := "{\"a\":1}\n{\"a\":2}\n{\"a\":3}\n{\"a\":4}\n"; string(buf.buffer) != want {
+		t.Errorf("want %q; got %q", want, buf.buffer)
+	}
+	if buf.rowcount != 4 {
+		t.Errorf("want 4 rows; got %d", buf.rowcount)
+	}
+	for _, tc := range []struct {
+		q       string
+		newline bool
+	}{
+		{"INSERT INTO t FORMAT TSV", true},
+		{"INSERT INTO t FORMAT TabSeparated", true},
+		{"INSERT INTO t FORMAT CSV", true},
+		{"insert into t format JSONEachRow", true},
+		{"INSERT INTO t FORMAT JSONLines", true},
+		{"INSERT INTO t FORMAT NDJSON ", true},
+		{"INSERT INTO t FORMAT TSVWithNames", true},
+		{"INSERT INTO t FORMAT TabSeparatedWithNames", true},
+		{"INSERT INTO t FORMAT CSVWithNames", true},
+		{"INSERT INTO t FORMAT TSVWithNamesAndTypes", true},
+		{"INSERT INTO t FORMAT TabSeparatedWithNamesAndTypes", true},
+		{"INSERT INTO t FORMAT CSVWithNamesAndTypes", true},
+		{"INSERT INTO t FORMAT TSVRaw", true},
+		{"INSERT INTO t FORMAT TabSeparatedRaw", true},
+		{"INSERT INTO t FORMAT TSVRawWithNames", true},
+		{"INSERT INTO t FORMAT TabSeparatedRawWithNames", true},
+		{"INSERT INTO t FORMAT TSVRawWithNamesAndTypes", true},
+		{"INSERT INTO t FORMAT TabSeparatedRawWithNamesAndTypes", true},
+		{"INSERT INTO t FORMAT JSONStringsEachRow", true},
+		{"INSERT INTO t FORMAT JSONCompactEachRow", true},
+		{"INSERT INTO t FORMAT JSONCompactStringsEachRow", true},
+		{"INSERT INTO t FORMAT JSONCompactEachRowWithNames", true},
+		{"INSERT INTO t FORMAT JSONCompactEachRowWithNamesAndTypes", true},
+		{"INSERT INTO t FORMAT JSONCompactStringsEachRowWithNames", true},
+		{"INSERT INTO t FORMAT JSONCompactStringsEachRowWithNamesAndTypes", true},
+		{"INSERT INTO t FORMAT LineAsString", true},
+		{"INSERT INTO t VALUES", false},
+		{"INSERT INTO t FORMAT Values", false},
+		{"INSERT INTO t FORMAT JSON", false},
+		{"INSERT INTO t FORMAT Native", false},
+	} {
+		if _, sep, _ := detectFormat(tc.q); (string(sep) == "\n") != tc.newline {
+			t.Errorf("%s: want newline format %v; got separator %q", tc.q, tc.newline, sep)
+		}
+	}
+}
+
+func Test_Multipart(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, r.URL.Query().Get("query")+" "+string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+	resetStore()
+	defer resetStore()
+
+	upload := func(target string, fields map[string]string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, value := range fields {
+			if name == "data" {
+				fw, _ := mw.CreateFormFile(name, "rows.txt")
+				fw.Write([]byte(value))
+			} else {
+				mw.WriteField(name, value)
+			}
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", target, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		dorequest(w, req)
+		return w.Code
+	}
+	if code := upload("/", map[string]string{"query": "INSERT INTO mp VALUES", "data": "(1),(2)"}); code != http.StatusOK {
+		t.Fatalf("query field: want 200; got %d", code)
+	}
+	if code := upload("/?query=INSERT+INTO+mp+VALUES", map[string]string{"query": "INSERT INTO other VALUES", "data": "(3)"}); code != http.StatusOK {
+		t.Fatalf("url query: want 200; got %d", code)
+	}
+	if code := upload("/", map[string]string{"query": "INSERT INTO mp VALUES"}); code != http.StatusBadRequest {
+		t.Errorf("no data field: want 400; got %d", code)
+	}
+	if code := upload("/", map[string]string{"query": "SELECT 1", "data": "(4)"}); code != http.StatusBadRequest {
+		t.Errorf("not an insert: want 400; got %d", code)
+	}
+
+	store.RLock()
+	buf := store.Req["/?query=INSERT+INTO+mp+VALUES"]
+	keys := len(store.Req)
+	store.RUnlock()
+	if keys != 1 || buf == nil || string(buf.buffer) != "(1),(2),(3)" || buf.rowcount != 3 {
+		t.Fatalf("want one key with 3 rows; got %d keys, %v", keys, buf)
+	}
+	store.flush()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0] != "INSERT INTO mp VALUES (1),(2),(3)" {
+		t.Errorf("want the rows forwarded as one insert; got %q", sent)
+	}
+}
+
+func Test_GracefulShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractTable("?"+r.URL.RawQuery) != "inflight" {
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+	resetStore()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(dorequest)}
+	go server.Serve(l)
+
+	// a POST with its body half sent when the shutdown starts
+	body, bodyw := io.Pipe()
+	posted := make(chan int)
+	go func() {
+		resp, err := http.Post("http://"+l.Addr().String()+"/?query=INSERT%20INTO%20inflight%20VALUES", "text/plain", body)
+		if err != nil {
+			posted <- 0
+			return
+		}
+		resp.Body.Close()
+		posted <- resp.StatusCode
+	}()
+	bodyw.Write([]byte("(1"))
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		gracefulShutdown(server, 2*time.Second)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("want new connections refused during shutdown")
+	}
+	bodyw.Write([]byte(")"))
+	bodyw.Close()
+
+	if code := <-posted; code != http.StatusOK {
+		t.Errorf("in-flight POST: want 200; got %d", code)
+	}
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0] != "(1)" {
+		t.Errorf("want the in-flight insert flushed; got %q", sent)
+	}
+}
+
+func Test_SignalShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, extractTable("?"+r.URL.RawQuery)+" "+string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.sigintimeout = ch.URL, 1 })
+
+	for _, tc := range []struct {
+		sig    os.Signal
+		posted bool // the POST in progress is finished and flushed
+	}{
+		{syscall.SIGTERM, true},
+		{os.Interrupt, false},
+	} {
+		resetStore()
+		mu.Lock()
+		sent = nil
+		mu.Unlock()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(dorequest)}
+		go server.Serve(l)
+		key := "?query=INSERT%20INTO%20buffered%20VALUES"
+		store.add(key, key, "buffered", []byte("(1)"), []byte(","), 1)
+
+		body, bodyw := io.Pipe()
+		posted := make(chan bool)
+		go func() {
+			resp, err := http.Post("http://"+l.Addr().String()+"/?query=INSERT%20INTO%20inflight%20VALUES", "text/plain", body)
+			if err == nil {
+				resp.Body.Close()
+			}
+			posted <- err == nil && resp.StatusCode == http.StatusOK
+		}()
+		bodyw.Write([]byte("(2"))
+		time.Sleep(50 * time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			shutdownFor(server, tc.sig)()
+			close(done)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		bodyw.Write([]byte(")"))
+		bodyw.Close()
+		if ok := <-posted; ok != tc.posted {
+			t.Errorf("%v: want the POST in progress finished %v; got %v", tc.sig, tc.posted, ok)
+		}
+		<-done
+
+		want := []string{"buffered (1)"}
+		if tc.posted {
+			want = append(want, "inflight (2)")
+		}
+		mu.Lock()
+		sort.Strings(sent)
+		if strings.Join(sent, ";") != strings.Join(want, ";") {
+			t.Errorf("%v: want %q flushed; got %q", tc.sig, want, sent)
+		}
+		mu.Unlock()
+	}
+}
+
+func Test_AdminPort(t *testing.T) {
+	ingest, admin := http.NewServeMux(), http.NewServeMux()
+	routes(ingest, admin)
+	resetStore()
+	defer resetStore()
+	for _, c := range []struct {
+		mux    *http.ServeMux
+		method string
+		path   string
+		want   int
+	}{
+		{ingest, "POST", "/?query=INSERT%20INTO%20t%20VALUES", http.StatusOK},
+		{ingest, "GET", "/ready", http.StatusOK},
+		{ingest, "GET", "/status", http.StatusNotFound},
+		{ingest, "POST", "/pause", http.StatusNotFound},
+		{admin, "GET", "/status", http.StatusOK},
+		{admin, "GET", "/ready", http.StatusOK},
+		{admin, "GET", "/buffers", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		c.mux.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader("(1)")))
+		if w.Code != c.want {
+			t.Errorf("%s %s: want %d; got %d", c.method, c.path, c.want, w.Code)
+		}
+	}
+}
+
+func Test_Pprof(t *testing.T) {
+	defer restoreConfig(*cfg())
+	for _, on := range []bool{false, true} {
+		configure(func(c *Config) { c.pprof = on })
+		mux := http.NewServeMux()
+		routes(mux, mux)
+		want := http.StatusNotFound
+		if on {
+			want = http.StatusOK
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/heap?debug=1", nil))
+		if w.Code != want {
+			t.Errorf("pprof %v: want %d; got %d", on, want, w.Code)
+		}
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("expvar: want 200; got %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+// metricSender is the graphite client, *graphite.Graphite
+type metricSender interface {
+	SendMetrics(metrics []graphite.Metric) error
+}
+
+// gaugeMetrics are the metrics with a value at a time, the rest are counters
+var gaugeMetrics = map[string]bool{
+	"heap_alloc": true, "next_gc": true, "num_gc": true, "buffered_bytes": true, "flush_queue": true,
+	"batch_age_max": true, "coalescing_ratio": true, "out_rate": true,
+	"ingest_ms_p50": true, "ingest_ms_p95": true, "ingest_ms_p99": true,
+	"forward_ms_p50": true, "forward_ms_p95": true, "forward_ms_p99": true, "healthy": true,
+}
+
+// isGauge is true for a gauge metric name, with or without the prefix
+func isGauge(name string) bool {
+	return gaugeMetrics[name[strings.LastIndex(name, ".")+1:]]
+}
+
+// Metrics sends metrics from a background goroutine so a slow or unreachable
+// graphite never blocks inserts, metrics over the queue size are dropped.
+// A batch of metrics goes to graphite in one write
+type Metrics struct {
+	mu      sync.Mutex
+	sender  metricSender
+	queue   chan []graphite.Metric
+	flushed chan chan struct{}
+	dropped uint64
+}
+
+// aggregate sums the counters and keeps the last gauge values between sends
+type aggregate struct {
+	sums   map[string]float64
+	gauges map[string]string
+}
+
+// MetricBatch gathers metrics with one timestamp to queue them together
+type MetricBatch struct {
+	metrics []graphite.Metric
+	now     int64
+}
+
+// logSink is where LogQueue sends the messages, *Graylog or *Syslog
+type logSink interface {
+	Name() string
+	Dial(attempts int, backoff Backoff) error
+	Log(level uint8, data ...interface{})
+}
+
+// LogQueue sends graylog or syslog messages from a background goroutine, like Metrics
+type LogQueue struct {
+	queue   chan logEntry
+	dropped uint64
+}
+
+type logEntry struct {
+	level uint8
+	data  []interface{}
+}
+
+var gr = NewMetrics(graphite.NewGraphiteNop("", 0), 10000)
+var logQueue *LogQueue
+
+func NewMetrics(sender metricSender, size int) *Metrics {
+	return NewMetricsEvery(sender, size, 0)
+}
+
+// NewMetricsEvery aggregates the metrics in process and sends them every
+// interval, counters summed and gauges last, one write instead of one per
+// request. With 0 every batch is sent as it comes
+func NewMetricsEvery(sender metricSender, size int, interval time.Duration) *Metrics {
+	m := &Metrics{sender: sender, queue: make(chan []graphite.Metric, size), flushed: make(chan chan struct{})}
+	go func() {
+		var tick <-chan time.Time
+		if interval > 0 {
+			tick = time.Tick(interval)
+		}
+		agg := &aggregate{sums: make(map[string]float64), gauges: make(map[string]string)}
+		take := func(metrics []graphite.Metric) {
+			if interval == 0 {
+				m.send(metrics)
+				return
+			}
+			agg.add(metrics)
+		}
+		for {
+			select {
+			case metrics := <-m.queue:
+				take(metrics)
+			case <-tick:
+				m.send(agg.flush(time.Now().Unix()))
+			case done := <-m.flushed:
+				for queued := len(m.queue); queued > 0; queued-- {
+					take(<-m.queue)
+				}
+				m.send(agg.flush(time.Now().Unix()))
+				close(done)
+			}
+		}
+	}()
+	return m
+}
+
+// Flush sends the queued and the aggregated metrics at once, on shutdown.
+// It waits for graphite at most timeout
+func (m *Metrics) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	select {
+	case m.flushed <- done:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// send writes the metrics, a sender that can reconnect (graphite over tcp)
+// is connected again after an error and the write tried once more
+func (m *Metrics) send(metrics []graphite.Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+	m.mu.Lock()
+	sender := m.sender
+	m.mu.Unlock()
+	if err := sender.SendMetrics(metrics); err != nil {
+		if c, ok := sender.(interface{ Connect() error }); ok && c.Connect() == nil {
+			sender.SendMetrics(metrics)
+		}
+	}
+}
+
+// add merges the metrics, values that are not numbers are kept as gauges
+func (a *aggregate) add(metrics []graphite.Metric) {
+	for _, metric := range metrics {
+		value, err := strconv.ParseFloat(metric.Value, 64)
+		if err != nil || isGauge(metric.Name) {
+			a.gauges[metric.Name] = metric.Value
+			continue
+		}
+		a.sums[metric.Name] += value
+	}
+}
+
+// flush returns the aggregated metrics sorted by name and starts over
+func (a *aggregate) flush(now int64) []graphite.Metric {
+	metrics := make([]graphite.Metric, 0, len(a.sums)+len(a.gauges))
+	for name, sum := range a.sums {
+		metrics = append(metrics, graphite.NewMetric(name, strconv.FormatFloat(sum, 'f', -1, 64), now))
+	}
+	for name, value := range a.gauges {
+		metrics = append(metrics, graphite.NewMetric(name, value, now))
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	a.sums, a.gauges = make(map[string]float64), make(map[string]string)
+	return metrics
+}
+
+// SetSender switches graphite, the queued metrics go to the new one
+func (m *Metrics) SetSender(sender metricSender) {
+	m.mu.Lock()
+	m.sender = sender
+	m.mu.Unlock()
+}
+
+// graphiteSender returns the graphite client for -graphitehost, the statsd one
+// for -statsdhost, a no-op one when both are empty. Over tcp the client is
+// returned with the connect error too, it connects again on the next send
+func graphiteSender() (metricSender, error) {
+	switch {
+	case cfg().statsdhost != "":
+		sender, err := NewStatsd(cfg().statsdhost, cfg().statsdprefix, cfg().statsdtags, hostname)
+		if err != nil {
+			return nil, err
+		}
+		return sender, nil
+	case cfg().graphitehost == "":
+		return graphite.NewGraphiteNop(cfg().graphitehost, cfg().graphiteport), nil
+	case cfg().graphiteproto == "tcp":
+		sender := &tcpGraphite{host: cfg().graphitehost, port: cfg().graphiteport}
+		return sender, sender.Connect()
+	}
+	sender, err := graphite.NewGraphiteUDP(cfg().graphitehost, cfg().graphiteport)
+	if err != nil {
+		return nil, err
+	}
+	return sender, nil
+}
+
+// tcpGraphite is graphite over tcp that dials again on the next send after a
+// failed connect, so graphite down at start doesn't stop proxyhouse
+type tcpGraphite struct {
+	host string
+	port int
+	conn *graphite.Graphite
+}
+
+// Connect dials graphite, closing the last connection
+func (g *tcpGraphite) Connect() error {
+	if g.conn != nil {
+		g.conn.Disconnect()
+		g.conn = nil
+	}
+	conn, err := graphite.NewGraphite(g.host, g.port)
+	if err != nil {
+		return err
+	}
+	g.conn = conn
+	return nil
+}
+
+// SendMetrics writes the metrics, dialing first without a connection
+func (g *tcpGraphite) SendMetrics(metrics []graphite.Metric) error {
+	if g.conn == nil {
+		if err := g.Connect(); err != nil {
+			return err
+		}
+	}
+	return g.conn.SendMetrics(metrics)
+}
+
+// SimpleSend queues the metric, it never blocks
+func (m *Metrics) SimpleSend(stat string, value string) error {
+	m.SendBatch([]graphite.Metric{graphite.NewMetric(stat, value, time.Now().Unix())})
+	return nil
+}
+
+// SendBatch queues the metrics as one send, it never blocks
+func (m *Metrics) SendBatch(metrics []graphite.Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+	select {
+	case m.queue <- metrics:
+	default:
+		atomic.AddUint64(&m.dropped, uint64(len(metrics)))
+	}
+}
+
+// NewMetricBatch starts a batch for SendBatch
+func NewMetricBatch() *MetricBatch {
+	return &MetricBatch{now: time.Now().Unix()}
+}
+
+// Add appends the metric to the batch
+func (b *MetricBatch) Add(stat string, value string) {
+	b.metrics = append(b.metrics, graphite.NewMetric(stat, value, b.now))
+}
+
+// Dropped returns the number of metrics dropped on a full queue
+func (m *Metrics) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// NewLogQueue connects to the sink in the background, up to attempts times with
+// the backoff, messages logged meanwhile wait in the queue. If the sink stays
+// unreachable they go to stdout, so a graylog outage never holds the start
+func NewLogQueue(sink logSink, size int, attempts int, backoff Backoff) *LogQueue {
+	q := &LogQueue{queue: make(chan logEntry, size)}
+	go func() {
+		if err := sink.Dial(attempts, backoff); err != nil {
+			writeLog(logout, LEVEL_WARN, sink.Name()+" unreachable, logging to stdout:", err)
+			sink = nil
+		}
+		for entry := range q.queue {
+			if sink == nil {
+				writeLog(logout, entry.level, entry.data...)
+				continue
+			}
+			sink.Log(entry.level, entry.data...)
+		}
+	}()
+	return q
+}
+
+// Log queues the message, it never blocks
+func (q *LogQueue) Log(level uint8, data ...interface{}) {
+	select {
+	case q.queue <- logEntry{level, data}:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+// Dropped returns the number of messages dropped on a full queue
+func (q *LogQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+// blockedSender never returns, like an unreachable graphite
+type blockedSender chan struct{}
+
+func (b blockedSender) SendMetrics(metrics []graphite.Metric) error {
+	<-b
+	return nil
+}
+
+func TestMetricsBlockedBackend(t *testing.T) {
+	blocked := make(blockedSender)
+	defer close(blocked)
+	defer func(m *Metrics) { gr = m }(gr)
+	gr = NewMetrics(blocked, 10)
+	resetStore()
+	defer resetStore()
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", strings.NewReader("(1)")))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("want inserts not blocked by metrics; took %s", elapsed)
+	}
+	if gr.Dropped() == 0 {
+		t.Errorf("want dropped metrics on a full queue")
+	}
+}
+
+// batchSender keeps every batch sent
+type batchSender chan []graphite.Metric
+
+func (b batchSender) SendMetrics(metrics []graphite.Metric) error {
+	b <- metrics
+	return nil
+}
+
+func TestSentMetricsBatch(t *testing.T) {
+	sent := make(batchSender, 10)
+	defer func(m *Metrics, h string, c Config) { gr, hostname = m, h; restoreConfig(c) }(gr, hostname, *cfg())
+	gr = NewMetrics(sent, 10)
+	hostname = "host1"
+	configure(func(c *Config) { c.graphiteprefix = "ph" })
+
+	sentMetrics("events", 3, 100)
+	var batch []graphite.Metric
+	select {
+	case batch = <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("want a batch sent")
+	}
+	got := make([]string, len(batch))
+	for i, m := range batch {
+		got[i] = m.Name + " " + m.Value
+	}
+	want := []string{
+		"ph.rows_sent 3",
+		"ph.requests_sent 1",
+		"ph.byhost.host1.rows_sent 3",
+		"ph.byhost.host1.requests_sent 1",
+		"ph.bytable.events.rows_sent 3",
+		"ph.bytable.events.requests_sent 1",
+		"ph.bytes_sent 100",
+		"ph.byhost.host1.bytes_sent 100",
+		"ph.bytable.events.bytes_sent 100",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want one batch:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	select {
+	case extra := <-sent:
+		t.Errorf("want a single send; got another batch %v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMetricsAggregate(t *testing.T) {
+	sent := make(batchSender, 10)
+	defer func(h string, c Config) { hostname = h; restoreConfig(c) }(hostname, *cfg())
+	hostname = "host1"
+	configure(func(c *Config) { c.graphiteprefix = "ph" })
+	m := NewMetricsEvery(sent, 100, 100*time.Millisecond)
+	m.SimpleSend("ph.flush_queue", "7")
+	m.SimpleSend("ph.send_retries", "1")
+	m.SimpleSend("ph.send_retries", "1")
+	m.SimpleSend("ph.flush_queue", "3")
+	m.SimpleSend("ph.coalescing_ratio", "2.5")
+	m.SimpleSend("ph.send_retries", "1")
+
+	var batch []graphite.Metric
+	select {
+	case batch = <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("want an aggregated batch")
+	}
+	got := make([]string, len(batch))
+	for i, metric := range batch {
+		got[i] = metric.Name + " " + metric.Value
+	}
+	if want := "ph.coalescing_ratio 2.5,ph.flush_queue 3,ph.send_retries 3"; strings.Join(got, ",") != want {
+		t.Errorf("want %q; got %q", want, strings.Join(got, ","))
+	}
+	select {
+	case extra := <-sent:
+		t.Errorf("want nothing sent without new metrics; got %v", extra)
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	// shutdown sends what is aggregated before the interval
+	m = NewMetricsEvery(sent, 100, time.Hour)
+	m.SimpleSend("ph.send_retries", "1")
+	m.SimpleSend("ph.send_retries", "1")
+	m.Flush(time.Second)
+	select {
+	case batch = <-sent:
+		if len(batch) != 1 || batch[0].Value != "2" {
+			t.Errorf("flush: want ph.send_retries 2; got %v", batch)
+		}
+	default:
+		t.Error("flush: want the aggregated metrics sent")
+	}
+}
+
+func TestGraphiteTCP(t *testing.T) {
+	defer restoreConfig(*cfg())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(func(c *Config) {
+		c.graphitehost, c.graphiteproto, c.graphiteport = "127.0.0.1", "tcp", ln.Addr().(*net.TCPAddr).Port
+	})
+	ln.Close()
+	sender, err := graphiteSender()
+	if err == nil || sender == nil {
+		t.Fatalf("graphite down: want the sender and the error; got %v %v", sender, err)
+	}
+
+	// the next send dials again
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sender.(*tcpGraphite).port = ln.Addr().(*net.TCPAddr).Port
+	if err := sender.SendMetrics([]graphite.Metric{graphite.NewMetric("ph.x", "1", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if line != "ph.x 1 1\n" {
+		t.Errorf("want the metric line; got %q", line)
+	}
+}
+
+// lockedWriter is a bytes.Buffer safe to read while the log queue writes
+type lockedWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *lockedWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestLogQueueGraylogDown(t *testing.T) {
+	out := &lockedWriter{}
+	defer func(w io.Writer) { logout = w }(logout)
+	logout = out
+
+	// the port is out of range, every dial fails
+	gl := NewGraylog(Graylog{Host: "127.0.0.1", Port: 70000})
+	start := time.Now()
+	q := NewLogQueue(gl, 10, 3, Backoff{Base: 20 * time.Millisecond, Max: 20 * time.Millisecond})
+	q.Log(LEVEL_INFO, "Start proxyhouse")
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("want start not blocked by graylog; took %v", elapsed)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(out.String(), "Start proxyhouse") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	got := out.String()
+	if !strings.Contains(got, "Graylog unreachable") || !strings.Contains(got, "Start proxyhouse") {
+		t.Errorf("want a warning and the start message on stdout; got %q", got)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const promTablesSize = 1000 // tables with their own labels, the rest are counted as "other"
+
+// TableCounters keeps the graphite counters by table for /metrics, graphite
+// gets increments while prometheus scrapes totals
+type TableCounters struct {
+	sync.Mutex
+	counts map[string]map[string]uint64 // name -> table -> total
+	tables map[string]bool
+	sent   map[string]time.Time // last send by table
+}
+
+var tableCounters = newTableCounters()
+
+func newTableCounters() *TableCounters {
+	return &TableCounters{counts: make(map[string]map[string]uint64), tables: make(map[string]bool), sent: make(map[string]time.Time)}
+}
+
+// promCounters are the /metrics counters by table with their help, in output order
+var promCounters = [][2]string{
+	{"requests_received", "Requests received from clients."},
+	{"bytes_received", "Body bytes received from clients."},
+	{"requests_sent", "Requests sent to clickhouse."},
+	{"rows_sent", "Rows sent to clickhouse."},
+	{"bytes_sent", "Bytes sent to clickhouse."},
+	{"ch_errors", "Failed requests to clickhouse."},
+}
+
+var labelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Add adds v to the counter of the table
+func (tc *TableCounters) Add(name, table string, v uint64) {
+	tc.Lock()
+	defer tc.Unlock()
+	if !tc.tables[table] {
+		if len(tc.tables) >= promTablesSize {
+			table = "other"
+		}
+		tc.tables[table] = true
+	}
+	if tc.counts[name] == nil {
+		tc.counts[name] = make(map[string]uint64)
+	}
+	tc.counts[name][table] += v
+}
+
+// Sent records a send of the table to clickhouse
+func (tc *TableCounters) Sent(table string, now time.Time) {
+	tc.Lock()
+	defer tc.Unlock()
+	if !tc.tables[table] && len(tc.tables) >= promTablesSize {
+		table = "other"
+	}
+	tc.sent[table] = now
+}
+
+// LastSent returns the last send time by table
+func (tc *TableCounters) LastSent() map[string]time.Time {
+	tc.Lock()
+	defer tc.Unlock()
+	sent := make(map[string]time.Time, len(tc.sent))
+	for table, at := range tc.sent {
+		sent[table] = at
+	}
+	return sent
+}
+
+// Get returns the totals of the counter by table
+func (tc *TableCounters) Get(name string) map[string]uint64 {
+	tc.Lock()
+	defer tc.Unlock()
+	totals := make(map[string]uint64, len(tc.counts[name]))
+	for table, v := range tc.counts[name] {
+		totals[table] = v
+	}
+	return totals
+}
+
+// showmetrics serves the counters, buffer, connection and batch size stats in
+// the prometheus text format
+func showmetrics(w http.ResponseWriter, r *http.Request) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	host = labelValue.Replace(host)
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	for _, c := range promCounters {
+		name := "proxyhouse_" + c[0] + "_total"
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, c[1], name)
+		totals := tableCounters.Get(c[0])
+		tables := make([]string, 0, len(totals))
+		for table := range totals {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			fmt.Fprintf(w, "%s{host=\"%s\",table=\"%s\"} %d\n", name, host, labelValue.Replace(table), totals[table])
+		}
+	}
+
+	keys, size, _ := store.stats()
+	promMetric(w, "proxyhouse_buffer_bytes", "gauge", "Bytes in the buffer.", host, size)
+	promMetric(w, "proxyhouse_buffer_keys", "gauge", "Keys in the buffer.", host, keys)
+	promMetric(w, "proxyhouse_error_files", "gauge", "Batches in the errors dir waiting for resend.", host, errorCount())
+	promMetric(w, "proxyhouse_inflight_bytes", "gauge", "Bytes being sent to clickhouse.", host, inflight.Bytes())
+	promMetric(w, "proxyhouse_connections_total", "counter", "Client connections accepted.", host, atomic.LoadUint32(&totalConnections))
+	fmt.Fprint(w, "# HELP proxyhouse_connections Open client connections by state.\n# TYPE proxyhouse_connections gauge\n")
+	fmt.Fprintf(w, "proxyhouse_connections{host=\"%s\",state=\"open\"} %d\n", host, atomic.LoadInt32(&currConnections))
+	fmt.Fprintf(w, "proxyhouse_connections{host=\"%s\",state=\"idle\"} %d\n", host, atomic.LoadInt32(&idleConnections))
+	promHistogram(w, "proxyhouse_batch_bytes", "Sent batches by size in bytes.", host, batchBytes)
+	promHistogram(w, "proxyhouse_batch_rows", "Sent batches by rows.", host, batchRows)
+	promTableHistograms(w, "proxyhouse_ingest_latency_ms", "Client request handling time in milliseconds.", host, ingestLatency)
+	promTableHistograms(w, "proxyhouse_forward_latency_ms", "Clickhouse round trip time in milliseconds, with the inline retries.", host, forwardLatency)
+	if cfg().ejectafter > 0 {
+		fmt.Fprint(w, "# HELP proxyhouse_upstream_healthy 1 for an upstream in the rotation, 0 for an ejected one.\n# TYPE proxyhouse_upstream_healthy gauge\n")
+		for _, u := range upstreamHealth.States() {
+			healthy := 1
+			if u[1] == "ejected" {
+				healthy = 0
+			}
+			fmt.Fprintf(w, "proxyhouse_upstream_healthy{host=\"%s\",upstream=\"%s\"} %d\n", host, labelValue.Replace(hidePassword(u[0])), healthy)
+		}
+	}
+}
+
+// promMetric writes a metric with the host label
+func promMetric(w io.Writer, name, kind, help, host string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{host=\"%s\"} %d\n", name, help, name, kind, name, host, value)
+}
+
+// promHistogram writes the histogram with cumulative le buckets
+func promHistogram(w io.Writer, name, help, host string, h *Histogram) {
+	bounds, counts, sum := h.Cumulative()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range bounds {
+		fmt.Fprintf(w, "%s_bucket{host=\"%s\",le=\"%d\"} %d\n", name, host, bound, counts[i])
+	}
+	count := counts[len(counts)-1]
+	fmt.Fprintf(w, "%s_bucket{host=\"%s\",le=\"+Inf\"} %d\n", name, host, count)
+	fmt.Fprintf(w, "%s_sum{host=\"%s\"} %d\n%s_count{host=\"%s\"} %d\n", name, host, sum, name, host, count)
+}
+
+// promTableHistograms writes the histograms with a table label
+func promTableHistograms(w io.Writer, name, help, host string, th *TableHistograms) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	histograms := th.Get()
+	tables := make([]string, 0, len(histograms))
+	for table := range histograms {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		bounds, counts, sum := histograms[table].Cumulative()
+		labels := fmt.Sprintf("host=\"%s\",table=\"%s\"", host, labelValue.Replace(table))
+		for i, bound := range bounds {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%d\"} %d\n", name, labels, bound, counts[i])
+		}
+		count := counts[len(counts)-1]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, count)
+		fmt.Fprintf(w, "%s_sum{%s} %d\n%s_count{%s} %d\n", name, labels, sum, name, labels, count)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	defer func(tc *TableCounters) { tableCounters = tc }(tableCounters)
+	tableCounters = newTableCounters()
+	defer func(l *TableHistograms) { ingestLatency = l }(ingestLatency)
+	ingestLatency = newTableHistograms("10,100")
+	ingestLatency.Observe("events", 20*time.Millisecond)
+	resetStore()
+	defer resetStore()
+	receivedMetrics("events", 10)
+	receivedMetrics("events", 5)
+	sentMetrics("events", 3, 15)
+	errorMetrics("logs")
+	key := "?query=INSERT%20INTO%20events%20VALUES"
+	store.add(key, key, "events", []byte("(1)"), []byte(","), 1)
+
+	w := httptest.NewRecorder()
+	showmetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	host, _ := os.Hostname()
+	page := w.Body.String()
+	for _, want := range []string{
+		"# TYPE proxyhouse_requests_received_total counter\n",
+		fmt.Sprintf("proxyhouse_requests_received_total{host=%q,table=\"events\"} 2\n", host),
+		fmt.Sprintf("proxyhouse_bytes_received_total{host=%q,table=\"events\"} 15\n", host),
+		fmt.Sprintf("proxyhouse_rows_sent_total{host=%q,table=\"events\"} 3\n", host),
+		fmt.Sprintf("proxyhouse_ch_errors_total{host=%q,table=\"logs\"} 1\n", host),
+		fmt.Sprintf("proxyhouse_buffer_bytes{host=%q} 3\n", host),
+		fmt.Sprintf("proxyhouse_buffer_keys{host=%q} 1\n", host),
+		fmt.Sprintf("proxyhouse_connections{host=%q,state=\"open\"}", host),
+		"# TYPE proxyhouse_batch_bytes histogram\n",
+		fmt.Sprintf("proxyhouse_batch_rows_bucket{host=%q,le=\"+Inf\"}", host),
+		"# TYPE proxyhouse_ingest_latency_ms histogram\n",
+		fmt.Sprintf("proxyhouse_ingest_latency_ms_bucket{host=%q,table=\"events\",le=\"10\"} 0\n", host),
+		fmt.Sprintf("proxyhouse_ingest_latency_ms_bucket{host=%q,table=\"events\",le=\"100\"} 1\n", host),
+		fmt.Sprintf("proxyhouse_ingest_latency_ms_sum{host=%q,table=\"events\"} 20\n", host),
+		"# TYPE proxyhouse_forward_latency_ms histogram\n",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("want %q in:\n%s", want, page)
+		}
+	}
+}
+
+func TestTableCountersLimit(t *testing.T) {
+	tc := newTableCounters()
+	for i := 0; i < promTablesSize+5; i++ {
+		tc.Add("rows_sent", fmt.Sprintf("t%d", i), 1)
+	}
+	tc.Add("rows_sent", "t0", 1)
+	totals := tc.Get("rows_sent")
+	if len(totals) != promTablesSize+1 || totals["other"] != 5 || totals["t0"] != 2 {
+		t.Errorf("want %d tables and other with 5, t0 kept; got %d, other %d, t0 %d", promTablesSize, len(totals), totals["other"], totals["t0"])
+	}
+}
+
+func TestHistogramCumulative(t *testing.T) {
+	h := mustHistogram("10,100")
+	for _, v := range []int{5, 50, 60, 500} {
+		h.Observe(v)
+	}
+	bounds, counts, sum := h.Cumulative()
+	if fmt.Sprint(bounds, counts, sum) != "[10 100] [1 3 4] 615" {
+		t.Errorf("want [10 100] [1 3 4] 615; got %v %v %d", bounds, counts, sum)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addrs []byte) string {
+		header := append([]byte{}, proxyV2Sig...)
+		header = append(header, 0x20|cmd, fam, 0, 0)
+		binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+		return string(append(header, addrs...))
+	}
+	ipv4 := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x1f, 0x90, 0, 80}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x1f, 0x90, 0, 80)
+	for _, tc := range []struct {
+		header, want string
+	}{
+		{"PROXY TCP4 192.0.2.1 10.0.0.1 8080 80\r\n", "192.0.2.1:8080"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 8080 80\r\n", "[2001:db8::1]:8080"},
+		{"PROXY UNKNOWN\r\n", "<nil>"},
+		{v2(1, 0x11, ipv4), "192.0.2.1:8080"},
+		{v2(1, 0x21, ipv6), "[2001:db8::1]:8080"},
+		{v2(1, 0x11, append(ipv4, 1, 0, 1, 'x')), "192.0.2.1:8080"},
+		{v2(0, 0x00, nil), "<nil>"},
+		{"PROXY TCP4 bad 10.0.0.1 8080 80\r\n", "error"},
+		{"PROXY TCP4 192.0.2.1 10.0.0.1 8080 80\n", "error"},
+		{"POST / HTTP/1.1\r\n", "error"},
+		{v2(1, 0x11, ipv4[:8]), "error"},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.header + "POST / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(r)
+		got := "error"
+		if err == nil {
+			got = "<nil>"
+			if addr != nil {
+				got = addr.String()
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%q: want %s; got %s %v", tc.header, tc.want, got, err)
+		}
+		if rest, _ := r.ReadString('\n'); err == nil && rest != "POST / HTTP/1.1\r\n" {
+			t.Errorf("%q: want the request after the header; got %q", tc.header, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	go server.Serve(&proxyListener{Listener: ln, timeout: time.Second})
+	defer server.Close()
+
+	request := func(header string) string {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(header + "GET / HTTP/1.0\r\n\r\n"))
+		resp, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return err.Error()
+		}
+		return string(resp)
+	}
+	if got := request("PROXY TCP4 192.0.2.1 10.0.0.1 8080 80\r\n"); !strings.HasSuffix(got, "\r\n\r\n192.0.2.1:8080") {
+		t.Errorf("want the client address; got %q", got)
+	}
+	if got := request(""); got != "" {
+		t.Errorf("no header: want the connection closed; got %q", got)
+	}
+}
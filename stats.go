@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tableErrorsSize  = 100
+	tableErrorsDecay = time.Minute
+	recentErrorsSize = 10   // responses kept by table
+	recentErrorBody  = 1024 // bytes kept of a response body
+	coalesceWindow   = time.Minute
+)
+
+// TableErrors counts recent send errors by table, the counts are halved
+// every tableErrorsDecay so they reflect recent failures only
+type TableErrors struct {
+	sync.Mutex
+	count   map[string]int
+	decayed time.Time
+}
+
+// TableCount is a table with its error count
+type TableCount struct {
+	Table string
+	Count int
+}
+
+// RecentError is an error response of the upstream
+type RecentError struct {
+	Time   time.Time `json:"time"`
+	Status int       `json:"status"`
+	Query  string    `json:"query"`
+	Body   string    `json:"body"`
+}
+
+// RecentErrors keeps the last recentErrorsSize error responses by table,
+// for at most tableErrorsSize tables
+type RecentErrors struct {
+	sync.Mutex
+	tables map[string][]RecentError
+}
+
+// Coalescing is the in/out requests ratio over the last window, every out
+// request creates a part in clickhouse, so a low ratio means too many parts
+type Coalescing struct {
+	sync.Mutex
+	in, out uint32
+	at      time.Time
+	ratio   float64 // in requests per out request
+	outRate float64 // out requests per second
+}
+
+// Histogram counts values by buckets, a value goes to the first bucket
+// it is less or equal to, values over the last bucket go to inf
+type Histogram struct {
+	bounds []int
+	counts []uint64 // len(bounds)+1, the last one is inf
+	sum    uint64
+	last   []uint64 // counts at the last Interval
+}
+
+// TableHistograms are latency histograms by table, in milliseconds, tables
+// over promTablesSize share "other"
+type TableHistograms struct {
+	sync.Mutex
+	buckets    string
+	histograms map[string]*Histogram
+}
+
+// MemStats is the last runtime memory sample with the buffered bytes at that
+// moment, to see when buffering drives GC pressure
+type MemStats struct {
+	sync.Mutex
+	sampled     bool
+	heapAlloc   uint64
+	nextGC      uint64
+	numGC       uint32
+	bufferBytes int
+}
+
+var tableErrors = &TableErrors{count: make(map[string]int)}
+
+var memStats = &MemStats{}
+
+var coalescing = &Coalescing{}
+
+var recentErrors = &RecentErrors{tables: make(map[string][]RecentError)}
+
+func (te *TableErrors) decay(now time.Time) {
+	if now.Sub(te.decayed) < tableErrorsDecay {
+		return
+	}
+	te.decayed = now
+	for table, count := range te.count {
+		if count/2 == 0 {
+			delete(te.count, table)
+		} else {
+			te.count[table] = count / 2
+		}
+	}
+}
+
+// Add counts an error for the table, on a full map the least failing table is dropped
+func (te *TableErrors) Add(table string) {
+	te.Lock()
+	defer te.Unlock()
+	te.decay(time.Now())
+	if _, ok := te.count[table]; !ok && len(te.count) >= tableErrorsSize {
+		min := ""
+		for t, c := range te.count {
+			if min == "" || c < te.count[min] {
+				min = t
+			}
+		}
+		delete(te.count, min)
+	}
+	te.count[table]++
+}
+
+// Top returns up to n tables with the most errors
+func (te *TableErrors) Top(n int) []TableCount {
+	te.Lock()
+	te.decay(time.Now())
+	top := make([]TableCount, 0, len(te.count))
+	for table, count := range te.count {
+		top = append(top, TableCount{table, count})
+	}
+	te.Unlock()
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count == top[j].Count {
+			return top[i].Table < top[j].Table
+		}
+		return top[i].Count > top[j].Count
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Add keeps the response for the table, the body is truncated and passwords are
+// hidden. On a full map the table with the oldest last error is dropped
+func (re *RecentErrors) Add(table, query string, status int, body string) {
+	if len(body) > recentErrorBody {
+		body = body[:recentErrorBody]
+	}
+	e := RecentError{Time: time.Now(), Status: status, Query: hidePassword(query), Body: hidePassword(body)}
+	re.Lock()
+	defer re.Unlock()
+	if _, ok := re.tables[table]; !ok && len(re.tables) >= tableErrorsSize {
+		oldest := ""
+		for t, list := range re.tables {
+			if oldest == "" || list[len(list)-1].Time.Before(re.tables[oldest][len(re.tables[oldest])-1].Time) {
+				oldest = t
+			}
+		}
+		delete(re.tables, oldest)
+	}
+	list := append(re.tables[table], e)
+	if len(list) > recentErrorsSize {
+		list = append([]RecentError(nil), list[len(list)-recentErrorsSize:]...)
+	}
+	re.tables[table] = list
+}
+
+// Get returns a copy of the kept responses by table, the newest last
+func (re *RecentErrors) Get() map[string][]RecentError {
+	re.Lock()
+	defer re.Unlock()
+	tables := make(map[string][]RecentError, len(re.tables))
+	for table, list := range re.tables {
+		tables[table] = append([]RecentError(nil), list...)
+	}
+	return tables
+}
+
+// Sample takes the in and out counters and computes the window from the previous sample
+func (c *Coalescing) Sample(in, out uint32, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.at.IsZero() {
+		din, dout := in-c.in, out-c.out
+		c.ratio = 0
+		if dout > 0 {
+			c.ratio = float64(din) / float64(dout)
+		}
+		c.outRate = float64(dout) / now.Sub(c.at).Seconds()
+	}
+	c.in, c.out, c.at = in, out, now
+}
+
+// Get returns the ratio and the out rate of the last window
+func (c *Coalescing) Get() (ratio, outRate float64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.ratio, c.outRate
+}
+
+// newHistogram parses comma separated ascending bucket bounds
+func newHistogram(spec string) (*Histogram, error) {
+	h := &Histogram{}
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		bound, err := strconv.Atoi(s)
+		if err != nil || bound <= 0 || (len(h.bounds) > 0 && bound <= h.bounds[len(h.bounds)-1]) {
+			return nil, fmt.Errorf("bad buckets %q: want ascending positive numbers", spec)
+		}
+		h.bounds = append(h.bounds, bound)
+	}
+	h.counts = make([]uint64, len(h.bounds)+1)
+	return h, nil
+}
+
+// mustHistogram is newHistogram for flag defaults
+func mustHistogram(spec string) *Histogram {
+	h, err := newHistogram(spec)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// Observe counts the value and returns its bucket name, le_<bound> or le_inf
+func (h *Histogram) Observe(value int) string {
+	i := sort.SearchInts(h.bounds, value)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(value))
+	if i == len(h.bounds) {
+		return "le_inf"
+	}
+	return fmt.Sprintf("le_%d", h.bounds[i])
+}
+
+// Cumulative returns the bounds, the count of values up to each bound and
+// over the last one (count), and the sum of the values
+func (h *Histogram) Cumulative() (bounds []int, counts []uint64, sum uint64) {
+	counts = make([]uint64, len(h.counts))
+	var total uint64
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+		counts[i] = total
+	}
+	return h.bounds, counts, atomic.LoadUint64(&h.sum)
+}
+
+// Interval returns the counts since the last call as a histogram, for
+// percentiles of the last report period. It is called from one goroutine
+func (h *Histogram) Interval() *Histogram {
+	d := &Histogram{bounds: h.bounds, counts: make([]uint64, len(h.counts))}
+	if h.last == nil {
+		h.last = make([]uint64, len(h.counts))
+	}
+	for i := range h.counts {
+		count := atomic.LoadUint64(&h.counts[i])
+		d.counts[i] = count - h.last[i]
+		h.last[i] = count
+	}
+	return d
+}
+
+// Quantile estimates the q quantile (0.99 for p99), interpolating within the
+// bucket, values over the last bucket count as the last bound. 0 without values
+func (h *Histogram) Quantile(q float64) float64 {
+	var total uint64
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen uint64
+	for i := range h.counts {
+		count := atomic.LoadUint64(&h.counts[i])
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+		if i == len(h.bounds) {
+			break
+		}
+		lower := 0
+		if i > 0 {
+			lower = h.bounds[i-1]
+		}
+		return float64(lower) + float64(h.bounds[i]-lower)*(rank-float64(seen))/float64(count)
+	}
+	if len(h.bounds) == 0 {
+		return 0
+	}
+	return float64(h.bounds[len(h.bounds)-1])
+}
+
+// newTableHistograms makes the histograms of every table with the buckets,
+// checked by validateFlags
+func newTableHistograms(buckets string) *TableHistograms {
+	return &TableHistograms{buckets: buckets, histograms: make(map[string]*Histogram)}
+}
+
+// Observe counts the duration of the table in milliseconds
+func (th *TableHistograms) Observe(table string, d time.Duration) {
+	th.Lock()
+	h, ok := th.histograms[table]
+	if !ok {
+		if len(th.histograms) >= promTablesSize {
+			table = "other"
+			h = th.histograms[table]
+		}
+		if h == nil {
+			h = mustHistogram(th.buckets)
+			th.histograms[table] = h
+		}
+	}
+	th.Unlock()
+	h.Observe(int(d / time.Millisecond))
+}
+
+// Get returns the histograms by table
+func (th *TableHistograms) Get() map[string]*Histogram {
+	th.Lock()
+	defer th.Unlock()
+	histograms := make(map[string]*Histogram, len(th.histograms))
+	for table, h := range th.histograms {
+		histograms[table] = h
+	}
+	return histograms
+}
+
+// Sample reads the runtime memory stats, it stops the world for a moment so
+// it runs on a timer and never per request
+func (m *MemStats) Sample(bufferBytes int) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m.Lock()
+	defer m.Unlock()
+	m.sampled = true
+	m.heapAlloc, m.nextGC, m.numGC = ms.HeapAlloc, ms.NextGC, ms.NumGC
+	m.bufferBytes = bufferBytes
+}
+
+// Get returns the last sample, ok is false before the first one
+func (m *MemStats) Get() (heapAlloc, nextGC uint64, numGC uint32, bufferBytes int, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.heapAlloc, m.nextGC, m.numGC, m.bufferBytes, m.sampled
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTableErrors(t *testing.T) {
+	te := &TableErrors{count: make(map[string]int)}
+	for i := 0; i < 3; i++ {
+		te.Add("events")
+	}
+	te.Add("logs")
+	top := te.Top(5)
+	if len(top) != 2 || top[0] != (TableCount{"events", 3}) || top[1] != (TableCount{"logs", 1}) {
+		t.Errorf("top: want [events:3 logs:1]; got %v", top)
+	}
+	if top := te.Top(1); len(top) != 1 || top[0].Table != "events" {
+		t.Errorf("top 1: want events; got %v", top)
+	}
+
+	te.Lock()
+	te.decayed = time.Now().Add(-2 * tableErrorsDecay)
+	te.Unlock()
+	top = te.Top(5)
+	if len(top) != 1 || top[0] != (TableCount{"events", 1}) {
+		t.Errorf("decay: want [events:1]; got %v", top)
+	}
+
+	for i := 0; i < tableErrorsSize+10; i++ {
+		te.Add(fmt.Sprintf("t%d", i))
+	}
+	te.Lock()
+	n := len(te.count)
+	te.Unlock()
+	if n > tableErrorsSize {
+		t.Errorf("size: want <= %d; got %d", tableErrorsSize, n)
+	}
+}
+
+func TestRecentErrors(t *testing.T) {
+	re := &RecentErrors{tables: make(map[string][]RecentError)}
+	for i := 0; i < recentErrorsSize+5; i++ {
+		re.Add("events", "?query=INSERT&password=secret", 500, fmt.Sprintf("Code: 16. Unknown column %d", i))
+	}
+	re.Add("logs", "?query=INSERT", 400, strings.Repeat("x", recentErrorBody*2))
+
+	got := re.Get()
+	events := got["events"]
+	if len(events) != recentErrorsSize {
+		t.Fatalf("want %d errors; got %d", recentErrorsSize, len(events))
+	}
+	if want := fmt.Sprintf("Code: 16. Unknown column %d", recentErrorsSize+4); events[len(events)-1].Body != want {
+		t.Errorf("want newest last %q; got %q", want, events[len(events)-1].Body)
+	}
+	if events[0].Query != "?query=INSERT&password=*" {
+		t.Errorf("want password hidden; got %q", events[0].Query)
+	}
+	if len(got["logs"][0].Body) != recentErrorBody {
+		t.Errorf("want body truncated to %d; got %d", recentErrorBody, len(got["logs"][0].Body))
+	}
+
+	for i := 0; i < tableErrorsSize; i++ {
+		re.Add(fmt.Sprintf("t%d", i), "", 500, "")
+	}
+	if got := re.Get(); len(got) != tableErrorsSize {
+		t.Errorf("want %d tables; got %d", tableErrorsSize, len(got))
+	} else if _, ok := got["events"]; ok {
+		t.Errorf("want the oldest table dropped")
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	c := &Coalescing{}
+	now := time.Now()
+	c.Sample(100, 10, now)
+	if ratio, rate := c.Get(); ratio != 0 || rate != 0 {
+		t.Errorf("first sample: want 0, 0; got %f, %f", ratio, rate)
+	}
+	c.Sample(1100, 30, now.Add(10*time.Second))
+	if ratio, rate := c.Get(); ratio != 50 || rate != 2 {
+		t.Errorf("want ratio 50, rate 2; got %f, %f", ratio, rate)
+	}
+	c.Sample(1100, 30, now.Add(20*time.Second))
+	if ratio, rate := c.Get(); ratio != 0 || rate != 0 {
+		t.Errorf("idle window: want 0, 0; got %f, %f", ratio, rate)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h, err := newHistogram("10, 100,1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for value, want := range map[int]string{0: "le_10", 10: "le_10", 11: "le_100", 100: "le_100", 999: "le_1000", 1001: "le_inf"} {
+		if got := h.Observe(value); got != want {
+			t.Errorf("%d: want %s; got %s", value, want, got)
+		}
+	}
+	if want := []uint64{2, 2, 1, 1}; fmt.Sprint(h.counts) != fmt.Sprint(want) {
+		t.Errorf("counts: want %v; got %v", want, h.counts)
+	}
+	for _, spec := range []string{"10,x", "100,10", "0", "-5", "10,10"} {
+		if _, err := newHistogram(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := mustHistogram("10,100,1000")
+	if got := h.Quantile(0.5); got != 0 {
+		t.Errorf("empty: want 0; got %v", got)
+	}
+	for i := 0; i < 90; i++ {
+		h.Observe(5)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(500)
+	}
+	for q, want := range map[float64]float64{0.5: 5.56, 0.9: 10, 0.95: 550, 0.99: 910} {
+		if got := h.Quantile(q); got < want-0.01 || got > want+0.01 {
+			t.Errorf("p%v: want %v; got %v", q*100, want, got)
+		}
+	}
+	h.Observe(5000)
+	if got := h.Quantile(1); got != 1000 {
+		t.Errorf("over the last bucket: want 1000; got %v", got)
+	}
+
+	if _, counts, _ := h.Interval().Cumulative(); counts[len(counts)-1] != 101 {
+		t.Errorf("first interval: want 101 values; got %v", counts)
+	}
+	h.Observe(50)
+	last := h.Interval()
+	if _, counts, _ := last.Cumulative(); counts[len(counts)-1] != 1 {
+		t.Errorf("second interval: want 1 value; got %v", counts)
+	}
+	if got := last.Quantile(0.99); got < 10 || got > 100 {
+		t.Errorf("second interval p99: want in 10..100; got %v", got)
+	}
+}
+
+func TestTableHistograms(t *testing.T) {
+	th := newTableHistograms("10,100")
+	th.Observe("events", 5*time.Millisecond)
+	th.Observe("events", 50*time.Millisecond)
+	th.Observe("logs", 2*time.Second)
+	got := th.Get()
+	if len(got) != 2 {
+		t.Fatalf("want 2 tables; got %v", got)
+	}
+	if _, counts, sum := got["events"].Cumulative(); fmt.Sprint(counts) != "[1 2 2]" || sum != 55 {
+		t.Errorf("events: got %v sum %d", counts, sum)
+	}
+	if _, counts, _ := got["logs"].Cumulative(); fmt.Sprint(counts) != "[0 0 1]" {
+		t.Errorf("logs: got %v", counts)
+	}
+}
+
+func TestMemStats(t *testing.T) {
+	m := &MemStats{}
+	if _, _, _, _, ok := m.Get(); ok {
+		t.Error("want no sample before the first one")
+	}
+	m.Sample(123)
+	heapAlloc, nextGC, _, bufferBytes, ok := m.Get()
+	if !ok || heapAlloc == 0 || nextGC == 0 || bufferBytes != 123 {
+		t.Errorf("want a sample with 123 buffered bytes; got heap %d, next gc %d, buffered %d", heapAlloc, nextGC, bufferBytes)
+	}
+
+	defer func(m *MemStats) { memStats = m }(memStats)
+	memStats = &MemStats{}
+	var stat strings.Builder
+	writeStatistic(&stat)
+	if strings.Contains(stat.String(), "heap alloc:") {
+		t.Errorf("not sampled: want no memory stats; got %q", stat.String())
+	}
+	memStats = m
+	stat.Reset()
+	writeStatistic(&stat)
+	for _, want := range []string{"heap alloc:", "next gc:", "num gc:", "buffered bytes:123\r\n"} {
+		if !strings.Contains(stat.String(), want) {
+			t.Errorf("want %q; got %q", want, stat.String())
+		}
+	}
+}
+
+func TestTableStatistic(t *testing.T) {
+	defer func(tc *TableCounters) { tableCounters = tc }(tableCounters)
+	tableCounters = newTableCounters()
+	resetStore()
+	defer resetStore()
+	receivedMetrics("events", 10)
+	receivedMetrics("events", 5)
+	sentMetrics("events", 3, 15)
+	errorMetrics("events")
+	key := "?query=INSERT%20INTO%20logs%20VALUES"
+	store.add(key, key, "logs", []byte("(1)"), []byte(","), 1)
+
+	var stat strings.Builder
+	writeTableStatistic(&stat)
+	lines := strings.Split(strings.TrimSpace(stat.String()), "\r\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 tables; got %q", lines)
+	}
+	prefix := "table:events in=2 out=1 rows=3 bytes_in=15 bytes_out=15 errors=1 buffered=0 last_flush="
+	if !strings.HasPrefix(lines[0], prefix) || strings.HasSuffix(lines[0], "=0") {
+		t.Errorf("events: want %s<now>; got %q", prefix, lines[0])
+	}
+	if want := "table:logs in=0 out=0 rows=0 bytes_in=0 bytes_out=0 errors=0 buffered=3 last_flush=0"; lines[1] != want {
+		t.Errorf("logs: want %q; got %q", want, lines[1])
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+// statsdPacket is the max UDP payload, lines are packed up to it
+const statsdPacket = 1432
+
+// Statsd sends the graphite metrics as statsd counters and gauges with host
+// and table tags: bytable.t.rows_sent is rows_sent with table:t, byhost
+// metrics are dropped for the host tag
+type Statsd struct {
+	conn   net.Conn
+	prefix string
+	tags   string // datadog, influx or none
+	host   string
+}
+
+// NewStatsd connects to the statsd udp address host:port
+func NewStatsd(addr, prefix, tags, host string) (*Statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Statsd{conn: conn, prefix: prefix, tags: tags, host: host}, nil
+}
+
+// SendMetrics sends the metrics in as few packets as fit, a metric with a
+// bytable version in the batch is sent by table only so totals aren't doubled
+func (s *Statsd) SendMetrics(metrics []graphite.Metric) error {
+	var packet bytes.Buffer
+	tabled := make(map[string]bool)
+	for _, m := range metrics {
+		if name, table := s.split(m.Name); table != "" {
+			tabled[name] = true
+		}
+	}
+	var err error
+	for _, m := range metrics {
+		name, table := s.split(m.Name)
+		if name == "" || (table == "" && tabled[name]) {
+			continue
+		}
+		line := s.line(name, m.Value, table)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacket {
+			if _, e := s.conn.Write(packet.Bytes()); e != nil {
+				err = e
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, e := s.conn.Write(packet.Bytes()); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// split returns the metric name without -graphiteprefix and its table,
+// an empty name for byhost metrics
+func (s *Statsd) split(full string) (name, table string) {
+	name = strings.TrimPrefix(full, cfg().graphiteprefix+".")
+	switch {
+	case strings.HasPrefix(name, "byhost."):
+		return "", ""
+	case strings.HasPrefix(name, "bytable."):
+		name = name[len("bytable."):]
+		if i := strings.Index(name, "."); i > 0 {
+			return name[i+1:], name[:i]
+		}
+	}
+	return name, ""
+}
+
+// line formats one statsd line with the tags
+func (s *Statsd) line(name, value, table string) string {
+	kind := "c"
+	if isGauge(name) {
+		kind = "g"
+	}
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+	switch s.tags {
+	case "datadog":
+		tags := "|#host:" + s.host
+		if table != "" {
+			tags += ",table:" + table
+		}
+		return name + ":" + value + "|" + kind + tags
+	case "influx":
+		tags := ",host=" + s.host
+		if table != "" {
+			tags += ",table=" + table
+		}
+		return name + tags + ":" + value + "|" + kind
+	}
+	if table != "" {
+		name += "." + table
+	}
+	return name + ":" + value + "|" + kind
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+func TestStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() []string {
+		buf := make([]byte, statsdPacket)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+	p := cfg().graphiteprefix
+	metrics := []graphite.Metric{
+		graphite.NewMetric(p+".rows_sent", "5", 0),
+		graphite.NewMetric(p+".byhost.web1.rows_sent", "5", 0),
+		graphite.NewMetric(p+".bytable.events.rows_sent", "5", 0),
+		graphite.NewMetric(p+".flush_retries", "1", 0),
+		graphite.NewMetric(p+".flush_queue", "42", 0),
+	}
+	for tags, want := range map[string]string{
+		"datadog": "proxyhouse.flush_queue:42|g|#host:web1 proxyhouse.flush_retries:1|c|#host:web1 proxyhouse.rows_sent:5|c|#host:web1,table:events",
+		"influx":  "proxyhouse.flush_queue,host=web1:42|g proxyhouse.flush_retries,host=web1:1|c proxyhouse.rows_sent,host=web1,table=events:5|c",
+		"none":    "proxyhouse.flush_queue:42|g proxyhouse.flush_retries:1|c proxyhouse.rows_sent.events:5|c",
+	} {
+		s, err := NewStatsd(conn.LocalAddr().String(), "proxyhouse", tags, "web1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SendMetrics(metrics); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(read(), " "); got != want {
+			t.Errorf("%s: want %q; got %q", tags, want, got)
+		}
+	}
+
+	// a batch over the packet size goes as several packets
+	s, _ := NewStatsd(conn.LocalAddr().String(), "proxyhouse", "none", "web1")
+	var many []graphite.Metric
+	for i := 0; i < 100; i++ {
+		many = append(many, graphite.NewMetric(p+".requests_received", "1", 0))
+	}
+	s.SendMetrics(many)
+	total := 0
+	for total < 100 {
+		total += len(read())
+	}
+	if total != 100 {
+		t.Errorf("want 100 lines; got %d", total)
+	}
+}
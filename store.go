@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errTooManyKeys  = errors.New("Too many buffer keys.")
+	errBufferFull   = errors.New("Buffer is full.")
+	errFormatPaused = errors.New("Format of the buffered key changed while paused.")
+	errBodyTooLarge = errors.New("Request body is over maxstorebytes.")
+)
+
+type Buffer struct {
+	rowcount int
+	buffer   []byte
+	created  time.Time
+	table    string
+	uri      string // forwarded uri, the key may keep only -keyparams of it
+	trace    string // traceparent of the first traced request, with -tracing
+}
+
+type Store struct {
+	sync.RWMutex
+	Req          map[string]*Buffer
+	cancelSyncer context.CancelFunc
+	cancelResend context.CancelFunc
+	cancelTables context.CancelFunc
+	interval     int64          // sync interval in ns, read by backgroundSender every cycle
+	size         int            // buffered bytes
+	tables       map[string]int // buffered bytes by table
+	flushed      map[string]int // rolling average flushed bytes by table, the new key capacity
+	flushMu      sync.Mutex     // one flush at a time for all flush triggers
+	evicting     sync.WaitGroup // sends started by evict
+	retrying     sync.WaitGroup // retries of flushes that let flushMu go
+	flushing     int32          // 1 while a flush is in progress
+	paused       int32          // 1 while flushing is paused by /pause
+}
+
+var store = &Store{Req: make(map[string]*Buffer, 0), tables: make(map[string]int), flushed: make(map[string]int)}
+
+const flushedTables = 1000 // tables with a learned buffer capacity
+
+// add appends the body to the key buffer, on -maxstorebytes or -maxkeys overflow
+// it returns an error or sends other keys to make room. A key is sent early when
+// it reaches -maxbatchbytes, a body over the cap is sent alone
+func (store *Store) add(key, uri, table string, body, delimiter []byte, rows int) error {
+	store.Lock()
+	defer store.Unlock()
+	// a body the empty store can't hold is rejected before any key is sent for it
+	if cfg().maxstorebytes > 0 && len(body) > cfg().maxstorebytes {
+		gr.SimpleSend(fmt.Sprintf("%s.store_overflow", cfg().graphiteprefix), "1")
+		return errBodyTooLarge
+	}
+	for cfg().maxstorebytes > 0 && store.size+len(body) > cfg().maxstorebytes && len(store.Req) > 0 {
+		gr.SimpleSend(fmt.Sprintf("%s.store_overflow", cfg().graphiteprefix), "1")
+		if store.isPaused() {
+			return errBufferFull
+		}
+		switch cfg().storeoverflow {
+		case "flush":
+			largest, _ := store.largest()
+			store.evict(largest)
+		case "table":
+			store.evict(store.tableKeys(store.largestTable())...)
+		default:
+			return errBufferFull
+		}
+	}
+	// paused keys grow up to the store limits, nothing is sent
+	batchbytes, batchrows := cfg().maxbatchbytes, cfg().maxbatchrows
+	if store.isPaused() {
+		batchbytes, batchrows = 0, 0
+	}
+	if batchbytes > 0 {
+		if len(body) > batchbytes {
+			gr.SimpleSend(fmt.Sprintf("%s.oversized_body", cfg().graphiteprefix), "1")
+			grlog(LEVEL_WARN, "Body ", len(body), " bytes over maxbatchbytes, sent alone: ", hidePassword(key), Fields{"component": "buffer", "table": table})
+		}
+		// flush the key before the body would push it over the cap
+		if buf, ok := store.Req[key]; ok && len(buf.buffer)+len(delimiter)+len(body) > batchbytes {
+			store.evict(key)
+		}
+	}
+	// a body in another format can't be merged, the buffered one is sent first,
+	// paused keys are never sent so the body is rejected
+	if buf, ok := store.Req[key]; ok && buf.uri != uri && insertFormat(buf.uri) != insertFormat(uri) {
+		gr.SimpleSend(fmt.Sprintf("%s.format_mismatch", cfg().graphiteprefix), "1")
+		if store.isPaused() {
+			return errFormatPaused
+		}
+		grlog(LEVEL_WARN, "Format changed for key, buffer sent: ", hidePassword(key), Fields{"component": "buffer", "table": table})
+		store.evict(key)
+	}
+	// the header rows of a *WithNames body are not rows, the batch keeps the
+	// ones of its first body. A -tableheader table gets bodies without them
+	if n := headerRows(insertFormat(uri)); n > 0 && tableLine(cfg().tableheader, table) == "" {
+		if rows -= n; rows < 0 {
+			rows = 0
+		}
+		if _, ok := store.Req[key]; ok {
+			body = dropRows(body, n)
+		}
+	}
+	buf, ok := store.Req[key]
+	if !ok {
+		if cfg().maxkeys > 0 && len(store.Req) >= cfg().maxkeys {
+			gr.SimpleSend(fmt.Sprintf("%s.keys_overflow", cfg().graphiteprefix), "1")
+			if cfg().keyoverflow != "flush" || store.isPaused() {
+				return errTooManyKeys
+			}
+			largest, _ := store.largest()
+			store.evict(largest)
+		}
+		buf = &Buffer{rowcount: 0, buffer: make([]byte, 0, store.capacity(table)), created: time.Now(), table: table, uri: uri}
+		store.Req[key] = buf
+	} else {
+		buf.buffer = append(buf.buffer, delimiter...)
+		store.size += len(delimiter)
+		store.tables[table] += len(delimiter)
+	}
+	buf.buffer = append(buf.buffer, body...)
+	buf.rowcount += rows
+	store.size += len(body)
+	store.tables[table] += len(body)
+	if (batchbytes > 0 && len(buf.buffer) >= batchbytes) || (batchrows > 0 && buf.rowcount >= batchrows) {
+		store.evict(key)
+	}
+	return nil
+}
+
+// trace keeps the traceparent for the batch of the key, the first one wins
+func (store *Store) trace(key, traceparent string) {
+	store.Lock()
+	defer store.Unlock()
+	if buf, ok := store.Req[key]; ok && buf.trace == "" {
+		buf.trace = traceparent
+	}
+}
+
+// remove deletes the key and its bytes from the accounting, must be called under lock
+func (store *Store) remove(key string) *Buffer {
+	buf, ok := store.Req[key]
+	if !ok {
+		return nil
+	}
+	delete(store.Req, key)
+	store.learn(buf)
+	store.size -= len(buf.buffer)
+	store.tables[buf.table] -= len(buf.buffer)
+	if store.tables[buf.table] <= 0 {
+		delete(store.tables, buf.table)
+	}
+	return buf
+}
+
+// learn adds the flushed buffer size to the rolling average of its table,
+// must be called under lock
+func (store *Store) learn(buf *Buffer) {
+	avg, ok := store.flushed[buf.table]
+	if !ok {
+		if len(store.flushed) >= flushedTables {
+			return
+		}
+		avg = len(buf.buffer)
+	}
+	store.flushed[buf.table] = (avg*3 + len(buf.buffer)) / 4
+}
+
+// maxCapacity caps the learned capacity, a table that flushed huge batches
+// doesn't preallocate that much for every new key
+const maxCapacity = 4 << 20
+
+// capacity returns the initial buffer capacity for a new key of the table,
+// the average flushed size or buffersize for a new table, capped by maxbatchbytes,
+// maxstorebytes and maxCapacity, must be called under lock
+func (store *Store) capacity(table string) int {
+	avg, ok := store.flushed[table]
+	if !ok {
+		return buffersize
+	}
+	if cfg().maxbatchbytes > 0 && avg > cfg().maxbatchbytes {
+		avg = cfg().maxbatchbytes
+	}
+	if cfg().maxstorebytes > 0 && avg > cfg().maxstorebytes {
+		avg = cfg().maxstorebytes
+	}
+	if avg > maxCapacity {
+		avg = maxCapacity
+	}
+	return avg
+}
+
+// evict removes the keys and sends them in background, must be called under lock
+func (store *Store) evict(keys ...string) {
+	for _, key := range keys {
+		if val := store.remove(key); val != nil {
+			store.evicting.Add(1)
+			go func(val *Buffer) {
+				defer store.evicting.Done()
+				sendBuffer(context.Background(), val, nil)
+				atomic.AddUint32(&out, 1)
+			}(val)
+		}
+	}
+}
+
+// flush swaps the buffer and forwards all gathered requests, with maxflushpercycle
+// set only the oldest keys are forwarded and the rest wait for the next cycle.
+// Flushes, the -tablesyncsec ones and the handoff hold flushMu, so they never
+// run concurrently, and retry failed batches after letting it go. Keys sent
+// early by evict don't wait for them
+func (store *Store) flush() {
+	store.flushContext(context.Background())
+}
+
+// flushContext is flush with the sends bound to ctx
+func (store *Store) flushContext(ctx context.Context) {
+	store.flushKeys(ctx, nil)
+}
+
+// flushCycle is the flush of a sync cycle, keys of tables with their own
+// -tablesyncsec interval are left to backgroundTableSync
+func (store *Store) flushCycle() {
+	intervals := syncIntervals()
+	store.flushKeys(context.Background(), func(val *Buffer) bool { return intervals[strings.ToLower(val.table)] > 0 })
+}
+
+// flushKeys is flushContext for the keys skip (if set) is false for
+func (store *Store) flushKeys(ctx context.Context, skip func(val *Buffer) bool) (rows, size int) {
+	var failed []failedBatch
+	store.retrying.Add(1)
+	defer func() {
+		defer store.retrying.Done()
+		r, n := retryFailed(ctx, failed)
+		rows, size = rows+r, size+n
+	}()
+	store.flushMu.Lock()
+	defer store.flushMu.Unlock()
+	atomic.StoreInt32(&store.flushing, 1)
+	defer atomic.StoreInt32(&store.flushing, 0)
+	store.Lock()
+	requests := store.Req
+	if skip != nil {
+		requests = make(map[string]*Buffer, len(store.Req))
+		for key, val := range store.Req {
+			if !skip(val) {
+				requests[key] = val
+			}
+		}
+	}
+	if limited := cfg().maxflushpercycle > 0 && len(requests) > cfg().maxflushpercycle; limited || len(requests) < len(store.Req) {
+		keys := make([]string, 0, len(requests))
+		for key := range requests {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return requests[keys[i]].created.Before(requests[keys[j]].created)
+		})
+		if limited {
+			keys = keys[:cfg().maxflushpercycle]
+		}
+		requests = make(map[string]*Buffer, len(keys))
+		for _, key := range keys {
+			requests[key] = store.remove(key)
+		}
+		if limited {
+			gr.SimpleSend(fmt.Sprintf("%s.flush_queue", cfg().graphiteprefix), fmt.Sprintf("%d", len(store.Req)))
+		}
+	} else {
+		for _, val := range requests {
+			store.learn(val)
+		}
+		store.Req = make(map[string]*Buffer)
+		store.tables = make(map[string]int)
+		store.size = 0
+	}
+	store.Unlock()
+	// keys that waited more than one interval missed the cycle they appeared in
+	now := time.Now()
+	delayed := 0
+	var maxage time.Duration
+	for key, val := range requests {
+		age := now.Sub(val.created)
+		if age > maxage {
+			maxage = age
+		}
+		if interval := store.syncInterval(); interval > 0 && age > interval {
+			delayed++
+			grlog(LEVEL_DBG, "Delayed key: ", hidePassword(key), " age: ", age, Fields{"component": "flush", "table": val.table})
+		}
+	}
+	if len(requests) > 0 {
+		gr.SimpleSend(fmt.Sprintf("%s.batch_age_max", cfg().graphiteprefix), fmt.Sprintf("%d", maxage.Milliseconds()))
+	} else {
+		gr.SimpleSend(fmt.Sprintf("%s.idle_cycles", cfg().graphiteprefix), "1")
+	}
+	if delayed > 0 {
+		gr.SimpleSend(fmt.Sprintf("%s.keys_delayed", cfg().graphiteprefix), fmt.Sprintf("%d", delayed))
+	}
+	//keys itterator
+	for _, val := range requests {
+		r, n := sendBuffer(ctx, val, &failed)
+		rows, size = rows+r, size+n
+		atomic.AddUint32(&out, 1)
+	}
+	return
+}
+
+// sendBuffer sends a flushed buffer, with -chunkbytes a bigger buffer goes as
+// several inserts cut at row ends. Every chunk is sent and saved to errors on
+// its own, so only failed chunks are resent. With failed set, a chunk that may
+// be retried is added to it instead of retried here. It returns the rows and
+// bytes delivered
+func sendBuffer(ctx context.Context, val *Buffer, failed *[]failedBatch) (rows, size int) {
+	if val.trace != "" {
+		ctx = withTrace(ctx, val.trace)
+		grlog(LEVEL_DBG, "Trace ", traceID(val.trace), " buffered ", time.Since(val.created), ": ", hidePassword(val.uri))
+	}
+	var chunks [][]byte
+	var counts []int
+	if cfg().chunkbytes > 0 && len(val.buffer) > cfg().chunkbytes {
+		chunks, counts = splitRows(val.buffer, insertFormat(val.uri), cfg().chunkbytes)
+	}
+	if len(chunks) <= 1 {
+		batch := failedBatch{key: val.uri, val: wrapBatch(val.table, val.buffer), rowcount: val.rowcount, size: len(val.buffer)}
+		if batch.send(ctx, failed) != nil {
+			return 0, 0
+		}
+		return val.rowcount, len(val.buffer)
+	}
+	errs := 0
+	for i, chunk := range chunks {
+		batch := failedBatch{key: chunkURI(val.uri, i), val: wrapBatch(val.table, chunk), rowcount: counts[i], size: len(chunk)}
+		if err := batch.send(ctx, failed); err != nil {
+			if err != errRetryLater {
+				errs++
+			}
+			continue
+		}
+		rows, size = rows+batch.rowcount, size+batch.size
+	}
+	gr.SimpleSend(fmt.Sprintf("%s.chunks_sent", cfg().graphiteprefix), fmt.Sprintf("%d", len(chunks)))
+	if errs > 0 && errs < len(chunks) {
+		gr.SimpleSend(fmt.Sprintf("%s.partial_flush", cfg().graphiteprefix), "1")
+		grlog(LEVEL_WARN, "Partial flush: ", errs, " of ", len(chunks), " chunks failed: ", hidePassword(val.uri), Fields{"component": "flush", "table": val.table})
+	}
+	return
+}
+
+// errRetryLater is the send error of a batch left to retryFailed
+var errRetryLater = errors.New("retried after the flush")
+
+// failedBatch is a flushed batch, one that failed while its flush held
+// flushMu is retried by retryFailed after the flush lets go of it, so the
+// retry delays don't hold up the other flushes
+type failedBatch struct {
+	key      string
+	val      []byte
+	rowcount int
+	size     int // bytes of the buffer without the -tableheader
+	code     int
+	err      error
+}
+
+// send sends the batch, with failed set without the retries: a batch they
+// would try again is added to failed and errRetryLater returned
+func (batch failedBatch) send(ctx context.Context, failed *[]failedBatch) error {
+	if failed == nil {
+		return sendRetried(ctx, batch.key, batch.val, batch.rowcount)
+	}
+	observeBatch(batch.val, batch.rowcount)
+	code, wait, err := deliverFrom(ctx, batch.key, batch.val, batch.rowcount, cfg().retries)
+	if err == nil || wait > 0 || !retryable(code) {
+		return retryFlushed(ctx, batch.key, batch.val, batch.rowcount, code, wait, err)
+	}
+	batch.code, batch.err = code, err
+	*failed = append(*failed, batch)
+	return errRetryLater
+}
+
+// retryable tells if the inline or the flush retries try a batch that
+// failed with code, 0 without a response, again
+func retryable(code int) bool {
+	return cfg().retries > 0 && (code == 0 || code >= 500) || cfg().flushretries > 0 && (code == 0 || cfg().flushretrystatus)
+}
+
+// retryFailed retries the batches a flush left to it, the inline retries
+// with their backoff and then -flushretries, as if they had not been cut
+// off. It returns the rows and bytes delivered
+func retryFailed(ctx context.Context, failed []failedBatch) (rows, size int) {
+	for _, batch := range failed {
+		code, err := batch.code, batch.err
+		var wait time.Duration
+		if cfg().retries > 0 && (code == 0 || code >= 500) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(sendBackoff().Delay(0)):
+			}
+			if ctx.Err() == nil {
+				code, wait, err = deliverFrom(ctx, batch.key, batch.val, batch.rowcount, 1)
+			}
+		}
+		if retryFlushed(ctx, batch.key, batch.val, batch.rowcount, code, wait, err) == nil {
+			rows, size = rows+batch.rowcount, size+batch.size
+		}
+	}
+	return
+}
+
+// sendRetried sends a flushed batch, a failed one is tried -flushretries more
+// times -flushretrydelay apart before it goes to the errors dir. Error status
+// codes are retried with -flushretrystatus only, a 503 with Retry-After never
+func sendRetried(ctx context.Context, key string, val []byte, rowcount int) error {
+	observeBatch(val, rowcount)
+	code, wait, err := deliver(ctx, key, val, rowcount)
+	return retryFlushed(ctx, key, val, rowcount, code, wait, err)
+}
+
+// retryFlushed is the -flushretries part of sendRetried for a batch whose
+// send returned code, wait and err
+func retryFlushed(ctx context.Context, key string, val []byte, rowcount int, code int, wait time.Duration, err error) error {
+	for attempt := 0; attempt < cfg().flushretries && err != nil && wait == 0 && (code == 0 || cfg().flushretrystatus); attempt++ {
+		gr.SimpleSend(fmt.Sprintf("%s.flush_retries", cfg().graphiteprefix), "1")
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(cfg().flushretrydelay) * time.Millisecond):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		code, wait, err = deliver(ctx, key, val, rowcount)
+	}
+	if err != nil && len(val) > 0 {
+		saveToErrorsAt(key, val, 1, time.Now().Add(wait))
+	}
+	return err
+}
+
+// splitRows cuts the batch into chunks of at most max bytes at row ends and
+// returns the rows of every chunk. The comma between VALUES rows is dropped.
+// A row longer than max is a chunk alone, a format rowEnds can't cut gives
+// no chunks
+func splitRows(batch []byte, format string, max int) (chunks [][]byte, rows []int) {
+	ends, ok := rowEnds(batch, format)
+	if !ok {
+		return nil, nil
+	}
+	start, cut, n := 0, 0, 0
+	for _, end := range ends {
+		if end-start > max && n > 0 {
+			chunks, rows = append(chunks, batch[start:cut]), append(rows, n)
+			start, n = cut, 0
+			if format == "VALUES" {
+				for start < len(batch) && (batch[start] == ' ' || batch[start] == '\t' || batch[start] == '\r' || batch[start] == '\n') {
+					start++
+				}
+				if start < len(batch) && batch[start] == ',' {
+					start++
+				}
+			}
+		}
+		cut, n = end, n+1
+	}
+	if n > 0 {
+		chunks, rows = append(chunks, batch[start:]), append(rows, n)
+	}
+	return
+}
+
+// rowEnds returns the offsets the rows of the batch end at, quoted strings
+// are skipped: a VALUES row ends with the bracket closing its tuple, a CSV row
+// with a newline outside double quotes and the rows of the other newline
+// formats, which escape newlines in values, with every newline. It is not ok
+// for other formats and for the *WithNames ones, their header can't be cut off
+func rowEnds(batch []byte, format string) (ends []int, ok bool) {
+	switch {
+	case format == "VALUES":
+		depth := 0
+		var quote byte
+		for i := 0; i < len(batch); i++ {
+			switch c := batch[i]; {
+			case quote != 0:
+				if c == '\\' {
+					i++
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"' || c == '`':
+				quote = c
+			case c == '(' || c == '[' || c == '{':
+				depth++
+			case (c == ')' || c == ']' || c == '}') && depth > 0:
+				if depth--; depth == 0 {
+					ends = append(ends, i+1)
+				}
+			}
+		}
+		return ends, true
+	case !newlineFormats[format] || headerRows(format) > 0:
+		return nil, false
+	}
+	quoted := false
+	csv := strings.HasPrefix(format, "CSV")
+	for i, c := range batch {
+		if csv && c == '"' {
+			quoted = !quoted
+		} else if c == '\n' && !quoted {
+			ends = append(ends, i+1)
+		}
+	}
+	// the last row may lack its newline
+	last := 0
+	if len(ends) > 0 {
+		last = ends[len(ends)-1]
+	}
+	if len(bytes.TrimSpace(batch[last:])) > 0 {
+		ends = append(ends, len(batch))
+	}
+	return ends, true
+}
+
+// chunkURI gives every chunk its own insert_deduplication_token, the token of
+// the uri with the chunk number, so a resent chunk keeps its token
+func chunkURI(uri string, i int) string {
+	pos := strings.Index(uri, "?")
+	values, err := url.ParseQuery(uri[pos+1:])
+	token := values.Get("insert_deduplication_token")
+	if err != nil || token == "" {
+		return uri
+	}
+	values.Set("insert_deduplication_token", fmt.Sprintf("%s_%d", token, i))
+	return uri[:pos+1] + values.Encode()
+}
+
+// insertFormat returns the FORMAT of the uri insert query, VALUES without one
+func insertFormat(uri string) string {
+	values, _ := url.ParseQuery(uri[strings.Index(uri, "?")+1:])
+	fields := strings.Fields(strings.ToUpper(values.Get("query")))
+	for i := len(fields) - 2; i >= 0; i-- {
+		if fields[i] == "FORMAT" {
+			return fields[i+1]
+		}
+	}
+	return "VALUES"
+}
+
+// tableLine returns the line set for the table in a -tableheader or -tablefooter value
+func tableLine(value, table string) string {
+	for _, entry := range strings.Split(value, ";") {
+		if i := strings.Index(entry, ":"); i > 0 && strings.ToLower(strings.TrimSpace(entry[:i])) == table {
+			return strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(entry[i+1:])
+		}
+	}
+	return ""
+}
+
+// wrapBatch adds the -tableheader and -tablefooter lines of the table to a flushed batch
+func wrapBatch(table string, batch []byte) []byte {
+	header, footer := tableLine(cfg().tableheader, table), tableLine(cfg().tablefooter, table)
+	if header == "" && footer == "" || len(batch) == 0 {
+		return batch
+	}
+	wrapped := make([]byte, 0, len(header)+len(batch)+len(footer)+3)
+	if header != "" {
+		wrapped = append(wrapped, header...)
+		if !strings.HasSuffix(header, "\n") {
+			wrapped = append(wrapped, '\n')
+		}
+	}
+	wrapped = append(wrapped, batch...)
+	if footer != "" {
+		if batch[len(batch)-1] != '\n' {
+			wrapped = append(wrapped, '\n')
+		}
+		wrapped = append(wrapped, footer...)
+	}
+	return wrapped
+}
+
+// shutdown stops the background loops and flushes what is left. The background
+// context is already canceled here, so the final sends get a fresh one with the
+// timeout, batches not sent in time go to the errors dir
+func (store *Store) shutdown(timeout time.Duration) {
+	for _, cancel := range []context.CancelFunc{store.cancelSyncer, store.cancelResend, store.cancelTables} {
+		if cancel != nil {
+			cancel()
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if cfg().handoff != "" {
+		store.handoff(ctx)
+	}
+	store.flushContext(ctx)
+}
+
+// handoff posts every buffered key to the -handoff instance with its original
+// uri, so the batches keep growing there. A key the sibling doesn't take is
+// sent upstream as in flush, and after the first failure so are the rest
+func (store *Store) handoff(ctx context.Context) {
+	var failed []failedBatch
+	store.retrying.Add(1)
+	defer func() { retryFailed(ctx, failed); store.retrying.Done() }()
+	store.flushMu.Lock()
+	defer store.flushMu.Unlock()
+	store.Lock()
+	requests := store.Req
+	store.Req = make(map[string]*Buffer)
+	store.tables = make(map[string]int)
+	store.size = 0
+	store.Unlock()
+	var down bool
+	for _, val := range requests {
+		if down {
+			sendBuffer(ctx, val, &failed)
+			atomic.AddUint32(&out, 1)
+			continue
+		}
+		if err := handoffBuffer(ctx, val); err != nil {
+			down = true
+			gr.SimpleSend(fmt.Sprintf("%s.handoff_failed", cfg().graphiteprefix), "1")
+			grlog(LEVEL_WARN, "Handoff error, sent upstream: ", hidePassword(val.uri), " error: ", err, Fields{"component": "shutdown", "table": val.table})
+			sendBuffer(ctx, val, &failed)
+			atomic.AddUint32(&out, 1)
+			continue
+		}
+		gr.SimpleSend(fmt.Sprintf("%s.handoff_keys", cfg().graphiteprefix), "1")
+	}
+}
+
+// handoffBuffer posts the buffer to the -handoff instance. The post gets half
+// of what is left of the shutdown deadline, a sibling that hangs leaves the
+// other half for the upstream send
+func handoffBuffer(ctx context.Context, val *Buffer) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/2)
+		defer cancel()
+	}
+	uri := strings.TrimSuffix(cfg().handoff, "/") + "/" + strings.TrimPrefix(val.uri, "/")
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewReader(val.buffer))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// flushAged sends the keys buffered longer than age without waiting for the sync interval
+func (store *Store) flushAged(age time.Duration) int {
+	store.Lock()
+	defer store.Unlock()
+	var keys []string
+	for key, val := range store.Req {
+		if time.Since(val.created) >= age {
+			keys = append(keys, key)
+		}
+	}
+	store.evict(keys...)
+	if len(keys) > 0 {
+		gr.SimpleSend(fmt.Sprintf("%s.aged_flushes", cfg().graphiteprefix), fmt.Sprintf("%d", len(keys)))
+	}
+	return len(keys)
+}
+
+// tableIntervals are the -tablesyncsec intervals by lowercased table
+var tableIntervals struct {
+	sync.RWMutex
+	byTable map[string]time.Duration
+}
+
+// setTableIntervals parses -tablesyncsec, on start and on a reload
+func setTableIntervals() {
+	byTable := make(map[string]time.Duration)
+	for _, entry := range strings.Split(cfg().tablesyncsec, ";") {
+		i := strings.Index(entry, ":")
+		if i <= 0 {
+			continue
+		}
+		if sec, err := strconv.Atoi(strings.TrimSpace(entry[i+1:])); err == nil && sec > 0 {
+			byTable[strings.ToLower(strings.TrimSpace(entry[:i]))] = time.Duration(sec) * time.Second
+		}
+	}
+	tableIntervals.Lock()
+	tableIntervals.byTable = byTable
+	tableIntervals.Unlock()
+}
+
+// syncIntervals returns the -tablesyncsec intervals, the map is not changed
+func syncIntervals() map[string]time.Duration {
+	tableIntervals.RLock()
+	defer tableIntervals.RUnlock()
+	return tableIntervals.byTable
+}
+
+// tableInterval returns the -tablesyncsec interval of the table, 0 without one
+func tableInterval(table string) time.Duration {
+	return syncIntervals()[strings.ToLower(table)]
+}
+
+// flushTables sends the keys of tables with their own interval that are as
+// old as it, holding flushMu like flush
+func (store *Store) flushTables() int {
+	intervals := syncIntervals()
+	if len(intervals) == 0 {
+		return 0
+	}
+	var failed []failedBatch
+	store.retrying.Add(1)
+	defer func() { retryFailed(context.Background(), failed); store.retrying.Done() }()
+	store.flushMu.Lock()
+	defer store.flushMu.Unlock()
+	store.Lock()
+	var requests []*Buffer
+	for key, val := range store.Req {
+		if interval := intervals[strings.ToLower(val.table)]; interval > 0 && time.Since(val.created) >= interval {
+			requests = append(requests, store.remove(key))
+		}
+	}
+	store.Unlock()
+	for _, val := range requests {
+		sendBuffer(context.Background(), val, &failed)
+		atomic.AddUint32(&out, 1)
+	}
+	return len(requests)
+}
+
+// spill saves a body the paused buffer has no room for to the errors dir with
+// -pausespill, recovery resends it after /resume
+func (store *Store) spill(uri, table string, body []byte) bool {
+	if !cfg().pausespill || !store.isPaused() {
+		return false
+	}
+	gr.SimpleSend(fmt.Sprintf("%s.paused_spilled", cfg().graphiteprefix), "1")
+	saveToErrors(uri, wrapBatch(table, body), 1)
+	return true
+}
+
+// pause stops flushing by the sync interval and -maxbatchage, overflows
+// are rejected instead of sending keys early
+func (store *Store) pause() {
+	atomic.StoreInt32(&store.paused, 1)
+}
+
+// resume starts flushing again, the buffer goes out on the next cycle
+func (store *Store) resume() {
+	atomic.StoreInt32(&store.paused, 0)
+}
+
+func (store *Store) isPaused() bool {
+	return atomic.LoadInt32(&store.paused) == 1
+}
+
+// syncInterval returns the current sync interval
+func (store *Store) syncInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&store.interval))
+}
+
+// setInterval changes the sync interval, it takes effect on the next cycle
+func (store *Store) setInterval(d time.Duration) {
+	atomic.StoreInt64(&store.interval, int64(d))
+}
+
+// stats returns the buffered keys, bytes and the creation time of the oldest key
+func (store *Store) stats() (keys int, size int, oldest time.Time) {
+	store.RLock()
+	defer store.RUnlock()
+	for _, val := range store.Req {
+		if oldest.IsZero() || val.created.Before(oldest) {
+			oldest = val.created
+		}
+	}
+	return len(store.Req), store.size, oldest
+}
+
+// largest returns the key with the biggest buffer, must be called under lock
+func (store *Store) largest() (key string, val *Buffer) {
+	for k, v := range store.Req {
+		if val == nil || len(v.buffer) > len(val.buffer) {
+			key, val = k, v
+		}
+	}
+	return
+}
+
+// largestTable returns the table with the most buffered bytes, must be called under lock
+func (store *Store) largestTable() (table string) {
+	for t, size := range store.tables {
+		if table == "" || size > store.tables[table] {
+			table = t
+		}
+	}
+	return
+}
+
+// tableKeys returns all keys of the table, must be called under lock
+func (store *Store) tableKeys(table string) (keys []string) {
+	for key, val := range store.Req {
+		if val.table == table {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreOverflow(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent = append(sent, extractTable("?"+r.URL.RawQuery))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.maxstorebytes = ch.URL, 100 })
+
+	// the greedy table holds 90 bytes in two keys, the small one 5 bytes
+	fill := func() {
+		resetStore()
+		sent = nil
+		store.add("?query=INSERT%20INTO%20greedy%20VALUES", "?query=INSERT%20INTO%20greedy%20VALUES", "greedy", []byte(strings.Repeat("x", 45)), nil, 1)
+		store.add("?query=INSERT%20INTO%20greedy%20VALUES&query_id=2", "?query=INSERT%20INTO%20greedy%20VALUES&query_id=2", "greedy", []byte(strings.Repeat("x", 45)), nil, 1)
+		store.add("?query=INSERT%20INTO%20small%20VALUES", "?query=INSERT%20INTO%20small%20VALUES", "small", []byte("(1)"), nil, 1)
+	}
+
+	configure(func(c *Config) { c.storeoverflow = "reject" })
+	fill()
+	if err := store.add("?query=INSERT%20INTO%20small%20VALUES", "?query=INSERT%20INTO%20small%20VALUES", "small", []byte("(2),(3),(4),(5)"), []byte(","), 4); err != errBufferFull {
+		t.Errorf("reject: want errBufferFull; got %v", err)
+	}
+
+	configure(func(c *Config) { c.storeoverflow = "table" })
+	fill()
+	if err := store.add("?query=INSERT%20INTO%20small%20VALUES", "?query=INSERT%20INTO%20small%20VALUES", "small", []byte("(2),(3),(4),(5)"), []byte(","), 4); err != nil {
+		t.Fatalf("table: want nil; got %v", err)
+	}
+	store.RLock()
+	size, keys, greedy, small := store.size, len(store.Req), store.tables["greedy"], store.tables["small"]
+	store.RUnlock()
+	if keys != 1 || greedy != 0 || small != 19 || size != 19 {
+		t.Errorf("table: want only small with 19 bytes; got %d keys, greedy %d, small %d, size %d", keys, greedy, small, size)
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if len(sent) != 2 || sent[0] != "greedy" || sent[1] != "greedy" {
+		t.Errorf("table: want both greedy keys sent; got %v", sent)
+	}
+	mu.Unlock()
+
+	configure(func(c *Config) { c.storeoverflow = "flush" })
+	fill()
+	if err := store.add("?query=INSERT%20INTO%20small%20VALUES", "?query=INSERT%20INTO%20small%20VALUES", "small", []byte("(2),(3),(4),(5)"), []byte(","), 4); err != nil {
+		t.Fatalf("flush: want nil; got %v", err)
+	}
+	store.RLock()
+	greedy, small = store.tables["greedy"], store.tables["small"]
+	store.RUnlock()
+	if greedy != 45 || small != 19 {
+		t.Errorf("flush: want one greedy key left; got greedy %d, small %d", greedy, small)
+	}
+
+	// a body over the whole store is rejected, nothing is sent for it
+	for _, overflow := range []string{"reject", "flush", "table"} {
+		configure(func(c *Config) { c.storeoverflow = overflow })
+		fill()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		sent = nil
+		mu.Unlock()
+		if err := store.add("?query=INSERT%20INTO%20huge%20VALUES", "?query=INSERT%20INTO%20huge%20VALUES", "huge", []byte(strings.Repeat("x", 101)), nil, 1); err != errBodyTooLarge {
+			t.Errorf("%s huge: want errBodyTooLarge; got %v", overflow, err)
+		}
+		store.RLock()
+		keys, size = len(store.Req), store.size
+		store.RUnlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		if keys != 3 || size != 93 || len(sent) != 0 {
+			t.Errorf("%s huge: want all 3 keys kept and none sent; got %d keys, %d bytes, sent %v", overflow, keys, size, sent)
+		}
+		mu.Unlock()
+	}
+	w := httptest.NewRecorder()
+	dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20huge%20VALUES", strings.NewReader(strings.Repeat("x", 101))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("dorequest huge: want 413; got %d", w.Code)
+	}
+}
+
+func TestFlushExclusive(t *testing.T) {
+	var active, overlap int32
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractTable("?"+r.URL.RawQuery) != "exclusive" {
+			return
+		}
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+
+	resetStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		store.add("?query=INSERT%20INTO%20exclusive%20VALUES", "?query=INSERT%20INTO%20exclusive%20VALUES", "exclusive", []byte("(1)"), []byte(","), 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.flush()
+		}()
+	}
+	wg.Wait()
+	if overlap != 0 {
+		t.Errorf("want flushes to never overlap")
+	}
+	if atomic.LoadInt32(&store.flushing) != 0 {
+		t.Errorf("want flushing reset after flush")
+	}
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.maxbatchbytes = ch.URL, 10 })
+
+	resetStore()
+	key := "?query=INSERT%20INTO%20t%20VALUES"
+	store.add(key, key, "t", []byte("(1)"), []byte(","), 1)
+	store.add(key, key, "t", []byte("(2)"), []byte(","), 1)
+	// a single body over the cap: the buffered key and the body go separately
+	store.add(key, key, "t", []byte("(3),(4),(5),(6)"), []byte(","), 4)
+	store.add(key, key, "t", []byte("(7)"), []byte(","), 1)
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	sort.Strings(sent)
+	got := strings.Join(sent, " ")
+	mu.Unlock()
+	if want := "(1),(2) (3),(4),(5),(6)"; got != want {
+		t.Errorf("sent: want %q; got %q", want, got)
+	}
+	store.RLock()
+	buf := store.Req[key]
+	store.RUnlock()
+	if buf == nil || string(buf.buffer) != "(7)" {
+		t.Errorf("buffer: want '(7)'; got %v", buf)
+	}
+}
+
+func TestMaxBatchRows(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.maxbatchrows = ch.URL, 3 })
+
+	resetStore()
+	defer resetStore()
+	key := "?query=INSERT%20INTO%20t%20VALUES"
+	store.add(key, key, "t", []byte("(1)"), []byte(","), 1)
+	store.add(key, key, "t", []byte("(2),(3)"), []byte(","), 2)
+	store.add(key, key, "t", []byte("(4)"), []byte(","), 1)
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	got := strings.Join(sent, " ")
+	mu.Unlock()
+	if want := "(1),(2),(3)"; got != want {
+		t.Errorf("sent: want %q; got %q", want, got)
+	}
+	store.RLock()
+	buf := store.Req[key]
+	store.RUnlock()
+	if buf == nil || string(buf.buffer) != "(4)" || buf.rowcount != 1 {
+		t.Errorf("buffer: want '(4)'; got %v", buf)
+	}
+}
+
+func TestTableHeader(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(map[string]string)
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent[extractTable("?"+r.URL.RawQuery)] = string(b)
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.tableheader, c.tablefooter = ch.URL, `headed:id\tname;other:x`, `headed:end` })
+
+	resetStore()
+	defer resetStore()
+	for _, tc := range []struct{ query, body string }{
+		{"/?query=INSERT%20INTO%20headed%20FORMAT%20TSVWithNames", "1\ta"},
+		{"/?query=INSERT%20INTO%20headed%20FORMAT%20TSVWithNames", "2\tb\n"},
+		{"/?query=INSERT%20INTO%20plain%20FORMAT%20TSV", "3\tc\n"},
+	} {
+		dorequest(httptest.NewRecorder(), httptest.NewRequest("POST", tc.query, strings.NewReader(tc.body)))
+	}
+	store.RLock()
+	rows := store.Req["/?query=INSERT%20INTO%20headed%20FORMAT%20TSVWithNames"].rowcount
+	store.RUnlock()
+	if rows != 2 {
+		t.Errorf("headed: want 2 rows; got %d", rows)
+	}
+	store.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "id\tname\n1\ta\n2\tb\nend"; sent["headed"] != want {
+		t.Errorf("headed: want %q; got %q", want, sent["headed"])
+	}
+	if want := "3\tc\n"; sent["plain"] != want {
+		t.Errorf("plain: want %q; got %q", want, sent["plain"])
+	}
+}
+
+func TestHeaderRows(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(map[string]string)
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent[insertFormat("?"+r.URL.RawQuery)] = string(b)
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+	resetStore()
+	defer resetStore()
+
+	for _, tc := range []struct {
+		format string
+		bodies []string
+		rows   int
+	}{
+		{"TSVWithNames", []string{"id\tname\n1\ta\n", "id\tname\n2\tb\n3\tc"}, 3},
+		{"CSVWithNames", []string{"id,name\n1,\"a\"\n", "id,name\n", "id,name\n2,\"b\"\n"}, 2},
+		{"TabSeparatedWithNames", []string{"id\n1\n", "id\n2\n"}, 2},
+		{"TSVWithNamesAndTypes", []string{"id\nUInt8\n1\n", "id\nUInt8\n2\n"}, 2},
+		{"CSVWithNamesAndTypes", []string{"id\nUInt8\n1\n", "id\nUInt8\n2\n"}, 2},
+	} {
+		key := "/?query=INSERT%20INTO%20t%20FORMAT%20" + tc.format
+		for _, body := range tc.bodies {
+			w := httptest.NewRecorder()
+			dorequest(w, httptest.NewRequest("POST", key, strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: want 200; got %d", tc.format, w.Code)
+			}
+		}
+		store.RLock()
+		rows := store.Req[key].rowcount
+		store.RUnlock()
+		if rows != tc.rows {
+			t.Errorf("%s: want %d rows; got %d", tc.format, tc.rows, rows)
+		}
+	}
+	store.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for format, want := range map[string]string{
+		"TSVWITHNAMES":          "id\tname\n1\ta\n2\tb\n3\tc\n",
+		"CSVWITHNAMES":          "id,name\n1,\"a\"\n2,\"b\"\n",
+		"TABSEPARATEDWITHNAMES": "id\n1\n2\n",
+		"TSVWITHNAMESANDTYPES":  "id\nUInt8\n1\n2\n",
+		"CSVWITHNAMESANDTYPES":  "id\nUInt8\n1\n2\n",
+	} {
+		if sent[format] != want {
+			t.Errorf("%s: want %q; got %q", format, want, sent[format])
+		}
+	}
+}
+
+func TestShutdownFlush(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractTable("?"+r.URL.RawQuery) != "final" {
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+	defer store.setInterval(store.syncInterval())
+
+	resetStore()
+	store.backgroundSender(3600)
+	time.Sleep(50 * time.Millisecond) // the first cycle is done, the next one is an hour away
+	key := "?query=INSERT%20INTO%20final%20VALUES"
+	store.add(key, key, "final", []byte("(1)"), []byte(","), 1)
+	store.shutdown(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0] != "(1)" {
+		t.Errorf("want the final batch sent on shutdown; got %q", sent)
+	}
+	if keys, _, _ := store.stats(); keys != 0 {
+		t.Errorf("want nothing left buffered; got %d keys", keys)
+	}
+}
+
+func TestFlushAged(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if table := extractTable("?" + r.URL.RawQuery); table == "old" || table == "fresh" {
+			mu.Lock()
+			sent = append(sent, table)
+			mu.Unlock()
+		}
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+
+	resetStore()
+	defer resetStore()
+	old, fresh := "?query=INSERT%20INTO%20old%20VALUES", "?query=INSERT%20INTO%20fresh%20VALUES"
+	store.add(old, old, "old", []byte("(1)"), []byte(","), 1)
+	store.add(fresh, fresh, "fresh", []byte("(2)"), []byte(","), 1)
+	store.Lock()
+	store.Req[old].created = time.Now().Add(-2 * time.Second)
+	store.Unlock()
+
+	if n := store.flushAged(time.Second); n != 1 {
+		t.Errorf("want 1 aged key; got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || sent[0] != "old" {
+		t.Errorf("want only the old key sent; got %q", sent)
+	}
+	if keys, _, _ := store.stats(); keys != 1 {
+		t.Errorf("want the fresh key buffered; got %d keys", keys)
+	}
+}
+
+func TestBackgroundSenderTicks(t *testing.T) {
+	var mu sync.Mutex
+	var flushed []time.Time
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractTable("?"+r.URL.RawQuery) == "ticks" {
+			mu.Lock()
+			flushed = append(flushed, time.Now())
+			mu.Unlock()
+		}
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+	defer store.setInterval(store.syncInterval())
+
+	resetStore()
+	key := "?query=INSERT%20INTO%20ticks%20VALUES"
+	store.add(key, key, "ticks", []byte("(1)"), []byte(","), 1)
+	start := time.Now()
+	store.backgroundSender(1)
+	defer resetStore()
+	defer store.cancelSyncer()
+	time.Sleep(100 * time.Millisecond)
+	store.add(key, key, "ticks", []byte("(2)"), []byte(","), 1)
+	time.Sleep(1100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(flushed) != 2 {
+		t.Fatalf("want 2 flushes; got %d", len(flushed))
+	}
+	if first := flushed[0].Sub(start); first > 100*time.Millisecond {
+		t.Errorf("first flush: want right away; got after %s", first)
+	}
+	if interval := flushed[1].Sub(flushed[0]); interval < 900*time.Millisecond || interval > 1100*time.Millisecond {
+		t.Errorf("interval: want about 1s; got %s", interval)
+	}
+}
+
+func TestFormatMismatch(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractTable("?"+r.URL.RawQuery) != "mixed" {
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, insertFormat("?"+r.URL.RawQuery)+" "+string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+
+	resetStore()
+	// keyparams left the query out of the key
+	key := "/?database=db"
+	tsv := "?query=INSERT%20INTO%20mixed%20FORMAT%20TSV&query_id=1"
+	tsv2 := "?query=INSERT%20INTO%20mixed%20FORMAT%20TSV&query_id=2"
+	json := "?query=INSERT%20INTO%20mixed%20FORMAT%20JSONEachRow"
+	store.add(key, tsv, "mixed", []byte("1\n"), nil, 1)
+	store.add(key, tsv2, "mixed", []byte("2\n"), nil, 1)
+	store.add(key, json, "mixed", []byte(`{"a":3}`), nil, 1)
+	time.Sleep(100 * time.Millisecond)
+	store.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"TSV 1\n2\n", `JSONEACHROW {"a":3}`}; strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("want %q; got %q", want, sent)
+	}
+
+	for uri, want := range map[string]string{
+		"?query=INSERT%20INTO%20t%20VALUES":                   "VALUES",
+		"?query=insert+into+t+format+csv":                     "CSV",
+		"/?query=INSERT%20INTO%20t%20FORMAT%20TSV&database=x": "TSV",
+		"?database=x": "VALUES",
+	} {
+		if got := insertFormat(uri); got != want {
+			t.Errorf("%s: want %s; got %s", uri, want, got)
+		}
+	}
+}
+
+func TestSplitRows(t *testing.T) {
+	for _, tc := range []struct {
+		batch, format string
+		max           int
+		want, rows    string
+	}{
+		{"(1),(2),(3)", "VALUES", 8, "(1),(2)|(3)", "2|1"},
+		{"(1),(2),(3)", "VALUES", 3, "(1)|(2)|(3)", "1|1|1"},
+		{"(100000),(2)", "VALUES", 3, "(100000)|(2)", "1|1"},
+		{"(1), (2)", "VALUES", 4, "(1)| (2)", "1|1"},
+		{"(1),(2),", "VALUES", 4, "(1)|(2),", "1|1"},
+		{"('a),b'),(2)", "VALUES", 8, "('a),b')|(2)", "1|1"},
+		{"('it\\'s),'),('x''),'),(3)", "VALUES", 12, "('it\\'s),')|('x''),')|(3)", "1|1|1"},
+		{"((1,2),[3]),(4)", "VALUES", 12, "((1,2),[3])|(4)", "1|1"},
+		{"1\n2\n3\n", "TSV", 4, "1\n2\n|3\n", "2|1"},
+		{"1\n22222\n3\n", "TSV", 4, "1\n|22222\n|3\n", "1|1|1"},
+		{"1\n2\n", "TSV", 10, "1\n2\n", "2"},
+		{"1\n2", "TSV", 2, "1\n|2", "1|1"},
+		{"1,\"a\nb\"\n2,c\n", "CSV", 6, "1,\"a\nb\"\n|2,c\n", "1|1"},
+		{"{\"a\":1}\n{\"a\":2}\n", "JSONEACHROW", 8, "{\"a\":1}\n|{\"a\":2}\n", "1|1"},
+		{"id\n1\n2\n", "TSVWITHNAMES", 2, "", ""},
+		{"[1,\n2]", "JSON", 2, "", ""},
+	} {
+		var got, rows []string
+		chunks, counts := splitRows([]byte(tc.batch), tc.format, tc.max)
+		for i, chunk := range chunks {
+			got, rows = append(got, string(chunk)), append(rows, strconv.Itoa(counts[i]))
+		}
+		if strings.Join(got, "|") != tc.want || strings.Join(rows, "|") != tc.rows {
+			t.Errorf("%q by %d: want %q of %s rows; got %q of %s", tc.batch, tc.max, tc.want, tc.rows, strings.Join(got, "|"), strings.Join(rows, "|"))
+		}
+	}
+
+	if got := chunkURI("?query=INSERT%20INTO%20t%20VALUES", 1); got != "?query=INSERT%20INTO%20t%20VALUES" {
+		t.Errorf("no token: want the uri as is; got %s", got)
+	}
+	if got := chunkURI("/?insert_deduplication_token=abc&query=x", 2); got != "/?insert_deduplication_token=abc_2&query=x" {
+		t.Errorf("token: want abc_2; got %s", got)
+	}
+}
+
+func TestSendBufferChunks(t *testing.T) {
+	inTempDir(t)
+	var mu sync.Mutex
+	var sent []string
+	fail := ""
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if fail != "" && strings.Contains(string(b), fail) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sent = append(sent, r.URL.Query().Get("insert_deduplication_token")+" "+string(b))
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.chunkbytes, c.resendint = ch.URL, 8, 0 })
+	uri := "?query=INSERT%20INTO%20t%20VALUES&insert_deduplication_token=tok"
+
+	for _, tc := range []struct {
+		fail  string
+		sent  string
+		files int
+	}{
+		{"", "tok_0 (1),(2)|tok_1 (3),(4)|tok_2 (5)", 0},
+		{"(", "", 3},
+		{"(3)", "tok_0 (1),(2)|tok_2 (5)", 1},
+	} {
+		mu.Lock()
+		sent, fail = nil, tc.fail
+		mu.Unlock()
+		os.RemoveAll(ERROR_DIR)
+		os.Mkdir(ERROR_DIR, 0755)
+		sendBuffer(context.Background(), &Buffer{uri: uri, table: "t", buffer: []byte("(1),(2),(3),(4),(5)"), rowcount: 5}, nil)
+		mu.Lock()
+		if got := strings.Join(sent, "|"); got != tc.sent {
+			t.Errorf("fail %q: want sent %q; got %q", tc.fail, tc.sent, got)
+		}
+		mu.Unlock()
+		if files, _ := filePathWalkDir(ERROR_DIR); len(files) != tc.files {
+			t.Errorf("fail %q: want %d error files; got %d", tc.fail, tc.files, len(files))
+		}
+	}
+
+	// the failed chunk is resent with its own token
+	mu.Lock()
+	sent, fail = nil, ""
+	mu.Unlock()
+	checkErr()
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(sent, "|"); got != "tok_1 (3),(4)" {
+		t.Errorf("resend: want 'tok_1 (3),(4)'; got %q", got)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	inTempDir(t)
+	var mu sync.Mutex
+	var upstream, sibling []string
+	record := func(to *[]string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			*to = append(*to, r.URL.Path+"?"+r.URL.RawQuery+" "+string(b))
+			mu.Unlock()
+		}
+	}
+	ch := httptest.NewServer(record(&upstream))
+	defer ch.Close()
+	sib := httptest.NewServer(record(&sibling))
+	defer sib.Close()
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = ch.URL })
+	uri := "?query=INSERT%20INTO%20t%20VALUES"
+
+	for _, tc := range []struct {
+		name     string
+		handoff  string
+		upstream string
+		sibling  string
+	}{
+		{"sibling up", sib.URL, "", "/?query=INSERT%20INTO%20t%20VALUES (1),(2)"},
+		{"sibling down", "http://127.0.0.1:1", "/?query=INSERT%20INTO%20t%20VALUES (1),(2)", ""},
+		{"sibling hangs", hung.URL, "/?query=INSERT%20INTO%20t%20VALUES (1),(2)", ""},
+	} {
+		mu.Lock()
+		upstream, sibling = nil, nil
+		mu.Unlock()
+		configure(func(c *Config) { c.handoff = tc.handoff })
+		resetStore()
+		store.add("/"+uri, uri, "t", []byte("(1)"), []byte(","), 1)
+		store.add("/"+uri, uri, "t", []byte("(2)"), []byte(","), 1)
+		store.shutdown(time.Second)
+
+		mu.Lock()
+		if got := strings.Join(upstream, "|"); got != tc.upstream {
+			t.Errorf("%s: upstream want %q; got %q", tc.name, tc.upstream, got)
+		}
+		if got := strings.Join(sibling, "|"); got != tc.sibling {
+			t.Errorf("%s: sibling want %q; got %q", tc.name, tc.sibling, got)
+		}
+		mu.Unlock()
+		if keys, _, _ := store.stats(); keys != 0 {
+			t.Errorf("%s: want nothing left buffered; got %d keys", tc.name, keys)
+		}
+	}
+}
+
+// flakyTransport fails the first fails requests with the error or status
+type flakyTransport struct {
+	fails, calls int
+	err          error
+	status       int
+}
+
+func (rt *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.calls++
+	ioutil.ReadAll(req.Body)
+	status := http.StatusOK
+	if rt.calls <= rt.fails {
+		if rt.err != nil {
+			return nil, rt.err
+		}
+		status = rt.status
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+}
+
+func TestFlushRetries(t *testing.T) {
+	inTempDir(t)
+	defer func(c *http.Client, cf Config) { client = c; restoreConfig(cf) }(client, *cfg())
+	configure(func(c *Config) { c.flushretries, c.flushretrydelay = 2, 1 })
+
+	for _, tc := range []struct {
+		name   string
+		rt     *flakyTransport
+		status bool
+		calls  int
+		files  int
+	}{
+		{"transient error", &flakyTransport{fails: 2, err: errors.New("connection refused")}, false, 3, 0},
+		{"persistent error", &flakyTransport{fails: 5, err: errors.New("connection refused")}, false, 3, 1},
+		{"status not retried", &flakyTransport{fails: 1, status: http.StatusInternalServerError}, false, 1, 1},
+		{"status retried", &flakyTransport{fails: 1, status: http.StatusInternalServerError}, true, 2, 0},
+	} {
+		os.RemoveAll(ERROR_DIR)
+		os.Mkdir(ERROR_DIR, 0755)
+		client = &http.Client{Transport: tc.rt}
+		configure(func(c *Config) { c.flushretrystatus = tc.status })
+		sendBuffer(context.Background(), &Buffer{uri: "?query=INSERT%20INTO%20t%20VALUES", table: "t", buffer: []byte("(1)"), rowcount: 1}, nil)
+		if tc.rt.calls != tc.calls {
+			t.Errorf("%s: want %d calls; got %d", tc.name, tc.calls, tc.rt.calls)
+		}
+		if files, _ := filePathWalkDir(ERROR_DIR); len(files) != tc.files {
+			t.Errorf("%s: want %d error files; got %d", tc.name, tc.files, len(files))
+		}
+	}
+}
+
+func TestFlushRetryUnlocked(t *testing.T) {
+	inTempDir(t)
+	defer func(c *http.Client, cf Config) { client = c; restoreConfig(cf) }(client, *cfg())
+	rt := &flakyTransport{fails: 1, err: errors.New("connection refused")}
+	client = &http.Client{Transport: rt}
+	configure(func(c *Config) { c.flushretries, c.flushretrydelay = 1, 300 })
+
+	resetStore()
+	defer resetStore()
+	key := "?query=INSERT%20INTO%20t%20VALUES"
+	store.add(key, key, "t", []byte("(1)"), []byte(","), 1)
+	done := make(chan struct{})
+	go func() {
+		store.flush()
+		close(done)
+	}()
+	// the retry waits 300ms, the lock is free long before
+	locked := false
+	for deadline := time.Now().Add(200 * time.Millisecond); !locked && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		locked = store.flushMu.TryLock()
+	}
+	if !locked {
+		t.Fatal("want flushMu released while the failed batch waits for its retry")
+	}
+	store.flushMu.Unlock()
+	select {
+	case <-done:
+		t.Error("want the flush still retrying")
+	default:
+	}
+	<-done
+	if rt.calls != 2 {
+		t.Errorf("want 2 calls; got %d", rt.calls)
+	}
+	if files, _ := filePathWalkDir(ERROR_DIR); len(files) != 0 {
+		t.Errorf("want no error files; got %d", len(files))
+	}
+}
+
+func TestBufferCapacity(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.maxbatchbytes = 0 })
+	store.Lock()
+	delete(store.flushed, "learned")
+	if got := store.capacity("learned"); got != buffersize {
+		t.Errorf("new table: want %d; got %d", buffersize, got)
+	}
+	store.learn(&Buffer{table: "learned", buffer: make([]byte, 40000)})
+	store.learn(&Buffer{table: "learned", buffer: make([]byte, 80000)})
+	if got := store.capacity("learned"); got != 50000 {
+		t.Errorf("learned: want 50000; got %d", got)
+	}
+	configure(func(c *Config) { c.maxbatchbytes = 20000 })
+	if got := store.capacity("learned"); got != 20000 {
+		t.Errorf("maxbatchbytes: want 20000; got %d", got)
+	}
+	configure(func(c *Config) { c.maxbatchbytes = 0 })
+	store.flushed["learned"] = 100 << 20
+	if got := store.capacity("learned"); got != maxCapacity {
+		t.Errorf("unbounded: want %d; got %d", maxCapacity, got)
+	}
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.maxstorebytes = 1 << 20 })
+	if got := store.capacity("learned"); got != 1<<20 {
+		t.Errorf("maxstorebytes: want %d; got %d", 1<<20, got)
+	}
+	delete(store.flushed, "learned")
+	store.Unlock()
+}
+
+// BenchmarkAddLargeTable adds 64KB to a new key of a table per op, fixed
+// starts every key at buffersize, adaptive at the learned flushed size
+func BenchmarkAddLargeTable(b *testing.B) {
+	body := bytes.Repeat([]byte("(1),"), 256)
+	key := "?query=INSERT%20INTO%20large%20VALUES"
+	for _, adaptive := range []bool{false, true} {
+		name := "fixed"
+		if adaptive {
+			name = "adaptive"
+		}
+		b.Run(name, func(b *testing.B) {
+			resetStore()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 64; j++ {
+					store.add(key, key, "large", body, []byte(","), 256)
+				}
+				store.Lock()
+				store.remove(key)
+				if !adaptive {
+					delete(store.flushed, "large")
+				}
+				store.Unlock()
+			}
+		})
+	}
+}
+
+func TestTableSyncSec(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, string(b))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer func(c Config) { restoreConfig(c); setTableIntervals() }(*cfg())
+	configure(func(c *Config) { c.fwd, c.tablesyncsec = ch.URL, "events:1;Logs:30" })
+	setTableIntervals()
+	if got := tableInterval("logs"); got != 30*time.Second {
+		t.Errorf("logs interval: want 30s; got %v", got)
+	}
+	if got := tableInterval("other"); got != 0 {
+		t.Errorf("other interval: want 0; got %v", got)
+	}
+
+	resetStore()
+	defer resetStore()
+	sentAfter := func(f func()) string {
+		f()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		got := strings.Join(sent, " ")
+		sent = nil
+		return got
+	}
+	events, other := "?query=INSERT%20INTO%20events%20VALUES", "?query=INSERT%20INTO%20other%20VALUES"
+	store.add(events, events, "events", []byte("(1)"), []byte(","), 1)
+	store.add(other, other, "other", []byte("(2)"), []byte(","), 1)
+	if got := sentAfter(store.flushCycle); got != "(2)" {
+		t.Errorf("sync cycle: want '(2)'; got %q", got)
+	}
+	if got := sentAfter(func() { store.flushTables() }); got != "" {
+		t.Errorf("table sync before 1s: want nothing; got %q", got)
+	}
+	store.Lock()
+	store.Req[events].created = time.Now().Add(-time.Second)
+	store.Unlock()
+	if got := sentAfter(func() { store.flushTables() }); got != "(1)" {
+		t.Errorf("table sync after 1s: want '(1)'; got %q", got)
+	}
+
+	store.add(events, events, "events", []byte("(3)"), []byte(","), 1)
+	if got := sentAfter(func() { store.flushContext(context.Background()) }); got != "(3)" {
+		t.Errorf("full flush: want '(3)'; got %q", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogFacility is daemon, the priority is facility*8 + level, the LEVEL_
+// constants are the syslog severities
+const syslogFacility = 3
+
+// Syslog sends RFC5424 messages to the local syslog socket or a remote
+// server, over tcp they are octet counted (RFC6587)
+type Syslog struct {
+	Network  string // unixgram or unix for local, udp or tcp
+	Addr     string
+	Hostname string
+	App      string
+	conn     net.Conn
+}
+
+// NewSyslog parses the -syslog address: local, udp://host:514 or tcp://host:514
+func NewSyslog(addr string) (*Syslog, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	sl := &Syslog{Hostname: hostname, App: filepath.Base(os.Args[0])}
+	if addr == "local" {
+		return sl, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("syslog %q: want local, udp://host:port or tcp://host:port", addr)
+	}
+	sl.Network, sl.Addr = u.Scheme, u.Host
+	if u.Port() == "" {
+		sl.Addr = net.JoinHostPort(u.Host, "514")
+	}
+	return sl, nil
+}
+
+// Name is the sink name in the log when it is unreachable
+func (sl *Syslog) Name() string {
+	return "Syslog"
+}
+
+// dial connects to the server, locally to the first socket that answers
+func (sl *Syslog) dial() (conn net.Conn, err error) {
+	if sl.Network != "" {
+		return net.DialTimeout(sl.Network, sl.Addr, 5*time.Second)
+	}
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if conn, err = net.Dial(network, path); err == nil {
+				sl.Network, sl.Addr = network, path
+				return conn, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// Dial connects to syslog, up to attempts times with the backoff between them
+func (sl *Syslog) Dial(attempts int, backoff Backoff) (err error) {
+	for i := 0; i == 0 || i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff.Delay(i - 1))
+		}
+		if sl.conn, err = sl.dial(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Format builds the RFC5424 message, tcp messages get the length prefix and
+// the local stream socket a newline
+func (sl *Syslog) Format(level uint8, msg string, now time.Time) []byte {
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", syslogFacility*8+int(level),
+		now.Format(time.RFC3339Nano), sl.Hostname, sl.App, os.Getpid(), msg)
+	switch sl.Network {
+	case "tcp":
+		return []byte(strconv.Itoa(len(line)) + " " + line)
+	case "unix":
+		return []byte(line + "\n")
+	}
+	return []byte(line)
+}
+
+// Log sends the message formatted as on stdout (-logformat), a broken
+// connection is dialed again and the message sent once more
+func (sl *Syslog) Log(level uint8, data ...interface{}) {
+	var buf bytes.Buffer
+	writeLog(&buf, level, data...)
+	msg := strings.TrimSuffix(buf.String(), "\n")
+	for attempt := 0; attempt < 2; attempt++ {
+		if sl.conn == nil {
+			conn, err := sl.dial()
+			if err != nil {
+				return
+			}
+			sl.conn = conn
+		}
+		sl.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := sl.conn.Write(sl.Format(level, msg, time.Now())); err == nil {
+			return
+		}
+		sl.conn.Close()
+		sl.conn = nil
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSyslog(t *testing.T) {
+	for addr, want := range map[string]string{
+		"local":              "",
+		"udp://10.0.0.1":     "udp 10.0.0.1:514",
+		"tcp://logs:6514":    "tcp logs:6514",
+		"http://logs:514":    "error",
+		"udp://":             "error",
+		"10.0.0.1:514":       "error",
+		"tcp://[::1]:1514":   "tcp [::1]:1514",
+		"udp://log.internal": "udp log.internal:514",
+	} {
+		sl, err := NewSyslog(addr)
+		got := "error"
+		if err == nil {
+			got = strings.TrimSpace(sl.Network + " " + sl.Addr)
+		}
+		if got != want {
+			t.Errorf("%s: want %q; got %q", addr, want, got)
+		}
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sl, _ := NewSyslog("tcp://" + ln.Addr().String())
+	sl.Hostname, sl.App = "host1", "proxyhouse"
+	q := NewLogQueue(sl, 10, 1, Backoff{})
+	q.Log(LEVEL_ERR, "Request error:", Fields{"table": "t"})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	size, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		t.Fatalf("want an octet count; got %q", size)
+	}
+	line := make([]byte, n)
+	if _, err := io.ReadFull(r, line); err != nil {
+		t.Fatal(err)
+	}
+	if want := regexp.MustCompile(`^<27>1 \S+ host1 proxyhouse \d+ - - Request error: table=t$`); !want.MatchString(string(line)) {
+		t.Errorf("want %s; got %q", want, line)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// tlsConfig returns the client TLS config trusting the PEM certificates of
+// the ca file, the system roots without one
+func tlsConfig(ca string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if ca == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", ca)
+	}
+	return config, nil
+}
+
+// clientAuth returns the server TLS config requiring client certificates
+// signed by the CAs of the PEM bundle
+func clientAuth(ca string) (*tls.Config, error) {
+	pool, err := tlsConfig(ca)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{ClientCAs: pool.RootCAs, ClientAuth: tls.RequireAndVerifyClientCert}, nil
+}
+
+// upstreamTLS returns the TLS config of https -fwd in c: the -upca roots,
+// the -upcert client certificate and the -upservername SNI
+func upstreamTLS(c *Config) (*tls.Config, error) {
+	config, err := tlsConfig(c.upca)
+	if err != nil {
+		return nil, err
+	}
+	if c.upcert != "" && c.upkey != "" {
+		cert, err := tls.LoadX509KeyPair(c.upcert, c.upkey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	config.ServerName = c.upservername
+	config.InsecureSkipVerify = c.upinsecure
+	return config, nil
+}
+
+// listenAndServe listens on the server address and serves it, https with -tlscert.
+// With proxy every connection starts with the PROXY protocol header
+func listenAndServe(server *http.Server, proxy bool) error {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	if proxy {
+		ln = &proxyListener{Listener: ln, timeout: time.Duration(cfg().readtimeout) * time.Second}
+	}
+	return serve(server, ln)
+}
+
+// serve serves the listener, https with -tlscert and -tlskey
+func serve(server *http.Server, ln net.Listener) error {
+	if cfg().tlscert == "" {
+		return server.Serve(ln)
+	}
+	return server.ServeTLS(ln, cfg().tlscert, cfg().tlskey)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a certificate for 127.0.0.1 and the name and its key to dir, signed by
+// the parent or self signed without one, and returns the files
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (certFile, keyFile string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{name},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, cert, key
+}
+
+func TestServeTLS(t *testing.T) {
+	defer restoreConfig(*cfg())
+	dir := t.TempDir()
+	cert, key, _, _ := writeCert(t, dir, "server", nil, nil)
+	configure(func(c *Config) { c.tlscert, c.tlskey = cert, key })
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go serve(server, ln)
+	defer server.Close()
+
+	config, err := tlsConfig(cfg().tlscert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("https: want ok; got %q", body)
+	}
+	if resp, err := http.Get("http://" + ln.Addr().String() + "/"); err == nil {
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("plain http: want 400; got %d", resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+
+	configure(func(c *Config) { c.tlskey = "" })
+	if problems := strings.Join(validateFlags(cfg()), "\n"); !strings.Contains(problems, "-tlscert and -tlskey") {
+		t.Errorf("want a problem without the key; got %q", problems)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	defer restoreConfig(*cfg())
+	dir := t.TempDir()
+	cert, key, _, _ := writeCert(t, dir, "server", nil, nil)
+	configure(func(c *Config) { c.tlscert, c.tlskey = cert, key })
+	caFile, _, ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	clientCert, clientKey, _, _ := writeCert(t, dir, "client", ca, caKey)
+	otherCert, otherKey, _, _ := writeCert(t, dir, "other", nil, nil)
+	configure(func(c *Config) { c.tlsclientca = caFile })
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	if server.TLSConfig, err = clientAuth(cfg().tlsclientca); err != nil {
+		t.Fatal(err)
+	}
+	go serve(server, ln)
+	defer server.Close()
+
+	get := func(certFile, keyFile string) (string, error) {
+		config, _ := tlsConfig(cfg().tlscert)
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), nil
+	}
+	if got, err := get(clientCert, clientKey); err != nil || got != "client" {
+		t.Errorf("signed client: want client; got %q %v", got, err)
+	}
+	if _, err := get("", ""); err == nil {
+		t.Error("no client certificate: want an error")
+	}
+	if _, err := get(otherCert, otherKey); err == nil {
+		t.Error("client certificate of another CA: want an error")
+	}
+
+	configure(func(c *Config) { c.tlscert = "" })
+	if problems := strings.Join(validateFlags(cfg()), "\n"); !strings.Contains(problems, "-tlsclientca") {
+		t.Errorf("want a problem without https; got %q", problems)
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	defer func(c *http.Client, cf Config) { client = c; restoreConfig(cf) }(client, *cfg())
+	dir := t.TempDir()
+	caFile, _, ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	serverCert, serverKey, _, _ := writeCert(t, dir, "clickhouse.internal", ca, caKey)
+	clientCert, clientKey, _, _ := writeCert(t, dir, "proxyhouse", ca, caKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sni, peer string
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sni, peer = r.TLS.ServerName, r.TLS.PeerCertificates[0].Subject.CommonName
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	if server.TLSConfig, err = clientAuth(caFile); err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, serverCert, serverKey)
+	defer server.Close()
+
+	configure(func(c *Config) { c.fwd = "https://" + ln.Addr().String() })
+	configure(func(c *Config) {
+		c.upca, c.upcert, c.upkey, c.upservername = caFile, clientCert, clientKey, "clickhouse.internal"
+	})
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+	client = testClient(t)
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sni != "clickhouse.internal" || peer != "proxyhouse" {
+		t.Errorf("want sni clickhouse.internal and client proxyhouse; got %q %q", sni, peer)
+	}
+
+	configure(func(c *Config) { c.upservername = "other.internal" })
+	client = testClient(t)
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err == nil {
+		t.Error("server name not in the certificate: want an error")
+	}
+	configure(func(c *Config) { c.upinsecure = true })
+	client = testClient(t)
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err != nil {
+		t.Errorf("-upinsecure: %v", err)
+	}
+
+	configure(func(c *Config) { c.upkey = "" })
+	if problems := strings.Join(validateFlags(cfg()), "\n"); !strings.Contains(problems, "-upcert and -upkey") {
+		t.Errorf("want a problem without -upkey; got %q", problems)
+	}
+	configure(func(c *Config) { c.upca = filepath.Join(dir, "missing.pem") })
+	if _, err := newClient(); err == nil {
+		t.Error("missing -upca: want a client error")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+)
+
+// traceparentRe is a W3C trace context header: version-trace id-span id-flags
+var traceparentRe = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+const zeroTraceID = "00000000000000000000000000000000"
+
+type traceKey struct{}
+
+// childTraceparent returns a traceparent in the trace of parent with a new
+// span id, a new sampled trace when parent is empty or invalid
+func childTraceparent(parent string) string {
+	traceID, flags := randomHex(16), "01"
+	if m := traceparentRe.FindStringSubmatch(parent); m != nil && m[1] != zeroTraceID {
+		traceID, flags = m[1], m[3]
+	}
+	return "00-" + traceID + "-" + randomHex(8) + "-" + flags
+}
+
+// traceID returns the trace id of a valid traceparent
+func traceID(traceparent string) string {
+	if m := traceparentRe.FindStringSubmatch(traceparent); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withTrace returns ctx carrying the traceparent the upstream requests continue
+func withTrace(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceparent)
+}
+
+// traceFrom returns the traceparent of ctx, empty without one
+func traceFrom(ctx context.Context) string {
+	traceparent, _ := ctx.Value(traceKey{}).(string)
+	return traceparent
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChildTraceparent(t *testing.T) {
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	child := childTraceparent(parent)
+	if traceID(child) != "4bf92f3577b34da6a3ce929d0e0e4736" || child == parent || !strings.HasSuffix(child, "-01") {
+		t.Errorf("want the parent trace with a new span; got %s", child)
+	}
+	for _, bad := range []string{"", "garbage", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+		if child := childTraceparent(bad); traceID(child) == "" || strings.Contains(child, "00000000000000000000000000000000") {
+			t.Errorf("%q: want a new trace; got %s", bad, child)
+		}
+	}
+}
+
+func TestTracingFlush(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Header.Get("traceparent"))
+		mu.Unlock()
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.tracing = ch.URL, true })
+	resetStore()
+	defer resetStore()
+
+	for _, tp := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-11111111111111111111111111111111-00f067aa0ba902b7-01"} {
+		req := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20traced%20VALUES", strings.NewReader("(1)"))
+		if tp != "" {
+			req.Header.Set("traceparent", tp)
+		}
+		dorequest(httptest.NewRecorder(), req)
+	}
+	store.flush()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || traceID(got[0]) != "4bf92f3577b34da6a3ce929d0e0e4736" || strings.Contains(got[0], "00f067aa0ba902b7") {
+		t.Errorf("want the batch sent in the first client trace with its own span; got %q", got)
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// client sends requests upstream, set up by newClient from -fwd
+var client = http.DefaultClient
+
+// Inflight counts bytes being sent upstream and blocks senders over -maxinflightbytes
+type Inflight struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	bytes int64
+}
+
+var inflight = newInflight()
+
+func newInflight() *Inflight {
+	f := &Inflight{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// acquire waits until n bytes fit under the limit, a batch bigger than the
+// limit goes alone when nothing else is in flight
+func (f *Inflight) acquire(n int64, limit int64) {
+	f.mu.Lock()
+	for limit > 0 && f.bytes > 0 && f.bytes+n > limit {
+		f.cond.Wait()
+	}
+	f.bytes += n
+	f.mu.Unlock()
+}
+
+func (f *Inflight) release(n int64) {
+	f.mu.Lock()
+	f.bytes -= n
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// Bytes returns the bytes in flight
+func (f *Inflight) Bytes() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bytes
+}
+
+// upstream returns the url base the key is forwarded to, the -fwd hosts in
+// turn or the host of its -shardby key, and the unix socket path when -fwd
+// is unix:///path
+func upstream(key string) (base, socket string) {
+	return selectUpstream(key, upstreamHealth.next)
+}
+
+// peekUpstream is upstream without taking the turn of the round-robin, for
+// the dry runs that must not shift the traffic
+func peekUpstream(key string) (base, socket string) {
+	return selectUpstream(key, upstreamHealth.peek)
+}
+
+// isUnix is true for a -fwd of unix:///path, the client dials the socket
+// path it has at start
+func isUnix(list string) bool {
+	return strings.HasPrefix(list, "unix://")
+}
+
+// selectUpstream is upstream with next picking from the -fwd list
+func selectUpstream(key string, next func(bases []string, weights []int) string) (base, socket string) {
+	list := fwdList()
+	if isUnix(list) {
+		return "http://unix", strings.TrimPrefix(list, "unix://")
+	}
+	bases, weights := upstreamWeights(list)
+	if cfg().shardby != "" && len(bases) > 1 {
+		return shardRing().Get(shardKey(key), upstreamHealth.Ejected), ""
+	}
+	return next(bases, weights), ""
+}
+
+// upstreams splits the comma separated -fwd list, without the weights
+func upstreams(list string) []string {
+	bases, _ := upstreamWeights(list)
+	return bases
+}
+
+// upstreamWeights splits the comma separated -fwd list of host*weight,
+// a host without a weight or with a bad one (validateFlags tells) weighs 1
+func upstreamWeights(list string) (bases []string, weights []int) {
+	for _, base := range strings.Split(list, ",") {
+		if base = strings.TrimSpace(base); base == "" {
+			continue
+		}
+		weight := 1
+		if pos := strings.LastIndex(base, "*"); pos > 0 {
+			if w, err := strconv.Atoi(base[pos+1:]); err == nil && w > 0 {
+				weight = w
+			}
+			base = base[:pos]
+		}
+		bases = append(bases, base)
+		weights = append(weights, weight)
+	}
+	return bases, weights
+}
+
+// failoverBases returns the hosts a failed send to base is tried on, in
+// order: the other -fwd hosts in the rotation, the SRV backups and then the
+// -failover ones
+func failoverBases(base string) (bases []string) {
+	candidates := upstreams(failoverList())
+	if list := fwdList(); !strings.HasPrefix(list, "unix://") {
+		candidates = append(upstreams(list), candidates...)
+	}
+	for _, b := range candidates {
+		if b != base && !upstreamHealth.Ejected(b) {
+			bases = append(bases, b)
+		}
+	}
+	return bases
+}
+
+// sendTo posts the batch to the uri, err is set for a status isOKStatus rejects:
+// anything but a 2xx, or with -okstatus anything not listed
+func sendTo(ctx context.Context, uri string, val []byte, traceparent string) (resp *http.Response, code int, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewReader(val))
+	if err != nil {
+		return nil, 0, err
+	}
+	if traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
+	if resp, err = do(req); err != nil {
+		return nil, 0, err
+	}
+	if !isOKStatus(resp.StatusCode) {
+		err = fmt.Errorf("Error: response code %d", resp.StatusCode)
+	}
+	return resp, resp.StatusCode, err
+}
+
+// UpstreamHealth counts consecutive failures by upstream base, with -ejectafter
+// an upstream over the limit is out of the rotation until a probe succeeds
+type UpstreamHealth struct {
+	sync.Mutex
+	failures map[string]int
+	ejected  map[string]time.Time
+	current  map[string]int
+}
+
+var upstreamHealth = newUpstreamHealth()
+
+func newUpstreamHealth() *UpstreamHealth {
+	return &UpstreamHealth{failures: make(map[string]int), ejected: make(map[string]time.Time), current: make(map[string]int)}
+}
+
+// Result records a send to the upstream, ok is false on connection errors and 5xx
+func (h *UpstreamHealth) Result(base string, ok bool) {
+	h.Lock()
+	defer h.Unlock()
+	if ok {
+		h.failures[base] = 0
+		if _, ejected := h.ejected[base]; ejected {
+			delete(h.ejected, base)
+			grlog(LEVEL_WARN, "Upstream reinstated: ", hidePassword(base), Fields{"component": "upstream"})
+			gr.SimpleSend(fmt.Sprintf("%s.upstream_reinstated", cfg().graphiteprefix), "1")
+		}
+		return
+	}
+	h.failures[base]++
+	if _, ejected := h.ejected[base]; !ejected && cfg().ejectafter > 0 && h.failures[base] >= cfg().ejectafter {
+		h.ejected[base] = time.Now()
+		grlog(LEVEL_WARN, "Upstream ejected after ", h.failures[base], " failures: ", hidePassword(base), Fields{"component": "upstream"})
+		gr.SimpleSend(fmt.Sprintf("%s.upstream_ejected", cfg().graphiteprefix), "1")
+	}
+}
+
+// pick returns the first upstream in the rotation, when all of them are
+// ejected the first one, so flushes keep going while nothing is healthy
+func (h *UpstreamHealth) pick(bases []string) string {
+	h.Lock()
+	defer h.Unlock()
+	for _, base := range bases {
+		if _, ejected := h.ejected[base]; !ejected {
+			return base
+		}
+	}
+	return bases[0]
+}
+
+// next returns the upstreams by smooth weighted round-robin (as nginx does),
+// a host of weight 3 gets 3 flushes of 4 next to one of weight 1 and they
+// are interleaved. The ejected ones are skipped, when all of them are
+// ejected they all still get the flushes in turn
+func (h *UpstreamHealth) next(bases []string, weights []int) string {
+	return h.choose(bases, weights, true)
+}
+
+// peek returns the upstream next would, without advancing the round-robin
+func (h *UpstreamHealth) peek(bases []string, weights []int) string {
+	return h.choose(bases, weights, false)
+}
+
+// choose is next, the round-robin state is only changed with advance
+func (h *UpstreamHealth) choose(bases []string, weights []int, advance bool) string {
+	h.Lock()
+	defer h.Unlock()
+	healthy := 0
+	for _, base := range bases {
+		if _, ejected := h.ejected[base]; !ejected {
+			healthy++
+		}
+	}
+	current := make(map[string]int, len(bases))
+	best, total := "", 0
+	for i, base := range bases {
+		if _, ejected := h.ejected[base]; ejected && healthy > 0 {
+			continue
+		}
+		current[base] = h.current[base] + weights[i]
+		total += weights[i]
+		if best == "" || current[base] > current[best] {
+			best = base
+		}
+	}
+	if advance {
+		for base, c := range current {
+			h.current[base] = c
+		}
+		h.current[best] -= total
+	}
+	return best
+}
+
+// Ejected reports whether the upstream is out of the rotation
+func (h *UpstreamHealth) Ejected(base string) bool {
+	h.Lock()
+	defer h.Unlock()
+	_, ejected := h.ejected[base]
+	return ejected
+}
+
+// States returns "ok" or "ejected" for every upstream sent to, sorted by base
+func (h *UpstreamHealth) States() [][2]string {
+	h.Lock()
+	defer h.Unlock()
+	states := make([][2]string, 0, len(h.failures))
+	for base := range h.failures {
+		state := "ok"
+		if _, ejected := h.ejected[base]; ejected {
+			state = "ejected"
+		}
+		states = append(states, [2]string{base, state})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i][0] < states[j][0] })
+	return states
+}
+
+// probe checks /ping of the ejected upstreams and reinstates those answering 200.
+// With -healthcheck every -fwd and -failover host is checked and a failed ping
+// counts as a failed send, so a down host is ejected before a flush finds it
+func (h *UpstreamHealth) probe(timeout time.Duration) {
+	h.Lock()
+	var bases []string
+	for base := range h.ejected {
+		bases = append(bases, base)
+	}
+	h.Unlock()
+	if list := fwdList(); cfg().healthcheck && !strings.HasPrefix(list, "unix://") {
+		for _, base := range append(upstreams(list), upstreams(failoverList())...) {
+			if !h.Ejected(base) {
+				bases = append(bases, base)
+			}
+		}
+	}
+	batch := NewMetricBatch()
+	for _, base := range bases {
+		ok := ping(base, timeout)
+		if ok || cfg().healthcheck {
+			h.Result(base, ok)
+		}
+		if cfg().healthcheck {
+			healthy := "1"
+			if h.Ejected(base) {
+				healthy = "0"
+			}
+			batch.Add(fmt.Sprintf("%s.upstream.%s.healthy", cfg().graphiteprefix, upstreamMetric(base)), healthy)
+		}
+	}
+	if len(batch.metrics) > 0 {
+		gr.SendBatch(batch.metrics)
+	}
+}
+
+// ping is true when /ping of the upstream answers 200 within the timeout
+func ping(base string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/ping", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// upstreamMetric is the graphite node of an upstream, its host and port
+func upstreamMetric(base string) string {
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		base = u.Host
+	}
+	return strings.NewReplacer(".", "_", ":", "_").Replace(base)
+}
+
+// backgroundProbe probes the ejected upstreams every interval
+func (h *UpstreamHealth) backgroundProbe(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			h.probe(interval)
+		}
+	}()
+}
+
+// newClient returns a client with the upstream keep-alive and TLS settings,
+// dialing the -fwd unix socket if set
+func newClient() (*http.Client, error) {
+	_, socket := upstream("")
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: time.Duration(cfg().upkeepalive) * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.MaxIdleConnsPerHost = 1000
+	transport.IdleConnTimeout = time.Duration(cfg().upidle) * time.Second
+	config, err := upstreamTLS(cfg())
+	if err != nil {
+		return nil, fmt.Errorf("upstream tls: %v", err)
+	}
+	transport.TLSClientConfig = config
+	if socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		transport.Proxy = nil
+	} else if cfg().httpproxy != "" {
+		proxy, err := url.Parse(cfg().httpproxy)
+		if err != nil {
+			return nil, fmt.Errorf("httpproxy: %v", err)
+		}
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if noProxy(req.URL.Hostname(), cfg().noproxy) {
+				return nil, nil
+			}
+			return proxy, nil
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// noProxy checks the host against a NO_PROXY style list: hosts, IPs,
+// CIDRs, domains matching their subdomains too (with or without the
+// leading dot) and * for all hosts
+func noProxy(host, list string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		default:
+			host = strings.ToLower(host)
+			domain := strings.TrimPrefix(entry, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripCredentials drops the clickhouse user and password params a client
+// put in the url when -chuser or -vaultpath is set, the proxy sends its own
+func stripCredentials(u *url.URL) {
+	if user, password := clickhouseCredentials(); user == "" && password == "" {
+		return
+	}
+	values := u.Query()
+	_, user := values["user"]
+	_, password := values["password"]
+	if !user && !password {
+		return
+	}
+	values.Del("user")
+	values.Del("password")
+	u.RawQuery = values.Encode()
+}
+
+// injectCredentials sets the clickhouse credentials headers of an upstream
+// request, batches buffered before may still have params of their own
+func injectCredentials(req *http.Request) {
+	user, password := clickhouseCredentials()
+	if user == "" && password == "" {
+		return
+	}
+	stripCredentials(req.URL)
+	if user != "" {
+		req.Header.Set("X-ClickHouse-User", user)
+	}
+	req.Header.Set("X-ClickHouse-Key", password)
+}
+
+// do sends the request, a failure on a reused keep-alive connection is retried
+// once on a fresh one, as upstream may have closed it on restart or idle timeout
+func do(req *http.Request) (*http.Response, error) {
+	injectCredentials(req)
+	reused := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil && (reused || isIdleClose(err)) && req.GetBody != nil {
+		gr.SimpleSend(fmt.Sprintf("%s.stale_retries", cfg().graphiteprefix), "1")
+		client.CloseIdleConnections()
+		req.Body, _ = req.GetBody()
+		resp, err = client.Do(req)
+	}
+	return resp, err
+}
+
+// isIdleClose checks for the transport error of a keep-alive connection the
+// upstream closed as idle while the request was being written
+func isIdleClose(err error) bool {
+	return strings.Contains(err.Error(), "server closed idle connection")
+}
+
+// forwardURI rewrites a buffer key to the upstream url
+func forwardURI(key string) string {
+	base, _ := upstream(key)
+	return forwardTo(key, base)
+}
+
+// previewURI is forwardURI without taking the turn of the round-robin
+func previewURI(key string) string {
+	base, _ := peekUpstream(key)
+	return forwardTo(key, base)
+}
+
+// forwardTo rewrites a buffer key to the url of the upstream base, the -repl
+// string the key starts with is replaced by the base. A key without it, like
+// the /path?query keys, gets the base in front and the rest of its -repl
+// strings replaced with -replmode=all
+func forwardTo(key, base string) string {
+	if cfg().repl == "" {
+		return base + key
+	}
+	if !strings.HasPrefix(key, cfg().repl) {
+		if atomic.CompareAndSwapUint32(&replWarned, 0, 1) {
+			grlog(LEVEL_WARN, "repl ", cfg().repl, " not at the start of key, the upstream is put in front: ", hidePassword(key))
+		}
+		key = cfg().repl + key
+	}
+	n := 1
+	if cfg().replmode == "all" && cfg().repl != "" {
+		n = -1
+	}
+	return strings.Replace(key, cfg().repl, base, n)
+}
+
+// copyResponse passes the upstream response to the client as is, an encoded
+// body keeps its Content-Encoding and is never decompressed on the way. A
+// success body is streamed, an error body is read up to -maxrespbytes and
+// returned for logging
+func copyResponse(w http.ResponseWriter, resp *http.Response) (body []byte, truncated bool, err error) {
+	for _, h := range []string{"Content-Type", "Content-Encoding", "X-ClickHouse-Query-Id", "X-ClickHouse-Summary"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if isOKStatus(resp.StatusCode) {
+		w.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(w, resp.Body)
+		return nil, false, err
+	}
+	body, truncated = readErrorBody(resp)
+	w.WriteHeader(resp.StatusCode)
+	_, err = w.Write(body)
+	return body, truncated, err
+}
+
+// readErrorBody reads up to -maxrespbytes of an error response, truncated is
+// set when the body was longer
+func readErrorBody(resp *http.Response) (body []byte, truncated bool) {
+	if cfg().maxrespbytes <= 0 {
+		body, _ = ioutil.ReadAll(resp.Body)
+		return body, false
+	}
+	body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, int64(cfg().maxrespbytes)+1))
+	if len(body) > cfg().maxrespbytes {
+		return body[:cfg().maxrespbytes], true
+	}
+	return body, false
+}
+
+// responseText returns the response body for logging, gzip bodies are decompressed
+func responseText(header http.Header, body []byte) string {
+	if header.Get("Content-Encoding") != "gzip" {
+		return string(body)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return string(body)
+	}
+	text, err := ioutil.ReadAll(io.LimitReader(r, int64(len(body))*32))
+	if err != nil {
+		return string(body)
+	}
+	return string(text)
+}
+
+// isSyncTable checks the table against -synctables
+func isSyncTable(table string) bool {
+	if cfg().synctables == "" {
+		return false
+	}
+	for _, t := range strings.Split(cfg().synctables, ",") {
+		if strings.TrimSpace(t) == table {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardSync sends the insert upstream right away and returns the upstream
+// response to the client, the client retries on errors so nothing is saved
+func forwardSync(w http.ResponseWriter, r *http.Request, key, table string, body []byte, rowcount int) {
+	base, _ := upstream(key)
+	uri := forwardTo(key, base)
+	req, err := http.NewRequestWithContext(r.Context(), "POST", uri, bytes.NewReader(body))
+	if err != nil {
+		errorMetrics(table)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ae := r.Header.Get("Accept-Encoding"); ae != "" {
+		req.Header.Set("Accept-Encoding", ae)
+	}
+	if cfg().tracing {
+		req.Header.Set("traceparent", childTraceparent(r.Header.Get("traceparent")))
+	}
+	sentMetrics(table, rowcount, len(body))
+	atomic.AddUint32(&out, 1)
+	inflight.acquire(int64(len(body)), int64(cfg().maxinflightbytes))
+	defer inflight.release(int64(len(body)))
+	sent := time.Now()
+	resp, err := do(req)
+	forwardLatency.Observe(table, time.Since(sent))
+	upstreamHealth.Result(base, err == nil && resp.StatusCode < 500)
+	if err != nil {
+		errorMetrics(table)
+		grlog(LEVEL_ERR, "Sync request error: ", hidePassword(uri), " error: ", err, Fields{"component": "sync", "table": table})
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Server", "proxyhouse "+version)
+	respBody, truncated, err := copyResponse(w, resp)
+	if err != nil || !isOKStatus(resp.StatusCode) {
+		errorMetrics(table)
+		text := responseText(resp.Header, respBody)
+		if truncated {
+			text += fmt.Sprintf(" ...(truncated at %d bytes)", cfg().maxrespbytes)
+		}
+		grlog(LEVEL_ERR, "Sync request error: ", hidePassword(uri), " status: ", resp.StatusCode, " body: ", text, Fields{"component": "sync", "table": table})
+		recentErrors.Add(table, key, resp.StatusCode, text)
+		return
+	}
+	atomic.StoreInt64(&lastFlush, time.Now().UnixNano())
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+// testClient returns a new upstream client, failing the test on an error
+func testClient(t *testing.T) *http.Client {
+	t.Helper()
+	c, err := newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestForwardURI(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd = "http://ch:8123" })
+	for _, tc := range []struct {
+		repl, mode, key, want string
+	}{
+		{"", "first", "?query=INSERT%20INTO%20t%20VALUES", "http://ch:8123?query=INSERT%20INTO%20t%20VALUES"},
+		{"", "all", "?query=INSERT%20INTO%20t%20VALUES", "http://ch:8123?query=INSERT%20INTO%20t%20VALUES"},
+		{"", "first", "/db?query=x", "http://ch:8123/db?query=x"},
+		{"http://ph:8124", "first", "http://ph:8124?query=x&from=http://ph:8124", "http://ch:8123?query=x&from=http://ph:8124"},
+		{"http://ph:8124", "all", "http://ph:8124?query=x&from=http://ph:8124", "http://ch:8123?query=x&from=http://ch:8123"},
+		{"http://ph:8124", "first", "?query=x", "http://ch:8123?query=x"},
+		{"/db1", "first", "/db1?query=x", "http://ch:8123?query=x"},
+		{"http://ph:8124", "first", "/?query=x&from=http://ph:8124", "http://ch:8123/?query=x&from=http://ph:8124"},
+		{"http://ph:8124", "all", "/?query=x&from=http://ph:8124", "http://ch:8123/?query=x&from=http://ch:8123"},
+	} {
+		configure(func(c *Config) { c.repl, c.replmode = tc.repl, tc.mode })
+		if got := forwardURI(tc.key); got != tc.want {
+			t.Errorf("repl %q %s %q: want %q; got %q", tc.repl, tc.mode, tc.key, tc.want, got)
+		}
+	}
+}
+
+func TestUnixSocketUpstream(t *testing.T) {
+	inTempDir(t)
+	dir, err := ioutil.TempDir("", "proxyhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "ch.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query, body string
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		query, body = r.URL.Query().Get("query"), string(b)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	defer func(c *http.Client, cf Config) { client = c; restoreConfig(cf) }(client, *cfg())
+	configure(func(c *Config) { c.fwd = "unix://" + socket })
+	client = testClient(t)
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1),(2)"), 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if query != "INSERT INTO t VALUES" || body != "(1),(2)" {
+		t.Errorf("want query 'INSERT INTO t VALUES' body '(1),(2)'; got '%s' '%s'", query, body)
+	}
+}
+
+func TestCopyResponseGzip(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("Code: 16. DB::Exception: No such column"))
+	zw.Close()
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(gz.Bytes())
+	}))
+	defer ch.Close()
+
+	req, _ := http.NewRequest("POST", ch.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	w := httptest.NewRecorder()
+	body, _, err := copyResponse(w, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("code: want 400; got %d", w.Code)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Content-Encoding: want gzip; got '%s'", w.Header().Get("Content-Encoding"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), gz.Bytes()) {
+		t.Errorf("body: want gzip bytes passed untouched")
+	}
+	if got := responseText(resp.Header, body); got != "Code: 16. DB::Exception: No such column" {
+		t.Errorf("text: want decompressed message; got %q", got)
+	}
+	if got := responseText(http.Header{}, []byte("plain")); got != "plain" {
+		t.Errorf("plain text: want 'plain'; got %q", got)
+	}
+}
+
+func TestCopyResponseCap(t *testing.T) {
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.maxrespbytes = 8 })
+	for _, tc := range []struct {
+		code      int
+		body      string
+		want      string
+		truncated bool
+	}{
+		{http.StatusOK, "Ok. a long success body", "Ok. a long success body", false},
+		{http.StatusBadRequest, "Code: 16. DB::Exception", "Code: 16", true},
+		{http.StatusBadRequest, "short", "short", false},
+	} {
+		resp := &http.Response{StatusCode: tc.code, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(tc.body))}
+		w := httptest.NewRecorder()
+		_, truncated, err := copyResponse(w, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tc.code || w.Body.String() != tc.want || truncated != tc.truncated {
+			t.Errorf("%d %q: want %q truncated %v; got %d %q truncated %v", tc.code, tc.body, tc.want, tc.truncated, w.Code, w.Body.String(), truncated)
+		}
+	}
+}
+
+func TestInflight(t *testing.T) {
+	f := newInflight()
+	f.acquire(8, 10)
+	done := make(chan struct{})
+	go func() {
+		f.acquire(5, 10)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("want acquire over the limit to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := f.Bytes(); got != 8 {
+		t.Errorf("bytes: want 8; got %d", got)
+	}
+	f.release(8)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("want acquire to proceed after release")
+	}
+	f.release(5)
+
+	// a batch over the limit goes alone
+	f.acquire(20, 10)
+	if got := f.Bytes(); got != 20 {
+		t.Errorf("oversized: want 20; got %d", got)
+	}
+	f.release(20)
+}
+
+func TestStaleConnectionRetry(t *testing.T) {
+	inTempDir(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var requests int32
+	// the first connection answers one request, then reads the next and
+	// closes like a restarted upstream
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for i := 0; ; i++ {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					ioutil.ReadAll(req.Body)
+					n := atomic.AddInt32(&requests, 1)
+					if i > 0 && n == 2 {
+						return
+					}
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+				}
+			}(c)
+		}
+	}()
+
+	defer func(c *http.Client, cf Config) { client = c; restoreConfig(cf) }(client, *cfg())
+	configure(func(c *Config) { c.fwd = "http://" + l.Addr().String() })
+	client = testClient(t)
+	for i := 0; i < 2; i++ {
+		if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err != nil {
+			t.Fatalf("send %d: want retry on a fresh connection; got %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("want 3 upstream requests; got %d", n)
+	}
+}
+
+func TestSyncTables(t *testing.T) {
+	var got []string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = append(got, string(b))
+		w.Header().Set("X-ClickHouse-Summary", `{"written_rows":"1"}`)
+		w.Write([]byte("Ok.\n"))
+	}))
+	defer ch.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.synctables = ch.URL, "billing, payments" })
+	resetStore()
+	defer resetStore()
+
+	w := httptest.NewRecorder()
+	dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20billing%20VALUES", strings.NewReader("(1)")))
+	if w.Code != http.StatusOK || w.Body.String() != "Ok.\n" || w.Header().Get("X-ClickHouse-Summary") == "" {
+		t.Errorf("sync table: want upstream response; got %d %q", w.Code, w.Body.String())
+	}
+	if len(got) != 1 || got[0] != "(1)" {
+		t.Errorf("sync table: want forwarded right away; got %q", got)
+	}
+
+	w = httptest.NewRecorder()
+	dorequest(w, httptest.NewRequest("POST", "/?query=INSERT%20INTO%20events%20VALUES", strings.NewReader("(2)")))
+	if len(got) != 1 {
+		t.Errorf("other table: want buffered; got %q", got)
+	}
+	if keys, _, _ := store.stats(); keys != 1 {
+		t.Errorf("other table: want 1 buffered key; got %d", keys)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+	}))
+	defer proxy.Close()
+	direct := 0
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		direct++
+	}))
+	defer ch.Close()
+	defer func(c *http.Client, cf Config) { client = c; restoreConfig(cf) }(client, *cfg())
+
+	configure(func(c *Config) { c.httpproxy, c.noproxy = proxy.URL, "dc1.local, 127.0.0.0/8" })
+	client = testClient(t)
+	for _, uri := range []string{"http://ch.example:8123/", "http://ch.dc1.local:8123/", ch.URL} {
+		req, _ := http.NewRequest("POST", uri, strings.NewReader("(1)"))
+		if resp, err := do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if len(proxied) != 1 || proxied[0] != "ch.example:8123" {
+		t.Errorf("want only ch.example proxied; got %q", proxied)
+	}
+	if direct != 1 {
+		t.Errorf("want the no proxy CIDR sent directly; got %d", direct)
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	for _, tc := range []struct {
+		host, list string
+		want       bool
+	}{
+		{"ch.dc1.local", "dc1.local", true},
+		{"ch.dc1.local", ".dc1.local", true},
+		{"dc1.local", ".dc1.local", true},
+		{"xdc1.local", "dc1.local", false},
+		{"ch", "CH:8123", true},
+		{"10.1.2.3", "10.0.0.0/8", true},
+		{"10.1.2.3", "10.1.2.3", true},
+		{"192.168.0.1", "10.0.0.0/8,ch", false},
+		{"anything", "*", true},
+		{"ch", "", false},
+	} {
+		if got := noProxy(tc.host, tc.list); got != tc.want {
+			t.Errorf("%s in %q: want %v; got %v", tc.host, tc.list, tc.want, got)
+		}
+	}
+}
+
+func TestReadErrorBody(t *testing.T) {
+	defer restoreConfig(*cfg())
+	for _, tc := range []struct {
+		max, size int
+		want      int
+		truncated bool
+	}{
+		{10, 5, 5, false},
+		{10, 10, 10, false},
+		{10, 1 << 20, 10, true},
+		{0, 100, 100, false},
+	} {
+		configure(func(c *Config) { c.maxrespbytes = tc.max })
+		body := &countReader{r: strings.NewReader(strings.Repeat("x", tc.size))}
+		got, truncated := readErrorBody(&http.Response{Body: ioutil.NopCloser(body)})
+		if len(got) != tc.want || truncated != tc.truncated {
+			t.Errorf("max %d, size %d: want %d bytes, truncated %v; got %d, %v", tc.max, tc.size, tc.want, tc.truncated, len(got), truncated)
+		}
+		if tc.max > 0 && body.n > tc.max+1 {
+			t.Errorf("max %d: want at most %d bytes read; got %d", tc.max, tc.max+1, body.n)
+		}
+	}
+}
+
+// idleCloseTransport fails the first request like a keep-alive connection
+// closed by the upstream
+type idleCloseTransport struct{ calls int }
+
+func (rt *idleCloseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.calls++
+	ioutil.ReadAll(req.Body)
+	if rt.calls == 1 {
+		return nil, errors.New("http: server closed idle connection")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+}
+
+func TestIdleCloseRetry(t *testing.T) {
+	inTempDir(t)
+	rt := &idleCloseTransport{}
+	defer func(c *http.Client) { client = c }(client)
+	client = &http.Client{Transport: rt}
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err != nil {
+		t.Errorf("want idle close retried; got %v", err)
+	}
+	if rt.calls != 2 {
+		t.Errorf("want 2 calls; got %d", rt.calls)
+	}
+	if files, _ := filePathWalkDir(ERROR_DIR); len(files) != 0 {
+		t.Errorf("want no error files; got %q", files)
+	}
+}
+
+func TestUpstreamEjection(t *testing.T) {
+	var healthy int32
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ch.Close()
+	defer func(h *UpstreamHealth, c Config) { upstreamHealth = h; restoreConfig(c) }(upstreamHealth, *cfg())
+	configure(func(c *Config) { c.ejectafter = 2 })
+	h := newUpstreamHealth()
+	other := "http://other:8123"
+
+	h.Result(ch.URL, false)
+	if got := h.pick([]string{ch.URL, other}); got != ch.URL {
+		t.Errorf("one failure: want %s in the rotation; got %s", ch.URL, got)
+	}
+	h.Result(ch.URL, false)
+	if got := h.pick([]string{ch.URL, other}); got != other {
+		t.Errorf("two failures: want %s ejected; got %s", ch.URL, got)
+	}
+	h.Result(other, false)
+	h.Result(other, false)
+	if got := h.pick([]string{ch.URL, other}); got != ch.URL {
+		t.Errorf("all ejected: want the first one; got %s", got)
+	}
+
+	h.probe(time.Second)
+	if states := h.States(); states[0] != [2]string{ch.URL, "ejected"} {
+		t.Errorf("failed probe: want still ejected; got %v", states)
+	}
+	atomic.StoreInt32(&healthy, 1)
+	h.probe(time.Second)
+	if states := h.States(); states[0] != [2]string{ch.URL, "ok"} || states[1] != [2]string{other, "ejected"} {
+		t.Errorf("ping 200: want reinstated; got %v", states)
+	}
+
+	// flushes count, /status shows the state
+	atomic.StoreInt32(&healthy, 0)
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.fwd, c.retries = ch.URL, 0 })
+	upstreamHealth = newUpstreamHealth()
+	deliver(context.Background(), "?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1)
+	deliver(context.Background(), "?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1)
+	w := httptest.NewRecorder()
+	showstatus(w, httptest.NewRequest("GET", "/status", nil))
+	if want := "upstream:" + ch.URL + " ejected\r\n"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("status: want %q; got %q", want, w.Body.String())
+	}
+}
+
+func TestInjectCredentials(t *testing.T) {
+	var user, key, query string
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, key, query = r.Header.Get("X-ClickHouse-User"), r.Header.Get("X-ClickHouse-Key"), r.URL.RawQuery
+	}))
+	defer ch.Close()
+	defer func(c *http.Client, cf Config) { client = c; restoreConfig(cf) }(client, *cfg())
+	configure(func(c *Config) { c.fwd, c.chuser, c.chpassword = ch.URL, "writer", "secret" })
+	client = testClient(t)
+
+	resetStore()
+	defer resetStore()
+	for _, u := range []string{"/?user=a&password=1&query=INSERT%20INTO%20t%20VALUES", "/?query=INSERT%20INTO%20t%20VALUES&user=b&password=2"} {
+		w := httptest.NewRecorder()
+		dorequest(w, httptest.NewRequest("POST", u, strings.NewReader("(1)")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: want 200; got %d", u, w.Code)
+		}
+	}
+	if len(store.Req) != 1 {
+		t.Errorf("want the producers in one buffer; got %d keys", len(store.Req))
+	}
+
+	// a batch saved before -chuser was set
+	if err := send("?query=INSERT%20INTO%20t%20VALUES&user=a&password=1", []byte("(1)"), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if user != "writer" || key != "secret" || strings.Contains(query, "user=") || strings.Contains(query, "password=") {
+		t.Errorf("want -chuser headers only; got user %q key %q query %q", user, key, query)
+	}
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	var counts [2]int32
+	var servers []*httptest.Server
+	for i := range counts {
+		i := i
+		ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&counts[i], 1)
+		}))
+		defer ch.Close()
+		servers = append(servers, ch)
+	}
+	defer func(h *UpstreamHealth, c *http.Client, cf Config) {
+		upstreamHealth, client = h, c
+		restoreConfig(cf)
+	}(upstreamHealth, client, *cfg())
+	configure(func(c *Config) { c.fwd = servers[0].URL + ", " + servers[1].URL })
+	configure(func(c *Config) { c.ejectafter = 1 })
+	upstreamHealth = newUpstreamHealth()
+	client = testClient(t)
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := [2]int32{atomic.LoadInt32(&counts[0]), atomic.LoadInt32(&counts[1])}; got != [2]int32{2, 2} {
+		t.Errorf("want 2 flushes each; got %v", got)
+	}
+
+	// an ejected host is skipped
+	upstreamHealth.Result(servers[0].URL, false)
+	for i := 0; i < 3; i++ {
+		send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0)
+	}
+	if got := [2]int32{atomic.LoadInt32(&counts[0]), atomic.LoadInt32(&counts[1])}; got != [2]int32{2, 5} {
+		t.Errorf("want the flushes on the second host; got %v", got)
+	}
+
+	configure(func(c *Config) { c.fwd = servers[0].URL + ",unix:///tmp/ch.sock" })
+	if problems := strings.Join(validateFlags(cfg()), "\n"); !strings.Contains(problems, "unix socket can't be in a list") {
+		t.Errorf("want a problem for a unix socket in a list; got %q", problems)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	inTempDir(t)
+	var status int32 = http.StatusBadGateway
+	var primary, secondary int32
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primary, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer ch.Close()
+	dr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondary, 1)
+	}))
+	defer dr.Close()
+	defer func(h *UpstreamHealth, c *http.Client, cf Config) {
+		upstreamHealth, client = h, c
+		restoreConfig(cf)
+	}(upstreamHealth, client, *cfg())
+	configure(func(c *Config) { c.fwd, c.failover = ch.URL, dr.URL })
+	upstreamHealth = newUpstreamHealth()
+	client = testClient(t)
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+
+	if err := send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0); err != nil {
+		t.Errorf("502: want the failover host to take it; got %v", err)
+	}
+	if primary != 1 || secondary != 1 {
+		t.Errorf("want one send each; got %d %d", primary, secondary)
+	}
+	if files, _ := filePathWalkDir(ERROR_DIR); len(files) != 0 {
+		t.Errorf("want no error files; got %q", files)
+	}
+
+	// a bad insert stays a bad insert on any host
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	send("?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, 0)
+	if primary != 2 || secondary != 1 {
+		t.Errorf("400: want no failover; got %d %d", primary, secondary)
+	}
+
+	configure(func(c *Config) { c.failover = "ch-dr:8123" })
+	if problems := strings.Join(validateFlags(cfg()), "\n"); !strings.Contains(problems, "-failover") {
+		t.Errorf("want a problem for a host without scheme; got %q", problems)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var down int32 = 1
+	ch1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ch1.Close()
+	ch2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ch2.Close()
+	sent := make(batchSender, 10)
+	defer func(h *UpstreamHealth, m *Metrics, c Config) {
+		upstreamHealth, gr = h, m
+		restoreConfig(c)
+	}(upstreamHealth, gr, *cfg())
+	configure(func(c *Config) {
+		c.fwd, c.ejectafter, c.healthcheck, c.graphiteprefix = ch1.URL+","+ch2.URL, 2, true, "ph"
+	})
+	upstreamHealth = newUpstreamHealth()
+	gr = NewMetrics(sent, 10)
+
+	// the circuit opens after -ejectafter failed pings, no flush needed
+	upstreamHealth.probe(time.Second)
+	if upstreamHealth.Ejected(ch2.URL) {
+		t.Error("one failed ping: want still in the rotation")
+	}
+	upstreamHealth.probe(time.Second)
+	if states := upstreamHealth.States(); len(states) != 2 || !upstreamHealth.Ejected(ch2.URL) || upstreamHealth.Ejected(ch1.URL) {
+		t.Errorf("two failed pings: want %s ejected; got %v", ch2.URL, states)
+	}
+	for i := 0; i < 4; i++ {
+		if got, _ := upstream(""); got != ch1.URL {
+			t.Errorf("want flushes on %s only; got %s", ch1.URL, got)
+		}
+	}
+	// a batch every probe, the ejection is another metric
+	var batch []graphite.Metric
+	for probes := 0; probes < 2; {
+		select {
+		case batch = <-sent:
+			if strings.HasSuffix(batch[0].Name, ".healthy") {
+				probes++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("want a batch every probe")
+		}
+	}
+	if len(batch) != 2 || batch[1].Name != "ph.upstream."+upstreamMetric(ch2.URL)+".healthy" || batch[1].Value != "0" || batch[0].Value != "1" {
+		t.Errorf("want healthy 1 and 0; got %v", batch)
+	}
+	w := httptest.NewRecorder()
+	showmetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `upstream="`+ch2.URL+`"} 0`) {
+		t.Errorf("want proxyhouse_upstream_healthy 0; got %s", w.Body)
+	}
+
+	// and closes on the first 200
+	atomic.StoreInt32(&down, 0)
+	upstreamHealth.probe(time.Second)
+	if upstreamHealth.Ejected(ch2.URL) {
+		t.Error("ping 200: want reinstated")
+	}
+}
+
+func TestUpstreamWeights(t *testing.T) {
+	defer func(h *UpstreamHealth, c Config) { upstreamHealth = h; restoreConfig(c) }(upstreamHealth, *cfg())
+	configure(func(c *Config) { c.fwd = "http://ch1:8123*3, http://ch2:8123" })
+	upstreamHealth = newUpstreamHealth()
+	if problems := validateFlags(cfg()); len(problems) != 0 {
+		t.Errorf("want valid flags; got %q", problems)
+	}
+
+	var got []string
+	for i := 0; i < 8; i++ {
+		base, _ := upstream("")
+		got = append(got, strings.TrimPrefix(base, "http://"))
+	}
+	want := "ch1:8123 ch1:8123 ch2:8123 ch1:8123 ch1:8123 ch1:8123 ch2:8123 ch1:8123"
+	if strings.Join(got, " ") != want {
+		t.Errorf("want %s; got %s", want, strings.Join(got, " "))
+	}
+
+	// the weight of an ejected host is left out
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.ejectafter = 1 })
+	upstreamHealth.Result("http://ch1:8123", false)
+	for i := 0; i < 3; i++ {
+		if base, _ := upstream(""); base != "http://ch2:8123" {
+			t.Errorf("want ch2 only; got %s", base)
+		}
+	}
+
+	configure(func(c *Config) { c.fwd = "http://ch1:8123*0,http://ch2:8123*x" })
+	if problems := validateFlags(cfg()); len(problems) != 2 {
+		t.Errorf("want 2 problems for bad weights; got %q", problems)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vault reads the clickhouse credentials from a Vault secret: kv v1, kv v2
+// or the dynamic ones of the database secrets engine
+type Vault struct {
+	Addr      string
+	Path      string
+	TokenFile string
+	client    *http.Client
+}
+
+// vaultCreds are the credentials of the last read, they override -chuser and -chpassword
+var vaultCreds struct {
+	sync.RWMutex
+	user, password string
+}
+
+// NewVault returns the client of the Vault at addr, the ca file verifies https
+func NewVault(addr, path, tokenFile, ca string) (*Vault, error) {
+	config, err := tlsConfig(ca)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &Vault{
+		Addr:      strings.TrimSuffix(addr, "/"),
+		Path:      strings.Trim(path, "/"),
+		TokenFile: tokenFile,
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// token is read on every request, so a Vault agent may rotate the file,
+// VAULT_TOKEN without a file
+func (v *Vault) token() (string, error) {
+	if v.TokenFile == "" {
+		if token := os.Getenv("VAULT_TOKEN"); token != "" {
+			return token, nil
+		}
+		return "", errors.New("no -vaulttokenfile and no VAULT_TOKEN")
+	}
+	data, err := ioutil.ReadFile(v.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Read returns the username (or user) and password of the secret and its
+// lease, zero for kv secrets
+func (v *Vault) Read(ctx context.Context) (user, password string, lease time.Duration, err error) {
+	token, err := v.token()
+	if err != nil {
+		return "", "", 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", v.Addr+"/v1/"+v.Path, nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", "", 0, fmt.Errorf("%s: %s %s", v.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var secret struct {
+		LeaseDuration int                        `json:"lease_duration"`
+		Renewable     bool                       `json:"renewable"`
+		Data          map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", "", 0, fmt.Errorf("%s: %v", v.Path, err)
+	}
+	data := secret.Data
+	// kv v2 nests the secret in data.data
+	if nested, ok := data["data"]; ok {
+		data = nil
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", "", 0, fmt.Errorf("%s: %v", v.Path, err)
+		}
+	}
+	field := func(names ...string) string {
+		for _, name := range names {
+			var s string
+			if json.Unmarshal(data[name], &s) == nil && s != "" {
+				return s
+			}
+		}
+		return ""
+	}
+	user, password = field("username", "user"), field("password")
+	if password == "" {
+		return "", "", 0, fmt.Errorf("%s: no password in the secret", v.Path)
+	}
+	// the lease of a kv v1 secret is only a refresh hint
+	if secret.Renewable {
+		lease = time.Duration(secret.LeaseDuration) * time.Second
+	}
+	return user, password, lease, nil
+}
+
+// refresh reads the secret and sets vaultCreds, it returns when to read again:
+// at half the lease, every interval for kv secrets and sooner after an error
+func (v *Vault) refresh(ctx context.Context, interval time.Duration) (next time.Duration, err error) {
+	user, password, lease, err := v.Read(ctx)
+	if err != nil {
+		gr.SimpleSend(fmt.Sprintf("%s.vault_errors", cfg().graphiteprefix), "1")
+		if interval > 30*time.Second {
+			interval = 30 * time.Second
+		}
+		return interval, err
+	}
+	vaultCreds.Lock()
+	changed := vaultCreds.user != user || vaultCreds.password != password
+	vaultCreds.user, vaultCreds.password = user, password
+	vaultCreds.Unlock()
+	if changed {
+		grlog(LEVEL_INFO, "Clickhouse credentials read from vault ", v.Path, Fields{"component": "vault"})
+	}
+	// every read of a database secret makes a new user, read it once per lease
+	if lease > 0 {
+		interval = lease / 2
+	}
+	return interval, nil
+}
+
+// background reads the secret again after next and then when refresh says
+func (v *Vault) background(next, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(next)
+			var err error
+			if next, err = v.refresh(context.Background(), interval); err != nil {
+				grlog(LEVEL_ERR, "Vault read error, retry in ", next, ": ", err, Fields{"component": "vault"})
+			}
+		}
+	}()
+}
+
+// clickhouseCredentials returns the user and password of upstream requests,
+// from Vault if -vaultpath is set or else -chuser and -chpassword
+func clickhouseCredentials() (user, password string) {
+	vaultCreds.RLock()
+	defer vaultCreds.RUnlock()
+	user, password = cfg().chuser, cfg().chpassword
+	if vaultCreds.user != "" {
+		user = vaultCreds.user
+	}
+	if vaultCreds.password != "" {
+		password = vaultCreds.password
+	}
+	return user, password
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVaultRefresh(t *testing.T) {
+	secrets := map[string]string{
+		"/v1/secret/data/clickhouse":  `{"lease_duration":0,"data":{"data":{"password":"kv2"},"metadata":{"version":3}}}`,
+		"/v1/kv/clickhouse":           `{"lease_duration":2764800,"data":{"user":"writer","password":"kv1"}}`,
+		"/v1/database/creds/inserter": `{"lease_duration":3600,"renewable":true,"data":{"username":"v-inserter-1","password":"dyn"}}`,
+		"/v1/kv/empty":                `{"data":{"user":"writer"}}`,
+	}
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		secret, ok := secrets[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(secret))
+	}))
+	defer vault.Close()
+	defer func(c Config) {
+		restoreConfig(c)
+		vaultCreds.user, vaultCreds.password = "", ""
+	}(*cfg())
+	configure(func(c *Config) { c.chuser, c.chpassword = "default", "" })
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(tokenFile, []byte("s.token\n"), 0600)
+
+	for _, tc := range []struct {
+		path, user, password string
+		next                 time.Duration
+	}{
+		{"secret/data/clickhouse", "default", "kv2", 5 * time.Minute},
+		{"/kv/clickhouse", "writer", "kv1", 5 * time.Minute},
+		{"database/creds/inserter", "v-inserter-1", "dyn", 30 * time.Minute},
+	} {
+		v, err := NewVault(vault.URL+"/", tc.path, tokenFile, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		vaultCreds.user, vaultCreds.password = "", ""
+		next, err := v.refresh(context.Background(), 5*time.Minute)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if user, password := clickhouseCredentials(); user != tc.user || password != tc.password || next != tc.next {
+			t.Errorf("%s: want %s %s next %s; got %s %s %s", tc.path, tc.user, tc.password, tc.next, user, password, next)
+		}
+	}
+
+	// a failed read keeps the last credentials and retries sooner
+	for _, path := range []string{"kv/empty", "kv/missing"} {
+		v, _ := NewVault(vault.URL, path, tokenFile, "")
+		if next, err := v.refresh(context.Background(), 5*time.Minute); err == nil || next != 30*time.Second {
+			t.Errorf("%s: want an error and a retry in 30s; got %v %s", path, err, next)
+		}
+	}
+	if user, password := clickhouseCredentials(); user != "v-inserter-1" || password != "dyn" {
+		t.Errorf("want the last credentials; got %s %s", user, password)
+	}
+
+	// the token file is read on every refresh
+	ioutil.WriteFile(tokenFile, []byte("s.revoked"), 0600)
+	v, _ := NewVault(vault.URL, "kv/clickhouse", tokenFile, "")
+	if _, err := v.refresh(context.Background(), time.Minute); err == nil {
+		t.Error("revoked token: want an error")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Webhook posts health transitions to -webhook: "errors" when the first batch
+// is saved to the errors dir after a healthy period, "drained" when recovery
+// has resent them all. Events fire on transitions only, a long outage is one call
+type Webhook struct {
+	sync.Mutex
+	failing bool
+	client  *http.Client
+}
+
+// WebhookEvent is the JSON body posted to -webhook
+type WebhookEvent struct {
+	Event      string `json:"event"`
+	Time       string `json:"time"`
+	Host       string `json:"host"`
+	ErrorFiles int    `json:"error_files"`
+	Version    string `json:"version"`
+}
+
+var notifier = &Webhook{client: &http.Client{Timeout: 5 * time.Second}}
+
+// saved is called for every batch written to the errors dir
+func (h *Webhook) saved() {
+	if cfg().webhook == "" {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if !h.failing {
+		h.failing = true
+		go h.post("errors", errorCount())
+	}
+}
+
+// recovered is called after a recovery pass with the error files left, a
+// backlog found at start is not reported but gets its "drained" event
+func (h *Webhook) recovered(pending int) {
+	if cfg().webhook == "" {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if pending > 0 {
+		h.failing = true
+	} else if h.failing {
+		h.failing = false
+		go h.post("drained", 0)
+	}
+}
+
+// post sends the event, a failed call is logged and not retried
+func (h *Webhook) post(event string, errorFiles int) {
+	host, _ := os.Hostname()
+	body, _ := json.Marshal(WebhookEvent{
+		Event:      event,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Host:       host,
+		ErrorFiles: errorFiles,
+		Version:    version,
+	})
+	resp, err := h.client.Post(cfg().webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		grlog(LEVEL_ERR, "Webhook error: ", event, " error: ", err, Fields{"component": "webhook"})
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		grlog(LEVEL_ERR, "Webhook error: ", event, " status: ", resp.StatusCode, Fields{"component": "webhook"})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	events := make(chan WebhookEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e WebhookEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer hook.Close()
+	defer restoreConfig(*cfg())
+	configure(func(c *Config) { c.webhook = hook.URL })
+	inTempDir(t)
+	h := &Webhook{client: hook.Client()}
+
+	next := func() string {
+		select {
+		case e := <-events:
+			return e.Event
+		case <-time.After(100 * time.Millisecond):
+			return ""
+		}
+	}
+
+	h.recovered(0)
+	if e := next(); e != "" {
+		t.Errorf("healthy: want no event; got %q", e)
+	}
+	h.saved()
+	if e := next(); e != "errors" {
+		t.Errorf("first error: want errors; got %q", e)
+	}
+	h.saved()
+	h.recovered(3)
+	if e := next(); e != "" {
+		t.Errorf("more errors: want no event; got %q", e)
+	}
+	h.recovered(0)
+	if e := next(); e != "drained" {
+		t.Errorf("backlog cleared: want drained; got %q", e)
+	}
+	h.recovered(0)
+	if e := next(); e != "" {
+		t.Errorf("still healthy: want no event; got %q", e)
+	}
+
+	// a backlog found at start is drained without an errors event
+	h = &Webhook{client: hook.Client()}
+	h.recovered(2)
+	h.recovered(0)
+	if e := next(); e != "drained" {
+		t.Errorf("backlog at start: want drained; got %q", e)
+	}
+}